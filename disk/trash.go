@@ -0,0 +1,190 @@
+package disk
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ricochet2200/go-disk-usage/du"
+
+	"github.com/zeisss/mediasyncer/libsyncer"
+)
+
+// The trash of a volume is the directory libsyncer.TrashDir. Each trashed file is moved to
+// TrashDir/<unix time in nanoseconds>/<path>, so the trash keeps several versions of a file.
+
+// inTrash returns true if the relative path is inside the trash.
+func inTrash(path string) bool {
+	p := filepath.ToSlash(filepath.Clean(strings.TrimPrefix(path, "/")))
+	return p == libsyncer.TrashDir || strings.HasPrefix(p, libsyncer.TrashDir+"/")
+}
+
+func (v *Volume) trashPath() string {
+	return filepath.Join(v.Path, libsyncer.TrashDir)
+}
+
+// Trash moves the file at path into the trash. If the trash is disabled, the file is deleted.
+func (v *Volume) Trash(path string) error {
+	if v.TrashConfig.Retention <= 0 {
+		return v.Delete(path)
+	}
+	if inTrash(path) {
+		return fmt.Errorf("%s is in the trash", path)
+	}
+
+	src := filepath.Join(v.Path, path)
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	fp := filepath.Join(v.trashPath(), strconv.FormatInt(time.Now().UnixNano(), 10), path)
+	if err := os.MkdirAll(filepath.Dir(fp), 0777); err != nil {
+		return err
+	}
+	if err := os.Rename(src, fp); err != nil {
+		return err
+	}
+	v.trashChanged(int64(info.Size()))
+	return nil
+}
+
+// TrashEntries returns the files in the trash, oldest first.
+func (v *Volume) TrashEntries() ([]libsyncer.TrashEntry, error) {
+	var entries []libsyncer.TrashEntry
+	err := filepath.Walk(v.trashPath(), func(fullpath string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		id, err := filepath.Rel(v.trashPath(), fullpath)
+		if err != nil {
+			return err
+		}
+		id = filepath.ToSlash(id)
+		parts := strings.SplitN(id, "/", 2)
+		deleted, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || len(parts) != 2 {
+			// Not created by Trash.
+			return nil
+		}
+		entries = append(entries, libsyncer.TrashEntry{
+			ID:      id,
+			Path:    parts[1],
+			Size:    libsyncer.ByteSize(info.Size()),
+			Deleted: time.Unix(0, deleted),
+		})
+		return nil
+	})
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Deleted.Before(entries[j].Deleted)
+	})
+	return entries, err
+}
+
+// Restore moves a file out of the trash to its original path. It fails if the path exists.
+func (v *Volume) Restore(id string) (string, error) {
+	parts := strings.SplitN(filepath.ToSlash(filepath.Clean(id)), "/", 2)
+	if len(parts) != 2 || parts[0] == ".." || inTrash(parts[1]) {
+		return "", fmt.Errorf("invalid trash entry %s", id)
+	}
+	src := filepath.Join(v.trashPath(), parts[0], parts[1])
+	info, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+
+	dst := filepath.Join(v.Path, parts[1])
+	if _, err := os.Stat(dst); err == nil {
+		return "", fmt.Errorf("%s already exists", parts[1])
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return "", err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return "", err
+	}
+	v.trashChanged(-info.Size())
+	v.removeEmptyTrashDirs(filepath.Dir(src))
+	return parts[1], nil
+}
+
+// Purge deletes the files older than the retention period and the oldest files until the
+// trash fits its size limit and need bytes are available.
+func (v *Volume) Purge(need libsyncer.ByteSize) error {
+	entries, err := v.TrashEntries()
+	if err != nil {
+		return err
+	}
+
+	var size libsyncer.ByteSize
+	for _, entry := range entries {
+		size += entry.Size
+	}
+	free := libsyncer.ByteSize(du.NewDiskUsage(v.Path).Available())
+
+	for _, entry := range entries {
+		expired := time.Since(entry.Deleted) > v.TrashConfig.Retention
+		tooBig := v.TrashConfig.MaxSize > 0 && size > v.TrashConfig.MaxSize
+		if !expired && !tooBig && free >= need {
+			break
+		}
+
+		fp := filepath.Join(v.trashPath(), filepath.FromSlash(entry.ID))
+		if err := os.Remove(fp); err != nil {
+			return err
+		}
+		v.trashChanged(-int64(entry.Size))
+		v.removeEmptyTrashDirs(filepath.Dir(fp))
+		size -= entry.Size
+		free += entry.Size
+	}
+	return nil
+}
+
+// trashSize returns the size of all files in the trash. The trash is only walked the first
+// time, afterwards the size is kept up to date by Trash, Restore and Purge.
+func (v *Volume) trashSize() uint64 {
+	v.trashMu.Lock()
+	defer v.trashMu.Unlock()
+	if !v.trashKnown {
+		v.trashBytes = 0
+		filepath.Walk(v.trashPath(), func(fullpath string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				v.trashBytes += uint64(info.Size())
+			}
+			return nil
+		})
+		v.trashKnown = true
+	}
+	return v.trashBytes
+}
+
+// trashChanged adds delta bytes to the size of the trash, if it was counted already.
+func (v *Volume) trashChanged(delta int64) {
+	v.trashMu.Lock()
+	defer v.trashMu.Unlock()
+	if !v.trashKnown {
+		return
+	}
+	if delta < 0 && uint64(-delta) > v.trashBytes {
+		v.trashBytes = 0
+		return
+	}
+	v.trashBytes = uint64(int64(v.trashBytes) + delta)
+}
+
+// removeEmptyTrashDirs removes dir and its parents up to the trash, as long as they are empty.
+func (v *Volume) removeEmptyTrashDirs(dir string) {
+	for dir != v.trashPath() && strings.HasPrefix(dir, v.trashPath()) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,182 @@
+package disk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zeisss/mediasyncer/libsyncer"
+)
+
+// newTestVolume returns a Volume in a temporary directory with a trash keeping files for
+// an hour. The directory is removed by the returned func.
+func newTestVolume(t *testing.T) (*Volume, func()) {
+	dir, err := ioutil.TempDir("", "mediasyncer-disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := Open(dir)
+	v.TrashConfig = libsyncer.TrashConfig{Retention: time.Hour}
+	return v, func() { os.RemoveAll(dir) }
+}
+
+func writeFile(t *testing.T, v *Volume, path, content string) {
+	fp := filepath.Join(v.Path, path)
+	if err := os.MkdirAll(filepath.Dir(fp), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fp, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrashAndRestore(t *testing.T) {
+	v, cleanup := newTestVolume(t)
+	defer cleanup()
+	writeFile(t, v, "movies/a.mkv", "hello")
+
+	if err := v.Trash("movies/a.mkv"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Stat("movies/a.mkv"); !os.IsNotExist(err) {
+		t.Fatalf("Expected the file to be gone, got %v", err)
+	}
+	entries, err := v.TrashEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Path != "movies/a.mkv" || entries[0].Size != 5 {
+		t.Fatalf("Unexpected entries %+v", entries)
+	}
+	if size := v.trashSize(); size != 5 {
+		t.Fatalf("Expected a trash size of 5, got %d", size)
+	}
+
+	// The trash is not part of the volume.
+	v.Walk(func(path string, info os.FileInfo, err error) error {
+		t.Errorf("Unexpected file %s", path)
+		return nil
+	})
+	if err := v.Trash(libsyncer.TrashDir + "/x"); err == nil {
+		t.Errorf("Expected an error for trashing a file in the trash")
+	}
+
+	writeFile(t, v, "movies/a.mkv", "again")
+	if _, err := v.Restore(entries[0].ID); err == nil {
+		t.Fatalf("Expected an error for restoring over an existing file")
+	}
+	os.Remove(filepath.Join(v.Path, "movies/a.mkv"))
+
+	path, err := v.Restore(entries[0].ID)
+	if err != nil || path != "movies/a.mkv" {
+		t.Fatalf("Expected movies/a.mkv to be restored, got %q %v", path, err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(v.Path, path)); string(data) != "hello" {
+		t.Fatalf("Unexpected content %q", data)
+	}
+	if size := v.trashSize(); size != 0 {
+		t.Fatalf("Expected an empty trash, got %d", size)
+	}
+	if _, err := os.Stat(v.trashPath()); err == nil {
+		if dirs, _ := ioutil.ReadDir(v.trashPath()); len(dirs) != 0 {
+			t.Fatalf("Expected the empty trash directories to be removed, got %d", len(dirs))
+		}
+	}
+}
+
+func TestRestoreRejectsPathsOutsideTheTrash(t *testing.T) {
+	v, cleanup := newTestVolume(t)
+	defer cleanup()
+	outside := filepath.Join(filepath.Dir(v.Path), filepath.Base(v.Path)+"-outside")
+	writeFile(t, v, "../"+filepath.Base(outside), "secret")
+	defer os.Remove(outside)
+
+	for _, id := range []string{
+		"../../" + filepath.Base(outside),
+		"1/../../../" + filepath.Base(outside),
+		"1/" + libsyncer.TrashDir + "/x",
+		"..",
+		"1",
+	} {
+		if _, err := v.Restore(id); err == nil {
+			t.Errorf("Expected an error for restoring %q", id)
+		}
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Fatalf("Expected the file outside the volume to be untouched: %v", err)
+	}
+}
+
+func TestTrashDisabled(t *testing.T) {
+	v, cleanup := newTestVolume(t)
+	defer cleanup()
+	v.TrashConfig.Retention = 0
+	writeFile(t, v, "a", "hello")
+
+	if err := v.Trash("a"); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := v.TrashEntries(); len(entries) != 0 {
+		t.Fatalf("Expected the file to be deleted, got %+v", entries)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	v, cleanup := newTestVolume(t)
+	defer cleanup()
+	for _, path := range []string{"a", "b", "c"} {
+		writeFile(t, v, path, "hello")
+		if err := v.Trash(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing is purged within the retention period and the size limit.
+	if err := v.Purge(0); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := v.TrashEntries(); len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %+v", entries)
+	}
+
+	// The oldest files are purged until the trash fits its size limit.
+	v.TrashConfig.MaxSize = 12
+	if err := v.Purge(0); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := v.TrashEntries()
+	if len(entries) != 2 || entries[0].Path != "b" || entries[1].Path != "c" {
+		t.Fatalf("Expected a to be purged, got %+v", entries)
+	}
+	if size := v.trashSize(); size != 10 {
+		t.Fatalf("Expected a trash size of 10, got %d", size)
+	}
+
+	// Files are purged until enough space is available.
+	v.TrashConfig.MaxSize = 0
+	if err := v.Purge(libsyncer.ByteSize(^uint64(0) >> 1)); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := v.TrashEntries(); len(entries) != 0 {
+		t.Fatalf("Expected the trash to be purged, got %+v", entries)
+	}
+
+	// Files older than the retention period are purged.
+	writeFile(t, v, "d", "hello")
+	if err := v.Trash("d"); err != nil {
+		t.Fatal(err)
+	}
+	v.TrashConfig.Retention = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if err := v.Purge(0); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := v.TrashEntries(); len(entries) != 0 {
+		t.Fatalf("Expected the expired file to be purged, got %+v", entries)
+	}
+	if size := v.trashSize(); size != 0 {
+		t.Fatalf("Expected an empty trash, got %d", size)
+	}
+}
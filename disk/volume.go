@@ -1,12 +1,19 @@
 package disk
 
 import (
+	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/ricochet2200/go-disk-usage/du"
 	"github.com/satori/go.uuid"
+
+	"github.com/zeisss/mediasyncer/libsyncer"
 )
 
 const (
@@ -17,6 +24,19 @@ const (
 type Volume struct {
 	id   string
 	Path string
+
+	// Xattrs enables preserving the extended attributes in the user namespace across transfers.
+	Xattrs bool
+
+	// TrashConfig configures the trash keeping files deleted after transfers. The trash is
+	// disabled by default.
+	TrashConfig libsyncer.TrashConfig
+
+	// trashBytes is the size of the trash, counted once and kept up to date by Trash, Restore
+	// and Purge. It is guarded by trashMu.
+	trashMu    sync.Mutex
+	trashBytes uint64
+	trashKnown bool
 }
 
 func Open(volumePath string) *Volume {
@@ -72,8 +92,13 @@ func (v *Volume) ID() string {
 	return v.id
 }
 
+// AvailableBytes returns the free space of the volume, including the space used by the trash.
 func (v *Volume) AvailableBytes() uint64 {
-	return du.NewDiskUsage(v.Path).Available()
+	return du.NewDiskUsage(v.Path).Available() + v.trashSize()
+}
+
+func (v *Volume) Capacity() uint64 {
+	return du.NewDiskUsage(v.Path).Size()
 }
 
 func (v *Volume) Walk(f filepath.WalkFunc) error {
@@ -81,6 +106,9 @@ func (v *Volume) Walk(f filepath.WalkFunc) error {
 	return filepath.Walk(v.Path, func(fullpath string, info os.FileInfo, err error) error {
 		//	fmt.Println("> " + fullpath + "\t" + info.Name())
 		if info.IsDir() {
+			if fullpath == v.trashPath() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
@@ -110,6 +138,9 @@ func (v *Volume) Read(path string) (io.ReadSeeker, error) {
 }
 
 func (v *Volume) Write(path string) (io.WriteCloser, error) {
+	if inTrash(path) {
+		return nil, fmt.Errorf("%s is in the trash", path)
+	}
 
 	fp := filepath.Join(v.Path, path)
 	directory := filepath.Dir(fp)
@@ -125,3 +156,143 @@ func (v *Volume) Delete(path string) error {
 
 	return os.Remove(fp)
 }
+
+// ReadMeta returns the modification time, the permissions and, if enabled, the extended
+// attributes of a file.
+func (v *Volume) ReadMeta(path string) (libsyncer.FileMeta, error) {
+	fp := filepath.Join(v.Path, path)
+	info, err := os.Stat(fp)
+	if err != nil {
+		return libsyncer.FileMeta{}, err
+	}
+	meta := libsyncer.FileMeta{ModTime: info.ModTime(), Mode: info.Mode().Perm()}
+	if v.Xattrs {
+		if meta.Xattrs, err = readXattrs(fp); err != nil {
+			return libsyncer.FileMeta{}, err
+		}
+	}
+	return meta, nil
+}
+
+// WriteMeta restores the metadata of a file. The modification time is restored last, as
+// changing the other metadata may update it.
+func (v *Volume) WriteMeta(path string, meta libsyncer.FileMeta) error {
+	fp := filepath.Join(v.Path, path)
+	var err error
+	if meta.Mode != 0 {
+		err = os.Chmod(fp, meta.Mode.Perm())
+	}
+	if v.Xattrs && err == nil {
+		err = writeXattrs(fp, meta.Xattrs)
+	}
+	if !meta.ModTime.IsZero() {
+		if timesErr := os.Chtimes(fp, time.Now(), meta.ModTime); err == nil {
+			err = timesErr
+		}
+	}
+	return err
+}
+
+// Rename renames a file within the volume, replacing an existing file.
+func (v *Volume) Rename(from, to string) error {
+	if inTrash(from) || inTrash(to) {
+		return fmt.Errorf("can't rename files in the trash")
+	}
+
+	fp := filepath.Join(v.Path, to)
+	if err := os.MkdirAll(filepath.Dir(fp), 0777); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(v.Path, from), fp)
+}
+
+// Move renames the file to another disk Volume. It fails if the volumes are on different
+// filesystems.
+func (v *Volume) Move(path string, to libsyncer.Volume) error {
+	target, ok := to.(*Volume)
+	if !ok {
+		return fmt.Errorf("%s is not a disk volume", to.ID())
+	}
+
+	fp := filepath.Join(target.Path, path)
+	if err := os.MkdirAll(filepath.Dir(fp), 0777); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(v.Path, path), fp)
+}
+
+// Watch watches the volume recursively with inotify and calls changed with the path of
+// each created, written, renamed or removed file or directory until stop is closed.
+// If events were lost, because the kernel queue overflowed, rescan is called.
+func (v *Volume) Watch(stop <-chan struct{}, changed func(path string), rescan func()) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if err := v.watchTree(w, v.Path, nil); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case event, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Base(event.Name) == VolumeIDFile || event.Op == fsnotify.Chmod {
+				continue
+			}
+			relPath, err := filepath.Rel(v.Path, event.Name)
+			if err != nil || inTrash(relPath) {
+				continue
+			}
+
+			if event.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					// Files may have been created before the directory was watched.
+					if err := v.watchTree(w, event.Name, changed); err != nil {
+						log.Println("ERROR: Failed to watch " + event.Name + ": " + err.Error())
+						rescan()
+					}
+					continue
+				}
+			}
+			changed(relPath)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			if err == fsnotify.ErrEventOverflow {
+				log.Println("Watching volume " + v.id + " lost events, rescanning.")
+				rescan()
+				continue
+			}
+			log.Println("ERROR: Watching volume " + v.id + ": " + err.Error())
+		}
+	}
+}
+
+// watchTree adds all directories below root to w and reports their files to changed, if given.
+func (v *Volume) watchTree(w *fsnotify.Watcher, root string, changed func(path string)) error {
+	return filepath.Walk(root, func(fullpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if fullpath == v.trashPath() {
+				return filepath.SkipDir
+			}
+			return w.Add(fullpath)
+		}
+		if changed != nil && filepath.Base(fullpath) != VolumeIDFile {
+			if relPath, err := filepath.Rel(v.Path, fullpath); err == nil {
+				changed(relPath)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,57 @@
+//go:build linux
+// +build linux
+
+package disk
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// xattrNamespace is the namespace of the extended attributes preserved across transfers.
+// The other namespaces require privileges or are managed by the system.
+const xattrNamespace = "user."
+
+func readXattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Listxattr(path, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Listxattr(path, buf); err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if !strings.HasPrefix(name, xattrNamespace) {
+			continue
+		}
+		size, err := unix.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		if size, err = unix.Getxattr(path, name, value); err != nil {
+			return nil, err
+		}
+		xattrs[name] = value[:size]
+	}
+	return xattrs, nil
+}
+
+func writeXattrs(path string, xattrs map[string][]byte) error {
+	for name, value := range xattrs {
+		if !strings.HasPrefix(name, xattrNamespace) {
+			continue
+		}
+		if err := unix.Setxattr(path, name, value, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
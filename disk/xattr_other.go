@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package disk
+
+import "errors"
+
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func writeXattrs(path string, xattrs map[string][]byte) error {
+	if len(xattrs) > 0 {
+		return errors.New("extended attributes are not supported on this platform")
+	}
+	return nil
+}
@@ -39,6 +39,10 @@ func (v *Volume) AvailableBytes() uint64 {
 	return space
 }
 
+func (v *Volume) Capacity() uint64 {
+	return v.Size
+}
+
 func (v *Volume) Walk(f filepath.WalkFunc) error {
 	return nil
 }
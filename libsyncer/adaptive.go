@@ -0,0 +1,209 @@
+package libsyncer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// AdaptiveConfig configures an AdaptivePricer.
+type AdaptiveConfig struct {
+	// TargetFill is the fraction (0..1) of the volume capacity the node wants to use.
+	TargetFill float64
+
+	// Step is the relative amount the factor is changed after an auction, e.g. 0.05.
+	Step float64
+
+	// MinFactor and MaxFactor limit the factor applied to the prices of the base formula.
+	MinFactor float64
+	MaxFactor float64
+
+	// StatePath is the file the learned state is persisted in. If empty, the state is
+	// not persisted.
+	StatePath string
+}
+
+// DefaultAdaptiveConfig returns an AdaptiveConfig aiming for a 80% filled volume.
+func DefaultAdaptiveConfig() AdaptiveConfig {
+	return AdaptiveConfig{
+		TargetFill: 0.8,
+		Step:       0.05,
+		MinFactor:  0.1,
+		MaxFactor:  10,
+	}
+}
+
+// AdaptiveState is the learned state of an AdaptivePricer.
+type AdaptiveState struct {
+	Factor            float64
+	Wins              int
+	Losses            int
+	LastClearingPrice Price
+}
+
+type adaptiveBid struct {
+	price Price
+	fill  float64
+	time  time.Time
+}
+
+// The AdaptivePricer wraps a PriceFormula and multiplies the prices of bids with a factor.
+// Prices calculated outside of auctions, e.g. the reserve price of the own files, are
+// left alone. It watches the auction.end messages for auctions it bid on and adjusts the
+// factor by Step: While the local volume is filled less than TargetFill, lost auctions
+// raise the factor and won auctions let a raised factor decay towards 1 again. Once the
+// volume is filled more than TargetFill, won auctions lower the factor.
+//
+// Since two nodes rarely win and lose the same auctions, this also breaks ties between nodes
+// bidding with the same base price. Two nodes below their target take turns winning instead
+// of outbidding each other up to MaxFactor.
+type AdaptivePricer struct {
+	AdaptiveConfig
+
+	base PriceFormula
+	name string
+
+	mu    sync.Mutex
+	state AdaptiveState
+	bids  map[AuctionID]adaptiveBid
+}
+
+// NewAdaptivePricer creates an AdaptivePricer for the base PriceFormula, restores the state
+// from cfg.StatePath and subscribes to the auction.end messages of t.
+func NewAdaptivePricer(t Transport, base PriceFormula, cfg AdaptiveConfig) (*AdaptivePricer, error) {
+	a := &AdaptivePricer{
+		AdaptiveConfig: cfg,
+		base:           base,
+		name:           t.Name(),
+		state:          AdaptiveState{Factor: 1},
+		bids:           make(map[AuctionID]adaptiveBid),
+	}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+
+	np := NetworkProtocol{t}
+	np.OnAuctionEnd(func(peer string, auctionID AuctionID, winnerPeer string, price Price, downloadURL string) {
+		a.auctionEnded(auctionID, winnerPeer, price)
+	})
+	return a, nil
+}
+
+// State returns a copy of the current state.
+func (a *AdaptivePricer) State() AdaptiveState {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.state
+}
+
+// SetBase replaces the base PriceFormula, keeping the learned factor.
+func (a *AdaptivePricer) SetBase(base PriceFormula) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.base = base
+}
+
+// Formula returns the PriceFormula applying the learned factor to the base PriceFormula.
+// Prices calculated for an auction are remembered, to learn from the outcome of the auction.
+func (a *AdaptivePricer) Formula() PriceFormula {
+	return func(ctx PriceContext) Price {
+		a.mu.Lock()
+		base := a.base
+		a.mu.Unlock()
+		price := base(ctx)
+		if price < 0 || ctx.AuctionID == "" {
+			return price
+		}
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		price = Price(float64(price) * a.state.Factor)
+		fill := 0.0
+		if ctx.Capacity > 0 {
+			fill = 1 - float64(ctx.FreeSpace)/float64(ctx.Capacity)
+		}
+		a.expireBids(ctx.Now)
+		a.bids[ctx.AuctionID] = adaptiveBid{price, fill, ctx.Now}
+		return price
+	}
+}
+
+// expireBids forgets bids for auctions which should have ended long ago.
+func (a *AdaptivePricer) expireBids(now time.Time) {
+	for id, bid := range a.bids {
+		if now.Sub(bid.time) > 10*AuctionTimeout {
+			delete(a.bids, id)
+		}
+	}
+}
+
+func (a *AdaptivePricer) auctionEnded(auctionID AuctionID, winnerPeer string, clearingPrice Price) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	bid, ok := a.bids[auctionID]
+	if !ok {
+		return
+	}
+	delete(a.bids, auctionID)
+
+	a.state.LastClearingPrice = clearingPrice
+	if winnerPeer == a.name {
+		a.state.Wins++
+		if bid.fill > a.TargetFill {
+			a.state.Factor *= 1 - a.Step
+		} else if a.state.Factor > 1 {
+			a.state.Factor = math.Max(1, a.state.Factor*(1-a.Step))
+		}
+	} else {
+		a.state.Losses++
+		if bid.fill < a.TargetFill {
+			a.state.Factor *= 1 + a.Step
+		}
+	}
+
+	if a.state.Factor < a.MinFactor {
+		a.state.Factor = a.MinFactor
+	}
+	if a.state.Factor > a.MaxFactor {
+		a.state.Factor = a.MaxFactor
+	}
+
+	if err := a.save(); err != nil {
+		log.Println("ERROR: Failed to save adaptive price state: " + err.Error())
+	}
+}
+
+func (a *AdaptivePricer) load() error {
+	if a.StatePath == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(a.StatePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, &a.state)
+}
+
+func (a *AdaptivePricer) save() error {
+	if a.StatePath == "" {
+		return nil
+	}
+	data, err := json.Marshal(a.state)
+	if err != nil {
+		return err
+	}
+	tmp := a.StatePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.StatePath)
+}
@@ -0,0 +1,138 @@
+package libsyncer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestAdaptivePricer(t *testing.T, name string, cfg AdaptiveConfig) (*AdaptivePricer, *testTransport) {
+	transport := &testTransport{name: name}
+	a, err := NewAdaptivePricer(transport, AdaptPriceFormula(PriceFormulaStatic(1.0)), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, transport
+}
+
+// endAuction delivers the auction.end message of an auction of node2.
+func endAuction(transport *testTransport, auctionID AuctionID, winner string, price Price) {
+	transport.receive("node2", MessageAuctionEnd, AuctionEndSerializer.Serialize(auctionID, winner, float32(price), ""))
+}
+
+func bidContext(auctionID AuctionID, free ByteSize) PriceContext {
+	return PriceContext{AuctionID: auctionID, FreeSpace: free, Capacity: 1000, Now: time.Now()}
+}
+
+func TestAdaptivePricer_LossBelowTarget(t *testing.T) {
+	a, transport := newTestAdaptivePricer(t, "node1", DefaultAdaptiveConfig())
+
+	if price := a.Formula()(bidContext("node2/auction/0", 900)); price != 1.0 {
+		t.Fatalf("Expected initial price of 1.0, got %v", price)
+	}
+	endAuction(transport, "node2/auction/0", "node3", 2.0)
+
+	// The factor is raised by one step, not up to the clearing price.
+	if price := a.Formula()(bidContext("node2/auction/1", 900)); math.Abs(float64(price)-1.05) > 1e-6 {
+		t.Fatalf("Expected a price of 1.05, got %v", price)
+	}
+	if state := a.State(); state.Losses != 1 || state.LastClearingPrice != 2.0 {
+		t.Fatalf("Unexpected state %+v", state)
+	}
+
+	// Winning below the target lets the factor decay.
+	endAuction(transport, "node2/auction/1", "node1", 1.05)
+	if state := a.State(); state.Wins != 1 || state.Factor != 1 {
+		t.Fatalf("Expected the factor to decay to 1, got %+v", state)
+	}
+}
+
+func TestAdaptivePricer_WinAboveTarget(t *testing.T) {
+	a, transport := newTestAdaptivePricer(t, "node1", DefaultAdaptiveConfig())
+
+	a.Formula()(bidContext("node2/auction/0", 100))
+	endAuction(transport, "node2/auction/0", "node1", 1.0)
+
+	if price := a.Formula()(bidContext("node2/auction/1", 100)); price >= 1.0 {
+		t.Fatalf("Expected price below 1.0 for a full volume, got %v", price)
+	}
+	if state := a.State(); state.Wins != 1 {
+		t.Fatalf("Unexpected state %+v", state)
+	}
+}
+
+func TestAdaptivePricer_ReservePrice(t *testing.T) {
+	a, transport := newTestAdaptivePricer(t, "node1", DefaultAdaptiveConfig())
+	for i := 0; i < 10; i++ {
+		id := AuctionID(fmt.Sprintf("node2/auction/%d", i))
+		a.Formula()(bidContext(id, 900))
+		endAuction(transport, id, "node3", 2.0)
+	}
+	if state := a.State(); state.Factor <= 1 {
+		t.Fatalf("Expected a raised factor, got %+v", state)
+	}
+	if price := a.Formula()(bidContext("", 900)); price != 1.0 {
+		t.Fatalf("Expected the reserve price to be unchanged, got %v", price)
+	}
+}
+
+func TestAdaptivePricer_TwoNodes(t *testing.T) {
+	node1, transport1 := newTestAdaptivePricer(t, "node1", DefaultAdaptiveConfig())
+	node2, transport2 := newTestAdaptivePricer(t, "node2", DefaultAdaptiveConfig())
+
+	wins := map[string]int{}
+	for i := 0; i < 100; i++ {
+		id := AuctionID(fmt.Sprintf("node3/auction/%d", i))
+		price1 := node1.Formula()(bidContext(id, 500))
+		price2 := node2.Formula()(bidContext(id, 500))
+		winner, price := "node1", price1
+		if price2 > price1 {
+			winner, price = "node2", price2
+		}
+		wins[winner]++
+		endAuction(transport1, id, winner, price)
+		endAuction(transport2, id, winner, price)
+	}
+
+	// The nodes take turns instead of outbidding each other.
+	for _, a := range []*AdaptivePricer{node1, node2} {
+		if state := a.State(); state.Factor > 1+a.Step {
+			t.Errorf("%s: expected the factor to stay close to 1, got %+v", a.name, state)
+		}
+	}
+	if wins["node1"] != 50 || wins["node2"] != 50 {
+		t.Errorf("Expected the nodes to take turns, got %v", wins)
+	}
+}
+
+func TestAdaptivePricer_IgnoresForeignAuctions(t *testing.T) {
+	a, transport := newTestAdaptivePricer(t, "node1", DefaultAdaptiveConfig())
+	endAuction(transport, "node2/auction/0", "node3", 2.0)
+
+	if state := a.State(); state.Losses != 0 || state.Factor != 1 {
+		t.Fatalf("Unexpected state %+v", state)
+	}
+}
+
+func TestAdaptivePricer_State(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mediasyncer-adaptive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := DefaultAdaptiveConfig()
+	cfg.StatePath = filepath.Join(dir, "state.json")
+
+	a, transport := newTestAdaptivePricer(t, "node1", cfg)
+	a.Formula()(bidContext("node2/auction/0", 900))
+	endAuction(transport, "node2/auction/0", "node3", 2.0)
+
+	restored, _ := newTestAdaptivePricer(t, "node1", cfg)
+	if restored.State() != a.State() {
+		t.Fatalf("Expected the state %+v to be restored, got %+v", a.State(), restored.State())
+	}
+}
@@ -0,0 +1,813 @@
+package libsyncer
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AdminServer provides an HTTP API to inspect and control the local node. If a Token is set,
+// requests must send it as `Authorization: Bearer <token>`.
+//
+//	GET    /status                        returns the name, version and activity of the node
+//	GET    /config                        returns the effective ConfigStatus
+//	GET    /peers                         returns the known peers and their metadata
+//	GET    /volumes                       returns the space, watermarks and reserved space of the volumes
+//	POST   /volumes?action=drain          drains all or one volume, see Auctioneer.Drain
+//	POST   /volumes?action=undrain        stops draining all or one volume
+//	GET    /files?volume=ID&match=...     lists the local files, of all or one volume, see MatchFile
+//	GET    /find?match=...                lists the matching files of all peers
+//	GET    /file?volume=ID&path=...       downloads a file, from another peer with &peer=NAME
+//	PUT    /file?volume=ID&path=...       uploads a file, replacing an existing file with &overwrite=1
+//	GET    /pins                          returns the pinned files
+//	POST   /pins?volume=ID&path=...       pins a local file, see Pins
+//	DELETE /pins?volume=ID&path=...       removes the pin of a file
+//	GET    /trash?volume=ID               lists the trash of all or one volume
+//	POST   /trash?action=restore&id=...   restores a file from the trash
+//	GET    /auctions                      returns the running auctions with their bids and transfers
+//	POST   /auctions?action=start         starts an auction right away, for all or one volume
+//	POST   /auctions?action=pause         pauses auctioning, for all or one volume
+//	POST   /auctions?action=resume        resumes auctioning, for all or one volume
+//	GET    /bids                          returns the open bids and running downloads of the bidder
+//	GET    /uploads                       returns the files being transferred to winners
+//	DELETE /uploads?volume=ID&path=...    cancels an upload, the file is auctioned again
+//	GET    /bandwidth                     returns the current ThrottleStats
+//	POST   /bandwidth?rate=1MiB           changes the global rate, if a Token is set
+//	POST   /bandwidth?rate=1MiB&peer=pi1  changes the rate for a single peer, if a Token is set
+//	POST   /keys?action=install           installs, uses or removes the cluster key in the form
+//	                                      body, if a Token is set and the Transport is a KeyManager
+//	GET    /scrub                         returns the corrupt files found by the Scrubber
+//	GET    /duplicates                    returns the duplicates found by the Deduplicator and the skipped peers
+//	POST   /duplicates                    searches the cluster for duplicates right away
+type AdminServer struct {
+	Addr         string
+	Token        string
+	Throttle     *Throttle
+	Transport    Transport
+	Scrubber     *Scrubber
+	Deduplicator *Deduplicator
+	Auctioneers  []*Auctioneer
+	Bidder       *Bidder
+	Volumes      Volumes
+	Pins         *Pins
+
+	// Clients are used to fetch files from other peers.
+	Clients *PeerClients
+
+	// FileServer signs the requests to the FileServers of other peers, if set.
+	FileServer *FileServer
+
+	// Config returns the effective config, e.g. Syncer.ConfigStatus.
+	Config func() ConfigStatus
+
+	mux *http.ServeMux
+	l   net.Listener
+}
+
+// NodeStatus summarizes what a node is doing, as reported by GET /status.
+type NodeStatus struct {
+	Name      string `json:"name"`
+	Version   int    `json:"version"`
+	Paused    bool   `json:"paused"`
+	Peers     int    `json:"peers"`
+	Auctions  int    `json:"auctions"`
+	Uploads   int    `json:"uploads"`
+	Bids      int    `json:"bids"`
+	Downloads int    `json:"downloads"`
+	Corrupt   int    `json:"corrupt"`
+}
+
+// PeerStatus describes a peer, as reported by GET /peers.
+type PeerStatus struct {
+	Name     string   `json:"name"`
+	URL      string   `json:"url"`
+	Volumes  []string `json:"volumes"`
+	Capacity ByteSize `json:"capacity"`
+	Free     ByteSize `json:"free"`
+	Labels   []string `json:"labels"`
+	Version  int      `json:"version"`
+}
+
+// FindResult lists the files found in the cluster, as reported by GET /find. Unreachable are
+// the peers whose files couldn't be listed.
+type FindResult struct {
+	Files       []FileStatus `json:"files"`
+	Unreachable []PeerID     `json:"unreachable"`
+}
+
+// TrashStatus describes a file in the trash of a volume, as reported by GET /trash.
+type TrashStatus struct {
+	Volume  string    `json:"volume"`
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`
+	Size    ByteSize  `json:"size"`
+	Deleted time.Time `json:"deleted"`
+}
+
+// NewAdminServer creates an AdminServer listening on addr once started.
+func NewAdminServer(addr string, throttle *Throttle, t Transport) *AdminServer {
+	a := &AdminServer{
+		Addr:      addr,
+		Throttle:  throttle,
+		Transport: t,
+		mux:       http.NewServeMux(),
+	}
+	a.mux.HandleFunc("/status", a.handleStatus)
+	a.mux.HandleFunc("/config", a.handleConfig)
+	a.mux.HandleFunc("/peers", a.handlePeers)
+	a.mux.HandleFunc("/volumes", a.handleVolumes)
+	a.mux.HandleFunc("/auctions", a.handleAuctions)
+	a.mux.HandleFunc("/bids", a.handleBids)
+	a.mux.HandleFunc("/uploads", a.handleUploads)
+	a.mux.HandleFunc("/files", a.handleFiles)
+	a.mux.HandleFunc("/find", a.handleFind)
+	a.mux.HandleFunc("/file", a.handleFile)
+	a.mux.HandleFunc("/pins", a.handlePins)
+	a.mux.HandleFunc("/trash", a.handleTrash)
+	a.mux.HandleFunc("/bandwidth", a.handleBandwidth)
+	a.mux.HandleFunc("/keys", a.handleKeys)
+	a.mux.HandleFunc("/scrub", a.handleScrub)
+	a.mux.HandleFunc("/duplicates", a.handleDuplicates)
+	return a
+}
+
+func (a *AdminServer) Serve() {
+	l, err := net.Listen("tcp", a.Addr)
+	if err != nil {
+		panic(err.Error())
+	}
+	a.l = l
+
+	if err := http.Serve(a.l, a); err != nil {
+		log.Println("ERROR in admin http.Serve: " + err.Error())
+	}
+}
+
+func (a *AdminServer) Close() {
+	if a.l == nil {
+		return
+	}
+	if err := a.l.Close(); err != nil {
+		log.Println("ERROR closing admin listener: " + err.Error())
+	}
+}
+
+func (a *AdminServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !a.authorized(req) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="mediasyncer"`)
+		http.Error(w, "invalid or missing admin token", http.StatusUnauthorized)
+		return
+	}
+	a.mux.ServeHTTP(w, req)
+}
+
+// authorized checks the bearer token of req, if a Token is configured.
+func (a *AdminServer) authorized(req *http.Request) bool {
+	if a.Token == "" {
+		return true
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1
+}
+
+func (a *AdminServer) handleStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	status := NodeStatus{
+		Name:    a.Transport.Name(),
+		Version: ProtocolVersion,
+		Paused:  len(a.Auctioneers) > 0,
+		Peers:   len(a.Transport.Peers()),
+	}
+	for _, auctioneer := range a.Auctioneers {
+		s := auctioneer.Status()
+		status.Paused = status.Paused && s.Paused
+		status.Uploads += len(s.Transfers)
+		if s.Auction != nil {
+			status.Auctions++
+		}
+	}
+	if a.Bidder != nil {
+		s := a.Bidder.Status()
+		status.Bids = len(s.Bids)
+		status.Downloads = len(s.Downloads)
+	}
+	if a.Scrubber != nil {
+		for _, report := range a.Scrubber.Reports() {
+			if !report.Repaired {
+				status.Corrupt++
+			}
+		}
+	}
+	writeJSON(w, status)
+}
+
+func (a *AdminServer) handleConfig(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if a.Config == nil {
+		http.Error(w, "config is not available", http.StatusNotImplemented)
+		return
+	}
+	writeJSON(w, a.Config())
+}
+
+func (a *AdminServer) handlePeers(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	peers := []PeerStatus{}
+	for name, meta := range a.Transport.Peers() {
+		peers = append(peers, PeerStatus{
+			Name:     name,
+			URL:      meta.URL,
+			Volumes:  meta.Volumes,
+			Capacity: meta.Capacity,
+			Free:     meta.Free,
+			Labels:   meta.Labels,
+			Version:  meta.Version,
+		})
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Name < peers[j].Name
+	})
+	writeJSON(w, peers)
+}
+
+func (a *AdminServer) handleVolumes(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+	case "POST":
+		auctioneers := a.auctioneers(req)
+		if len(auctioneers) == 0 {
+			http.Error(w, "unknown volume", http.StatusNotFound)
+			return
+		}
+		switch req.FormValue("action") {
+		case "drain":
+			for _, auctioneer := range auctioneers {
+				log.Println("Draining volume " + auctioneer.Volume.ID())
+				auctioneer.Drain()
+			}
+		case "undrain":
+			for _, auctioneer := range auctioneers {
+				log.Println("Stopped draining volume " + auctioneer.Volume.ID())
+				auctioneer.StopDraining()
+			}
+		default:
+			http.Error(w, "action must be drain or undrain", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if a.Config == nil {
+		http.Error(w, "volumes are not available", http.StatusNotImplemented)
+		return
+	}
+	writeJSON(w, a.Config().Volumes)
+}
+
+// auctioneers returns the Auctioneers of the volume given in the request, or all of them.
+func (a *AdminServer) auctioneers(req *http.Request) []*Auctioneer {
+	volume := req.FormValue("volume")
+	if volume == "" {
+		return a.Auctioneers
+	}
+	for _, auctioneer := range a.Auctioneers {
+		if auctioneer.Volume.ID() == volume {
+			return []*Auctioneer{auctioneer}
+		}
+	}
+	return nil
+}
+
+func (a *AdminServer) handleAuctions(w http.ResponseWriter, req *http.Request) {
+	auctioneers := a.auctioneers(req)
+	if len(auctioneers) == 0 {
+		http.Error(w, "unknown volume", http.StatusNotFound)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+	case "POST":
+		switch req.FormValue("action") {
+		case "start":
+			started := false
+			var errs []string
+			for _, auctioneer := range auctioneers {
+				if err := auctioneer.StartAuction(); err != nil {
+					errs = append(errs, auctioneer.Volume.ID()+": "+err.Error())
+				} else {
+					started = true
+				}
+			}
+			if !started {
+				http.Error(w, strings.Join(errs, "\n"), http.StatusConflict)
+				return
+			}
+		case "pause":
+			for _, auctioneer := range auctioneers {
+				auctioneer.Pause()
+			}
+		case "resume":
+			for _, auctioneer := range auctioneers {
+				auctioneer.Resume()
+			}
+		default:
+			http.Error(w, "action must be start, pause or resume", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := make([]AuctioneerStatus, 0, len(auctioneers))
+	for _, auctioneer := range auctioneers {
+		status = append(status, auctioneer.Status())
+	}
+	writeJSON(w, status)
+}
+
+func (a *AdminServer) handleBids(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if a.Bidder == nil {
+		http.Error(w, "bidding is disabled", http.StatusNotImplemented)
+		return
+	}
+	writeJSON(w, a.Bidder.Status())
+}
+
+func (a *AdminServer) handleUploads(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		transfers := []TransferStatus{}
+		for _, auctioneer := range a.Auctioneers {
+			transfers = append(transfers, auctioneer.Status().Transfers...)
+		}
+		writeJSON(w, transfers)
+	case "DELETE":
+		file := FileID{VolumeID: req.FormValue("volume"), Path: req.FormValue("path")}
+		auctioneers := a.auctioneers(req)
+		if file.VolumeID == "" || len(auctioneers) == 0 {
+			http.Error(w, "unknown volume", http.StatusNotFound)
+			return
+		}
+		if err := auctioneers[0].CancelUpload(file); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *AdminServer) handleBandwidth(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+	case "POST", "PUT":
+		if a.Token == "" {
+			http.Error(w, "changing the bandwidth requires an admin token", http.StatusForbidden)
+			return
+		}
+		rate, err := ParseByteSize(req.FormValue("rate"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if peer := req.FormValue("peer"); peer != "" {
+			a.Throttle.SetPeerRate(PeerID(peer), rate)
+		} else {
+			a.Throttle.SetRate(rate)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, a.Throttle.Stats())
+}
+
+func (a *AdminServer) handleKeys(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	// Anyone able to install a key could join the cluster.
+	if a.Token == "" {
+		http.Error(w, "managing keys requires an admin token", http.StatusForbidden)
+		return
+	}
+	km, ok := a.Transport.(KeyManager)
+	if !ok {
+		http.Error(w, "transport does not support keys", http.StatusNotImplemented)
+		return
+	}
+	// Keys in the URL would end up in access logs.
+	if req.URL.Query().Get("key") != "" {
+		http.Error(w, "the key must be sent in the request body", http.StatusBadRequest)
+		return
+	}
+	key, err := base64.StdEncoding.DecodeString(req.PostFormValue("key"))
+	if err != nil {
+		http.Error(w, "invalid key: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch req.URL.Query().Get("action") {
+	case "install":
+		err = km.InstallKey(key)
+	case "use":
+		err = km.UseKey(key)
+	case "remove":
+		err = km.RemoveKey(key)
+	default:
+		http.Error(w, "action must be install, use or remove", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminServer) handleScrub(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if a.Scrubber == nil {
+		http.Error(w, "scrubbing is disabled", http.StatusNotImplemented)
+		return
+	}
+	writeJSON(w, a.Scrubber.Reports())
+}
+
+func (a *AdminServer) handleDuplicates(w http.ResponseWriter, req *http.Request) {
+	if a.Deduplicator == nil {
+		http.Error(w, "duplicate detection is disabled", http.StatusNotImplemented)
+		return
+	}
+	switch req.Method {
+	case "GET":
+	case "POST":
+		a.Deduplicator.Run()
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, a.Deduplicator.Duplicates())
+}
+
+// volumes returns the volume given in the request, or all of them.
+func (a *AdminServer) volumes(req *http.Request) Volumes {
+	volume := req.FormValue("volume")
+	if volume == "" {
+		return a.Volumes
+	}
+	if vol := a.Volumes.Get(volume); vol != nil {
+		return Volumes{vol}
+	}
+	return nil
+}
+
+// requestPath returns the `path` parameter of the request, relative to the root of a volume.
+func requestPath(req *http.Request) (string, bool) {
+	p := path.Clean("/" + req.FormValue("path"))[1:]
+	return p, p != ""
+}
+
+// localFile returns the existing local file given by the `path` and `volume` parameters of
+// the request. Without a volume, all volumes are searched for the path. If the file is not
+// found, an error is sent and ok is false.
+func (a *AdminServer) localFile(w http.ResponseWriter, req *http.Request) (vol Volume, file FileID, info os.FileInfo, ok bool) {
+	p, ok := requestPath(req)
+	if !ok {
+		http.Error(w, "path is required", http.StatusBadRequest)
+		return nil, FileID{}, nil, false
+	}
+	var err error
+	if volume := req.FormValue("volume"); volume != "" {
+		vol = a.Volumes.Get(volume)
+		if vol == nil {
+			http.Error(w, "unknown volume", http.StatusNotFound)
+			return nil, FileID{}, nil, false
+		}
+		info, err = vol.Stat(p)
+	} else {
+		vol, info, err = a.Volumes.Stat(p)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, p+" not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return nil, FileID{}, nil, false
+	}
+	return vol, FileID{VolumeID: vol.ID(), Path: p}, info, true
+}
+
+func (a *AdminServer) handleFiles(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	vols := a.volumes(req)
+	if vols == nil {
+		http.Error(w, "unknown volume", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, ListFiles(vols, req.FormValue("match"), a.Pins))
+}
+
+func (a *AdminServer) handleFind(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	match := req.FormValue("match")
+	if match == "" {
+		http.Error(w, "match is required", http.StatusBadRequest)
+		return
+	}
+
+	name := PeerID(a.Transport.Name())
+	result := FindResult{Files: ListFiles(a.Volumes, match, a.Pins), Unreachable: []PeerID{}}
+	for i := range result.Files {
+		result.Files[i].Peer = name
+	}
+
+	peers := a.Transport.Peers()
+	names := make([]string, 0, len(peers))
+	for peer := range peers {
+		names = append(names, peer)
+	}
+	sort.Strings(names)
+	for _, peer := range names {
+		if peers[peer].URL == "" {
+			continue
+		}
+		u := peerURL(peers[peer].URL, FilesPath) + "?" + url.Values{"match": {match}}.Encode()
+		var files []FileStatus
+		if err := fetchJSON(a.Clients.Client(PeerID(peer)), name, a.FileServer.SignURL(u), &files); err != nil {
+			log.Println("Failed to list the files of " + peer + ": " + err.Error())
+			result.Unreachable = append(result.Unreachable, PeerID(peer))
+			continue
+		}
+		for _, file := range files {
+			file.Peer = PeerID(peer)
+			result.Files = append(result.Files, file)
+		}
+	}
+	writeJSON(w, result)
+}
+
+func (a *AdminServer) handleFile(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET", "HEAD":
+		if peer := req.FormValue("peer"); peer != "" && peer != a.Transport.Name() {
+			a.proxyFile(w, req, PeerID(peer))
+			return
+		}
+		vol, file, info, ok := a.localFile(w, req)
+		if !ok {
+			return
+		}
+		reader, err := vol.Read(file.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if closer, ok := reader.(io.Closer); ok {
+			defer closer.Close()
+		}
+		if meta, err := ReadMeta(vol, file.Path); err == nil {
+			meta.SetHeader(w.Header())
+		}
+		http.ServeContent(w, req, file.Path, info.ModTime(), reader)
+
+	case "PUT":
+		p, ok := requestPath(req)
+		if !ok {
+			http.Error(w, "path is required", http.StatusBadRequest)
+			return
+		}
+		vol := a.Volumes.Get(req.FormValue("volume"))
+		if req.FormValue("volume") == "" {
+			vol = a.emptiestVolume()
+		}
+		if vol == nil {
+			http.Error(w, "unknown volume", http.StatusNotFound)
+			return
+		}
+		file := FileID{VolumeID: vol.ID(), Path: p}
+		if Ignored(vol, p) {
+			http.Error(w, p+" is ignored", http.StatusForbidden)
+			return
+		}
+		meta, err := ParseFileMeta(req.Header)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.Println("Receiving " + file.String() + " through the admin API")
+		err = StoreFile(vol, p, req.Body, req.ContentLength, meta, req.FormValue("overwrite") != "")
+		if err == ErrFileExists {
+			http.Error(w, p+" exists", http.StatusConflict)
+			return
+		} else if err != nil {
+			log.Println("ERROR: Failed to store " + file.String() + ": " + err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		info, err := vol.Stat(p)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, fileStatus(file, info, a.Pins))
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// emptiestVolume returns the volume with the most available space.
+func (a *AdminServer) emptiestVolume() Volume {
+	var best Volume
+	for _, vol := range a.Volumes {
+		if best == nil || vol.AvailableBytes() > best.AvailableBytes() {
+			best = vol
+		}
+	}
+	return best
+}
+
+// proxyFile downloads the requested file from the FileServer of peer.
+func (a *AdminServer) proxyFile(w http.ResponseWriter, req *http.Request, peer PeerID) {
+	meta, ok := a.Transport.Peers()[string(peer)]
+	if !ok || meta.URL == "" {
+		http.Error(w, "unknown peer", http.StatusNotFound)
+		return
+	}
+	p, ok := requestPath(req)
+	if !ok || req.FormValue("volume") == "" {
+		http.Error(w, "volume and path are required", http.StatusBadRequest)
+		return
+	}
+
+	u := peerURL(meta.URL, "/"+urlPath(FileID{VolumeID: req.FormValue("volume"), Path: p}))
+	proxied, err := http.NewRequest(req.Method, a.FileServer.SignURL(u), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	proxied.Header.Set(PeerHeader, a.Transport.Name())
+	if r := req.Header.Get("Range"); r != "" {
+		proxied.Header.Set("Range", r)
+	}
+	resp, err := a.Clients.Client(peer).Do(proxied.WithContext(req.Context()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, h := range []string{"Content-Length", "Content-Type", "Content-Range", "Last-Modified", ModTimeHeader, ModeHeader, XattrHeader} {
+		for _, v := range resp.Header[http.CanonicalHeaderKey(h)] {
+			w.Header().Add(h, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		log.Println("ERROR: Failed to download " + u + ": " + err.Error())
+	}
+}
+
+func (a *AdminServer) handlePins(w http.ResponseWriter, req *http.Request) {
+	if a.Pins == nil {
+		http.Error(w, "pinning is not available", http.StatusNotImplemented)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		writeJSON(w, a.Pins.Files())
+	case "POST":
+		_, file, _, ok := a.localFile(w, req)
+		if !ok {
+			return
+		}
+		if err := a.Pins.Pin(file); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Println("Pinned " + file.String())
+		writeJSON(w, file)
+	case "DELETE":
+		p, ok := requestPath(req)
+		if !ok {
+			http.Error(w, "path is required", http.StatusBadRequest)
+			return
+		}
+		volume := req.FormValue("volume")
+		for _, file := range a.Pins.Files() {
+			if file.Path != p || volume != "" && file.VolumeID != volume {
+				continue
+			}
+			if err := a.Pins.Unpin(file); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Println("Unpinned " + file.String())
+			writeJSON(w, file)
+			return
+		}
+		http.Error(w, p+" is not pinned", http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *AdminServer) handleTrash(w http.ResponseWriter, req *http.Request) {
+	vols := a.volumes(req)
+	if vols == nil {
+		http.Error(w, "unknown volume", http.StatusNotFound)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		trash := []TrashStatus{}
+		for _, vol := range vols {
+			entries, err := ListTrash(vol)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, entry := range entries {
+				trash = append(trash, TrashStatus{vol.ID(), entry.ID, entry.Path, entry.Size, entry.Deleted})
+			}
+		}
+		writeJSON(w, trash)
+	case "POST":
+		if req.FormValue("action") != "restore" {
+			http.Error(w, "action must be restore", http.StatusBadRequest)
+			return
+		}
+		id := req.FormValue("id")
+		for _, vol := range vols {
+			entries, err := ListTrash(vol)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, entry := range entries {
+				if entry.ID != id {
+					continue
+				}
+				p, err := RestoreFile(vol, id)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusConflict)
+					return
+				}
+				log.Println("Restored " + p + " from the trash of volume " + vol.ID())
+				writeJSON(w, FileID{VolumeID: vol.ID(), Path: p})
+				return
+			}
+		}
+		http.Error(w, id+" is not in the trash", http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("ERROR encoding json: " + err.Error())
+	}
+}
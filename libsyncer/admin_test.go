@@ -0,0 +1,193 @@
+package libsyncer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminServerAuctions(t *testing.T) {
+	vol := newTestVolume("v", 1000)
+	vol.files["a"] = []byte("hello")
+
+	transport := &testTransport{}
+	proto := NetworkProtocol{transport}
+	pricing := &Pricing{Formula: AdaptPriceFormula(PriceFormulaStatic(1)), Volume: vol}
+	auctioneer := NewAuctioneer(proto, pricing, vol, nil, nil)
+	auctioneer.Ticker.Stop()
+	auctioneer.Clock = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	go auctioneer.Serve()
+
+	admin := NewAdminServer("", nil, transport)
+	admin.Token = "secret"
+	admin.Auctioneers = []*Auctioneer{auctioneer}
+
+	request := func(method, target, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := request("GET", "/auctions", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without token, got %d", w.Code)
+	}
+	if w := request("GET", "/auctions", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for a wrong token, got %d", w.Code)
+	}
+
+	if w := request("POST", "/auctions?action=pause", "secret"); w.Code != http.StatusOK || !auctioneer.Paused() {
+		t.Fatalf("Expected auctioning to be paused, got %d", w.Code)
+	}
+
+	// Manual auctions ignore pausing.
+	w := request("POST", "/auctions?action=start", "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the auction to start, got %d: %s", w.Code, w.Body)
+	}
+	var status []AuctioneerStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 1 || !status[0].Paused || status[0].Auction == nil || status[0].Auction.File.Path != "a" {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+	if len(transport.broadcasts) != 1 {
+		t.Fatalf("Expected auction.start to be broadcasted, got %v", transport.broadcasts)
+	}
+
+	if w := request("POST", "/auctions?action=start", "secret"); w.Code != http.StatusConflict {
+		t.Fatalf("Expected a conflict for a second auction, got %d", w.Code)
+	}
+	if w := request("DELETE", "/uploads?volume=v&path=a", "secret"); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a file not being uploaded, got %d", w.Code)
+	}
+}
+
+func TestAdminServerFiles(t *testing.T) {
+	vol := newTestVolume("v", 1000)
+	transport := &testTransport{}
+	auctioneer := NewAuctioneer(NetworkProtocol{transport}, nil, vol, nil, nil)
+	auctioneer.Ticker.Stop()
+
+	admin := NewAdminServer("", nil, transport)
+	admin.Volumes = Volumes{vol}
+	admin.Pins = &Pins{files: make(map[FileID]bool)}
+	admin.Auctioneers = []*Auctioneer{auctioneer}
+	admin.Config = func() ConfigStatus { return ConfigStatus{} }
+
+	request := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := request("PUT", "/file?path=dir/../a.mkv", "hello"); w.Code != http.StatusOK || string(vol.files["a.mkv"]) != "hello" {
+		t.Fatalf("Expected the file to be stored, got %d: %s", w.Code, w.Body)
+	}
+	if w := request("PUT", "/file?path=a.mkv", "again"); w.Code != http.StatusConflict {
+		t.Fatalf("Expected a conflict for an existing file, got %d", w.Code)
+	}
+	if w := request("GET", "/file?path=a.mkv", ""); w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Fatalf("Expected the content of the file, got %d: %s", w.Code, w.Body)
+	}
+	if w := request("GET", "/file?path=b.mkv", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a missing file, got %d", w.Code)
+	}
+
+	if w := request("POST", "/pins?path=a.mkv", ""); w.Code != http.StatusOK || !admin.Pins.Pinned(FileID{"v", "a.mkv"}) {
+		t.Fatalf("Expected the file to be pinned, got %d: %s", w.Code, w.Body)
+	}
+	var result FindResult
+	if err := json.NewDecoder(request("GET", "/find?match=*.mkv", "").Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Files) != 1 || result.Files[0].Peer != "local" || !result.Files[0].Pinned {
+		t.Fatalf("Unexpected files %+v", result.Files)
+	}
+	if w := request("DELETE", "/pins?path=a.mkv", ""); w.Code != http.StatusOK || admin.Pins.Pinned(FileID{"v", "a.mkv"}) {
+		t.Fatalf("Expected the pin to be removed, got %d: %s", w.Code, w.Body)
+	}
+
+	if w := request("POST", "/volumes?action=drain&volume=v", ""); w.Code != http.StatusOK || !auctioneer.Draining() {
+		t.Fatalf("Expected the volume to be drained, got %d: %s", w.Code, w.Body)
+	}
+	if w := request("POST", "/volumes?action=undrain", ""); w.Code != http.StatusOK || auctioneer.Draining() {
+		t.Fatalf("Expected draining to stop, got %d: %s", w.Code, w.Body)
+	}
+}
+
+// testKeyTransport records the installed cluster keys.
+type testKeyTransport struct {
+	testTransport
+	installed []string
+}
+
+func (t *testKeyTransport) InstallKey(key []byte) error {
+	t.installed = append(t.installed, string(key))
+	return nil
+}
+func (t *testKeyTransport) UseKey(key []byte) error    { return nil }
+func (t *testKeyTransport) RemoveKey(key []byte) error { return nil }
+
+func TestAdminServerKeys(t *testing.T) {
+	transport := &testKeyTransport{}
+	admin := NewAdminServer("", nil, transport)
+	key := url.Values{"key": {"c2VjcmV0"}}.Encode()
+
+	request := func(target, body string) int {
+		req := httptest.NewRequest("POST", target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := request("/keys?action=install", key); code != http.StatusForbidden {
+		t.Fatalf("Expected 403 without an admin token, got %d", code)
+	}
+	admin.Token = "secret"
+	if code := request("/keys?action=install&"+key, ""); code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a key in the URL, got %d", code)
+	}
+	if code := request("/keys?action=install", key); code != http.StatusNoContent {
+		t.Fatalf("Expected the key to be installed, got %d", code)
+	}
+	if len(transport.installed) != 1 || transport.installed[0] != "secret" {
+		t.Fatalf("Unexpected keys %q", transport.installed)
+	}
+}
+
+func TestAdminServerBandwidth(t *testing.T) {
+	throttle := NewThrottle(ThrottleConfig{})
+	admin := NewAdminServer("", throttle, &testTransport{})
+
+	request := func(method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := request("POST", "/bandwidth?rate=1MiB"); w.Code != http.StatusForbidden || throttle.Stats().Rate != 0 {
+		t.Fatalf("Expected 403 without a configured token, got %d", w.Code)
+	}
+	if w := request("GET", "/bandwidth"); w.Code != http.StatusOK {
+		t.Fatalf("Expected the stats, got %d", w.Code)
+	}
+
+	admin.Token = "secret"
+	if w := request("POST", "/bandwidth?rate=1MiB&peer=pi1"); w.Code != http.StatusOK || throttle.Stats().Peers["pi1"].Rate != 1<<20 {
+		t.Fatalf("Expected the rate of pi1 to be changed, got %d: %s", w.Code, w.Body)
+	}
+}
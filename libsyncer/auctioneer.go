@@ -1,24 +1,146 @@
 package libsyncer
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"sync"
 	"time"
 )
 
 const AuctionTimeout = 5 * time.Second
 
-type Auctioneer struct {
-	Network      NetworkProtocol
-	PriceFormula PriceFormula
-	Volume       Volume
-	Ticker       *time.Ticker
-	Uploader     *Uploader
+// PullTimeout is the time a winner has to download a file it bid on with PullURL.
+const PullTimeout = 1 * time.Hour
 
-	Bids              chan auctionBid
+type Auctioneer struct {
+	Network    NetworkProtocol
+	Pricing    *Pricing
+	Volume     Volume
+	Ticker     *time.Ticker
+	Uploader   *Uploader
+	FileServer *FileServer
+	Schedule   *Schedule
+	Clock      Clock
+
+	// Skip reports files which must not be auctioned, e.g. because they are corrupt.
+	Skip func(file FileID) bool
+
+	Bids chan auctionBid
+
+	// UploadsInProgress contains the files being transferred. It is guarded by mu,
+	// since the Rebalancer must not move them.
+	mu                sync.Mutex
 	UploadsInProgress map[string]struct{}
-	UploadDone        chan FileID
+	UploadResults     chan UploadResult
+
+	// pulls contains the files being downloaded by winners which bid with PullURL.
+	pulls         map[AuctionID]auctionPull
+	transfersDone chan transferDone
+
+	// failedUploads remembers the peer the last upload of a file failed for, so the next
+	// auction of the file is not awarded to the same peer again. Later auctions accept the
+	// peer again, since the failure may have been temporary.
+	failedUploads map[string]PeerID
+
+	// uploads allows cancelling the running uploads, keyed by file.
+	uploads    map[string]auctionUpload
+	peerEvents chan auctioneerPeerEvent
+
+	// paused stops starting auctions on ticks. It is guarded by mu.
+	paused bool
+
+	// draining awards the files to any bidder, regardless of the local price. It is
+	// guarded by mu.
+	draining bool
+
+	// The requests of the AdminServer are handled by Serve.
+	statusRequests chan chan AuctioneerStatus
+	startRequests  chan chan error
+	cancelRequests chan auctioneerCancel
+}
+
+// AuctioneerStatus describes what an Auctioneer is doing.
+type AuctioneerStatus struct {
+	Volume   string `json:"volume"`
+	Paused   bool   `json:"paused"`
+	Draining bool   `json:"draining"`
+
+	// Auction is the running auction, if any.
+	Auction *AuctionStatus `json:"auction,omitempty"`
+
+	// Transfers are the files being transferred to the winners of auctions.
+	Transfers []TransferStatus `json:"transfers"`
+}
+
+// AuctionStatus describes a running auction and the bids received so far.
+type AuctionStatus struct {
+	ID      AuctionID   `json:"id"`
+	File    FileID      `json:"file"`
+	Size    ByteSize    `json:"size"`
+	Price   Price       `json:"price"`
+	Started time.Time   `json:"started"`
+	Bids    []BidStatus `json:"bids"`
+}
+
+// BidStatus describes a bid received by an Auctioneer.
+type BidStatus struct {
+	Peer  string `json:"peer"`
+	Price Price  `json:"price"`
+
+	// Mode is how the file is transferred if the bid wins: push, pull or replicated.
+	Mode string `json:"mode"`
+}
+
+// TransferStatus describes a file being transferred to the winner of an auction. Files
+// downloaded by the winner have a deadline.
+type TransferStatus struct {
+	File     FileID     `json:"file"`
+	Peer     PeerID     `json:"peer"`
+	Mode     string     `json:"mode"`
+	Deadline *time.Time `json:"deadline,omitempty"`
+}
+
+type auctioneerCancel struct {
+	file   FileID
+	result chan error
+}
+
+// bidMode returns the transfer mode of a bid with the given upload URL.
+func bidMode(uploadURL string) string {
+	switch uploadURL {
+	case PullURL:
+		return "pull"
+	case ReplicatedURL:
+		return "replicated"
+	default:
+		return "push"
+	}
+}
+
+type auctionUpload struct {
+	file   FileID
+	peer   PeerID
+	cancel context.CancelFunc
+}
+
+type auctioneerPeerEvent struct {
+	event PeerEvent
+	peer  string
+	meta  NodeMeta
+}
+
+type auctionPull struct {
+	file     FileID
+	peer     PeerID
+	deadline time.Time
+}
+
+type transferDone struct {
+	peer      string
+	auctionID AuctionID
+	success   bool
 }
 
 type auctionBid struct {
@@ -28,22 +150,41 @@ type auctionBid struct {
 	uploadURL string
 }
 
-func NewAuctioneer(n NetworkProtocol, priceFormula PriceFormula, vol Volume, uploader *Uploader) *Auctioneer {
+func NewAuctioneer(n NetworkProtocol, pricing *Pricing, vol Volume, uploader *Uploader, fs *FileServer) *Auctioneer {
 	a := &Auctioneer{
-		Network:      n,
-		Ticker:       time.NewTicker(10 * time.Second),
-		PriceFormula: priceFormula,
-		Uploader:     uploader,
-		Volume:       vol,
+		Network:    n,
+		Ticker:     time.NewTicker(10 * time.Second),
+		Pricing:    pricing,
+		Uploader:   uploader,
+		FileServer: fs,
+		Volume:     vol,
+		Clock:      time.Now,
 
 		Bids:              make(chan auctionBid),
 		UploadsInProgress: make(map[string]struct{}),
-		UploadDone:        make(chan FileID),
+		UploadResults:     make(chan UploadResult),
+		pulls:             make(map[AuctionID]auctionPull),
+		transfersDone:     make(chan transferDone),
+		failedUploads:     make(map[string]PeerID),
+		uploads:           make(map[string]auctionUpload),
+		peerEvents:        make(chan auctioneerPeerEvent),
+
+		statusRequests: make(chan chan AuctioneerStatus),
+		startRequests:  make(chan chan error),
+		cancelRequests: make(chan auctioneerCancel),
 	}
 
 	n.OnAuctionBid(func(peer string, auctionID AuctionID, price Price, url string) {
 		a.Bids <- auctionBid{peer, auctionID, price, url}
 	})
+	n.OnTransferDone(func(peer string, auctionID AuctionID, success bool) {
+		a.transfersDone <- transferDone{peer, auctionID, success}
+	})
+	n.OnPeerEvent(func(event PeerEvent, peer string, meta NodeMeta) {
+		if event != PeerUpdated {
+			a.peerEvents <- auctioneerPeerEvent{event, peer, meta}
+		}
+	})
 
 	return a
 }
@@ -56,7 +197,8 @@ type auctionCanidate struct {
 
 func (a *Auctioneer) collectFileList() []auctionCanidate {
 	var canidates []auctionCanidate
-	freeSpace := ByteSize(a.Volume.AvailableBytes())
+	ctx := a.Pricing.Context(PeerID(a.Network.Name()), "")
+	maxFree, known := a.maxPeerFreeSpace()
 
 	a.Volume.Walk(func(fullpath string, info os.FileInfo, err error) error {
 		if info.Size() == 0 {
@@ -68,13 +210,13 @@ func (a *Auctioneer) collectFileList() []auctionCanidate {
 			Path:     fullpath,
 		}
 
-		if _, ok := a.UploadsInProgress[file.String()]; ok {
+		if a.Busy(file) || a.Skip != nil && a.Skip(file) {
 			return nil
 		}
 
 		t := info.ModTime()
 
-		if t.After(time.Now().Add(-1 * 60 * time.Minute)) {
+		if LastWrite(a.Volume, fullpath, info).After(a.Clock().Add(-1 * 60 * time.Minute)) {
 			//log.Printf("Skipping %s - too young.\n", fullpath)
 			return nil
 		}
@@ -82,7 +224,14 @@ func (a *Auctioneer) collectFileList() []auctionCanidate {
 			Size:    ByteSize(info.Size()),
 			ModTime: &t,
 		}
-		price := a.PriceFormula(file, stats, freeSpace)
+		if entry, ok := info.Sys().(IndexEntry); ok {
+			stats.Hash = entry.Hash
+		}
+		if known && stats.Size > maxFree {
+			// No peer has enough space for this file.
+			return nil
+		}
+		price := a.Pricing.Price(ctx, file, stats)
 
 		canidates = append(canidates, auctionCanidate{
 			file:  file,
@@ -95,55 +244,147 @@ func (a *Auctioneer) collectFileList() []auctionCanidate {
 	return canidates
 }
 
+// maxPeerFreeSpace returns the largest free space advertised by any peer. known is false,
+// if no peer advertised its free space, e.g. because the Transport has no metadata.
+func (a *Auctioneer) maxPeerFreeSpace() (maxFree ByteSize, known bool) {
+	for _, meta := range a.Network.T.Peers() {
+		if meta.Capacity == 0 {
+			return 0, false
+		}
+		if meta.Free > maxFree {
+			maxFree = meta.Free
+		}
+		known = true
+	}
+	return maxFree, known
+}
+
 func (a *Auctioneer) Serve() {
 	auctionSeq := 0
 
 	auctionInProgress := false
 	var auctionID AuctionID
+	var auctionStarted time.Time
 	var auctionEndTimer <-chan time.Time
 	var bids []auctionBid
 	var auctionCanidate auctionCanidate
 
+	// startAuction starts an auction for the first file of the volume. Auctions started
+	// manually ignore the schedule and pausing.
+	startAuction := func(manual bool) error {
+		if auctionInProgress {
+			return fmt.Errorf("auction-in-progress")
+		}
+		if !manual && a.Paused() {
+			return fmt.Errorf("paused")
+		}
+		if !manual && !a.Schedule.AllowAuction(a.Clock()) {
+			return fmt.Errorf("not allowed by schedule")
+		}
+
+		canidates := a.collectFileList()
+		if len(canidates) == 0 {
+			return fmt.Errorf("no local file to auction found")
+		}
+
+		auctionInProgress = true
+		auctionStarted = a.Clock()
+		auctionID = AuctionID(fmt.Sprintf("%s/%s/auction/%d", a.Network.Name(), a.Volume.ID(), auctionSeq))
+		auctionSeq++
+
+		auctionCanidate = canidates[0]
+
+		if err := a.Network.AuctionStart(auctionID, auctionCanidate.file, auctionCanidate.stats); err != nil {
+			// Peers which received the message can still bid.
+			log.Printf("%s: auction.start not delivered: %v\n", auctionID, err)
+		}
+		auctionEndTimer = time.After(AuctionTimeout)
+		return nil
+	}
+
 	for {
 		select {
 		case <-a.Ticker.C:
+			a.expirePulls()
+			if err := startAuction(false); err != nil {
+				log.Println("Ignoring auction tick - " + err.Error() + ".")
+			}
+
+		case reply := <-a.startRequests:
+			reply <- startAuction(true)
+
+		case reply := <-a.statusRequests:
+			status := AuctioneerStatus{Volume: a.Volume.ID(), Paused: a.Paused(), Draining: a.Draining(), Transfers: a.transfers()}
 			if auctionInProgress {
-				log.Println("Ignoring auction tick - auction-in-progress.")
-				continue
+				auction := &AuctionStatus{
+					ID:      auctionID,
+					File:    auctionCanidate.file,
+					Size:    auctionCanidate.stats.Size,
+					Price:   auctionCanidate.price,
+					Started: auctionStarted,
+					Bids:    []BidStatus{},
+				}
+				for _, bid := range bids {
+					auction.Bids = append(auction.Bids, BidStatus{bid.peer, bid.price, bidMode(bid.uploadURL)})
+				}
+				status.Auction = auction
 			}
+			reply <- status
 
-			canidates := a.collectFileList()
-			if len(canidates) == 0 {
-				log.Println("Ignoring auction tick - no local file to auction found.")
+		case cancel := <-a.cancelRequests:
+			upload, ok := a.uploads[cancel.file.String()]
+			if !ok {
+				cancel.result <- fmt.Errorf("%s is not being uploaded", cancel.file)
 				continue
 			}
-
-			auctionInProgress = true
-			auctionID = AuctionID(fmt.Sprintf("%s/auction/%d", a.Network.Name(), auctionSeq))
-			auctionSeq++
-
-			auctionCanidate = canidates[0]
-
-			a.Network.AuctionStart(auctionID, auctionCanidate.file, auctionCanidate.stats)
-			auctionEndTimer = time.After(AuctionTimeout)
+			log.Printf("# Cancelling upload of %s to %s.\n", cancel.file, upload.peer)
+			upload.cancel()
+			cancel.result <- nil
 
 		case bid := <-a.Bids:
-			if !auctionInProgress {
-				return
-			}
-			if auctionID != bid.auctionID {
-				return
+			if !auctionInProgress || auctionID != bid.auctionID {
+				log.Printf("# Ignoring bid for unknown auction %s from %s\n", bid.auctionID, bid.peer)
+				continue
 			}
 
 			bids = append(bids, bid)
 
+		case e := <-a.peerEvents:
+			if e.event == PeerJoined {
+				if e.meta.Free > 0 {
+					log.Printf("# Peer %s joined with %v free - rebalancing.\n", e.peer, e.meta.Free)
+					if err := startAuction(false); err != nil {
+						log.Println("Not rebalancing - " + err.Error() + ".")
+					}
+				}
+				continue
+			}
+
+			// The peer left or died: forget its bids and abort transfers to it.
+			for i := 0; i < len(bids); i++ {
+				if bids[i].peer == e.peer {
+					bids = append(bids[:i], bids[i+1:]...)
+					i--
+				}
+			}
+			a.cancelTransfers(PeerID(e.peer))
+
 		case <-auctionEndTimer:
 			if len(bids) == 0 {
 				log.Println("No bids received. Auction failed.")
 			} else {
-				winningBid := bids[0]
-
+				failedPeer, hasFailed := a.failedUploads[auctionCanidate.file.String()]
+				delete(a.failedUploads, auctionCanidate.file.String())
+				winningBid := auctionBid{price: -1}
 				for _, bid := range bids {
+					if hasFailed && PeerID(bid.peer) == failedPeer {
+						log.Printf("# Ignoring bid from %s - previous upload failed.\n", bid.peer)
+						continue
+					}
+					if bid.uploadURL == ReplicatedURL && auctionCanidate.stats.Hash == "" {
+						log.Printf("# Ignoring replica bid from %s - the hash of the file was not announced.\n", bid.peer)
+						continue
+					}
 					if bid.price > winningBid.price {
 						winningBid = bid
 					}
@@ -151,28 +392,207 @@ func (a *Auctioneer) Serve() {
 
 				log.Printf("# Auction ended. %d bids received.\n", len(bids))
 				log.Printf("# File: %v\n", auctionCanidate.file)
-				if winningBid.price > auctionCanidate.price {
+				if winningBid.peer != "" && (winningBid.price > auctionCanidate.price || a.Draining()) {
 					log.Printf("# Peer %s won the auction with %v\n", winningBid.peer, winningBid.price)
 
-					a.Network.AuctionEnd(auctionID, winningBid.peer)
-
+					a.mu.Lock()
 					a.UploadsInProgress[auctionCanidate.file.String()] = struct{}{}
-					go a.Uploader.Upload(auctionCanidate.file, PeerID(winningBid.peer), winningBid.uploadURL, a.UploadDone)
+					a.mu.Unlock()
+					if winningBid.uploadURL == ReplicatedURL {
+						log.Printf("# %s stores the file already - dropping the local copy.\n", winningBid.peer)
+						a.endAuction(auctionID, winningBid.peer, winningBid.price, "")
+						a.uploadFinished(UploadResult{File: auctionCanidate.file, Peer: PeerID(winningBid.peer)})
+					} else if winningBid.uploadURL == PullURL {
+						deadline := a.Clock().Add(PullTimeout)
+						downloadURL, err := a.FileServer.CreateDownloadURL(auctionCanidate.file, PeerID(winningBid.peer), deadline)
+						if err != nil {
+							log.Printf("ERROR: Unable to create download URL for %v: %v - keeping the file locally.\n", auctionCanidate.file, err)
+							a.mu.Lock()
+							delete(a.UploadsInProgress, auctionCanidate.file.String())
+							a.mu.Unlock()
+							a.endAuction(auctionID, a.Network.Name(), auctionCanidate.price, "")
+						} else {
+							a.pulls[auctionID] = auctionPull{auctionCanidate.file, PeerID(winningBid.peer), deadline}
+							a.endAuction(auctionID, winningBid.peer, winningBid.price, downloadURL)
+						}
+					} else {
+						a.endAuction(auctionID, winningBid.peer, winningBid.price, "")
+						ctx, cancel := context.WithCancel(context.Background())
+						a.uploads[auctionCanidate.file.String()] = auctionUpload{auctionCanidate.file, PeerID(winningBid.peer), cancel}
+						go a.Uploader.Upload(ctx, auctionCanidate.file, PeerID(winningBid.peer), winningBid.uploadURL, a.UploadResults)
+					}
 				} else {
 					log.Printf("# Keeping file locally. No remote winner found (highest: %v from %s)\n", winningBid.price, winningBid.peer)
-					a.Network.AuctionEnd(auctionID, a.Network.Name())
+					a.endAuction(auctionID, a.Network.Name(), auctionCanidate.price, "")
 				}
 			}
 
 			auctionInProgress = false
 			bids = nil
 
-		case file := <-a.UploadDone:
-			log.Printf("# Upload finished: %s\n", file)
-			if err := a.Volume.Delete(file.Path); err != nil {
-				panic("delete failed: " + err.Error())
+		case result := <-a.UploadResults:
+			a.uploadFinished(result)
+
+		case done := <-a.transfersDone:
+			pull, ok := a.pulls[done.auctionID]
+			if !ok || string(pull.peer) != done.peer {
+				log.Printf("# Ignoring transfer.done for unknown auction %s from %s\n", done.auctionID, done.peer)
+				continue
+			}
+			delete(a.pulls, done.auctionID)
+
+			result := UploadResult{File: pull.file, Peer: pull.peer}
+			if !done.success {
+				result.Err = fmt.Errorf("download by %s failed", done.peer)
 			}
-			delete(a.UploadsInProgress, file.String())
+			a.uploadFinished(result)
+		}
+	}
+}
+
+// transfers returns the files being transferred to winners. Must be called by Serve.
+func (a *Auctioneer) transfers() []TransferStatus {
+	transfers := []TransferStatus{}
+	for _, pull := range a.pulls {
+		deadline := pull.deadline
+		transfers = append(transfers, TransferStatus{File: pull.file, Peer: pull.peer, Mode: "pull", Deadline: &deadline})
+	}
+	for _, upload := range a.uploads {
+		transfers = append(transfers, TransferStatus{File: upload.file, Peer: upload.peer, Mode: "push"})
+	}
+	return transfers
+}
+
+// Status returns the running auction and transfers. It blocks until Serve handles the request.
+func (a *Auctioneer) Status() AuctioneerStatus {
+	reply := make(chan AuctioneerStatus)
+	a.statusRequests <- reply
+	return <-reply
+}
+
+// StartAuction starts an auction right away, even if auctioning is paused or not allowed by
+// the schedule. It fails if an auction is running already or there is no file to auction.
+func (a *Auctioneer) StartAuction() error {
+	reply := make(chan error)
+	a.startRequests <- reply
+	return <-reply
+}
+
+// CancelUpload aborts the upload of file. The file is auctioned again, but not awarded to
+// the same peer. Files downloaded by the winner can't be cancelled.
+func (a *Auctioneer) CancelUpload(file FileID) error {
+	result := make(chan error)
+	a.cancelRequests <- auctioneerCancel{file, result}
+	return <-result
+}
+
+// Pause stops starting auctions on ticks until Resume is called. The running auction and
+// transfers are finished.
+func (a *Auctioneer) Pause() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.paused = true
+}
+
+// Resume starts auctions on ticks again.
+func (a *Auctioneer) Resume() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.paused = false
+}
+
+// Paused returns true if auctioning is paused.
+func (a *Auctioneer) Paused() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.paused
+}
+
+// Drain awards the files of the volume to the highest bidder, even if the bid is below the
+// local price, until StopDraining is called. Draining is not persisted.
+func (a *Auctioneer) Drain() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.draining = true
+}
+
+// StopDraining keeps files whose bids are below the local price again.
+func (a *Auctioneer) StopDraining() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.draining = false
+}
+
+// Draining returns true if the volume is drained.
+func (a *Auctioneer) Draining() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.draining
+}
+
+// Busy returns true if the file is being transferred to another peer.
+func (a *Auctioneer) Busy(file FileID) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.UploadsInProgress[file.String()]
+	return ok
+}
+
+// endAuction announces the winner of an auction.
+func (a *Auctioneer) endAuction(auctionID AuctionID, winner string, price Price, downloadURL string) {
+	if err := a.Network.AuctionEnd(auctionID, winner, price, downloadURL); err != nil {
+		log.Printf("%s: auction.end not delivered: %v\n", auctionID, err)
+	}
+}
+
+// uploadFinished moves the local file into the trash after a successful transfer. After a
+// failed transfer, the file can be auctioned again.
+func (a *Auctioneer) uploadFinished(result UploadResult) {
+	a.mu.Lock()
+	delete(a.UploadsInProgress, result.File.String())
+	a.mu.Unlock()
+	if upload, ok := a.uploads[result.File.String()]; ok {
+		upload.cancel()
+		delete(a.uploads, result.File.String())
+	}
+	if result.Err != nil {
+		// The file is auctioned again with one of the next ticks.
+		log.Printf("# Upload of %s to %s failed: %v\n", result.File, result.Peer, result.Err)
+		a.failedUploads[result.File.String()] = result.Peer
+		return
+	}
+
+	log.Printf("# Upload finished: %s\n", result.File)
+	delete(a.failedUploads, result.File.String())
+	if err := TrashFile(a.Volume, result.File.Path); err != nil {
+		log.Println("ERROR: Failed to trash " + result.File.String() + ": " + err.Error())
+	}
+}
+
+// cancelTransfers aborts the uploads to peer and fails the transfers it did not download yet.
+// The files are auctioned again with one of the next ticks.
+func (a *Auctioneer) cancelTransfers(peer PeerID) {
+	for file, upload := range a.uploads {
+		if upload.peer == peer {
+			log.Printf("# Cancelling upload of %s - %s left.\n", file, peer)
+			upload.cancel()
+		}
+	}
+	for id, pull := range a.pulls {
+		if pull.peer == peer {
+			delete(a.pulls, id)
+			a.uploadFinished(UploadResult{pull.file, pull.peer, fmt.Errorf("%s left", peer)})
+		}
+	}
+}
+
+// expirePulls fails the transfers of winners not downloading their files in time.
+func (a *Auctioneer) expirePulls() {
+	now := a.Clock()
+	for id, pull := range a.pulls {
+		if now.After(pull.deadline) {
+			delete(a.pulls, id)
+			a.uploadFinished(UploadResult{pull.file, pull.peer, fmt.Errorf("download by %s timed out", pull.peer)})
 		}
 	}
 }
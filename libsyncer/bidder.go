@@ -1,22 +1,94 @@
 package libsyncer
 
 import (
+	"context"
 	"log"
 	"os"
+	"sync"
+	"time"
 )
 
 // The Bidder is a service that subscribes to AuctionStarted events on the NetworkProtocol,
-// calculates a bid with the PriceFormula and responds with a Bid.
-// If not enough space is available on the Volume, the auction is ignored.
+// calculates a bid with the Pricing of each volume and responds with the highest Bid.
+// Volumes without enough space, above their HighWatermark, being drained or ignoring the file are skipped. If no volume is left,
+// the auction is ignored.
 // If the PriceFormula returns a negative price, the auction is ignored.
+// If the Schedule does not allow bidding, the auction is ignored.
+// If the seller advertises a different ProtocolVersion, the auction is ignored.
+//
+// Files existing locally at the same path or with the same content are handled according to
+// the ConflictPolicy.
+//
+// If the Bidder has a Downloader, it bids with PullURL and downloads won files from
+// the seller itself. Downloads from a seller leaving the network are cancelled.
 type Bidder struct {
-	volume       Volume
-	network      NetworkProtocol
-	priceFormula PriceFormula
-	fileServer   *FileServer
+	// Conflict decides how to bid on files existing locally. Defaults to ConflictSkip.
+	Conflict ConflictPolicy
+
+	// Draining reports volumes being drained, which don't take files.
+	Draining func(volume string) bool
+
+	volumes    []VolumeConfig
+	network    NetworkProtocol
+	pricing    map[string]*Pricing
+	fileServer *FileServer
+	schedule   *Schedule
+	downloader *Downloader
 
 	active   bool
 	auctions chan bidderAuctionStarted
+	ends     chan bidderAuctionEnded
+	reloads  chan bidderReload
+
+	// pulls contains the auctions the bidder bid on with PullURL.
+	pulls map[AuctionID]bidderAuctionStarted
+
+	// bids contains the bids on auctions which didn't end yet.
+	bids           map[AuctionID]bidderBid
+	statusRequests chan chan BidderStatus
+
+	// downloads contains the cancel functions of the running downloads.
+	downloadsMu sync.Mutex
+	downloads   map[AuctionID]bidderDownload
+}
+
+type bidderDownload struct {
+	peer   string
+	file   FileID
+	size   ByteSize
+	cancel context.CancelFunc
+}
+
+type bidderBid struct {
+	auction bidderAuctionStarted
+	price   Price
+}
+
+// BidderStatus describes the open bids and running downloads of a Bidder.
+type BidderStatus struct {
+	Bids      []OpenBid        `json:"bids"`
+	Downloads []DownloadStatus `json:"downloads"`
+}
+
+// OpenBid is a bid on an auction which didn't end yet. Target is where the file is stored
+// if the bid wins.
+type OpenBid struct {
+	Auction AuctionID `json:"auction"`
+	Peer    string    `json:"peer"`
+	File    FileID    `json:"file"`
+	Target  FileID    `json:"target"`
+	Size    ByteSize  `json:"size"`
+	Price   Price     `json:"price"`
+	Mode    string    `json:"mode"`
+	Time    time.Time `json:"time"`
+}
+
+// DownloadStatus describes a file being downloaded from the seller of a won auction.
+type DownloadStatus struct {
+	Auction AuctionID `json:"auction"`
+	Peer    string    `json:"peer"`
+	File    FileID    `json:"file"`
+	Size    ByteSize  `json:"size"`
 }
 
 // bidderAuctionStarted represents an internal message which is generated for
@@ -26,23 +98,68 @@ type bidderAuctionStarted struct {
 	ID    AuctionID
 	file  FileID
 	stats FileStats
+	time  time.Time
+
+	// volume is the local volume the bid was made for and path the path the file is stored
+	// at. If overwrite is set, the local file at path is replaced. If replicated is set, the
+	// content is stored locally already.
+	volume     string
+	path       string
+	overwrite  bool
+	replicated bool
+}
+
+// bidderReload represents an internal message which is generated for
+// reloading the config of the bidder.
+type bidderReload struct {
+	volumes  []VolumeConfig
+	conflict ConflictPolicy
+}
+
+// bidderAuctionEnded represents an internal message which is generated for
+// ended auction events.
+type bidderAuctionEnded struct {
+	peer        string
+	ID          AuctionID
+	winner      string
+	downloadURL string
 }
 
 // NewBidder creates a new Bidder for the given dependencies. The bidder is not started yet,
-// but immediately subscribes to the NetworkProtocols OnAuctionStart.
-func NewBidder(n NetworkProtocol, vol Volume, pf PriceFormula, fs *FileServer) *Bidder {
+// but immediately subscribes to the NetworkProtocols OnAuctionStart and OnAuctionEnd.
+// pricing contains the Pricing of each volume by volume ID.
+// If downloader is nil, the winning files are uploaded by the seller.
+func NewBidder(n NetworkProtocol, vols []VolumeConfig, pricing map[string]*Pricing, fs *FileServer, schedule *Schedule, downloader *Downloader) *Bidder {
 	b := &Bidder{
-		network:      n,
-		volume:       vol,
-		priceFormula: pf,
-		fileServer:   fs,
+		network:    n,
+		volumes:    vols,
+		pricing:    pricing,
+		fileServer: fs,
+		schedule:   schedule,
+		downloader: downloader,
 
 		active:   true,
 		auctions: make(chan bidderAuctionStarted),
+		ends:     make(chan bidderAuctionEnded),
+		reloads:  make(chan bidderReload),
+		pulls:    make(map[AuctionID]bidderAuctionStarted),
+
+		bids:           make(map[AuctionID]bidderBid),
+		statusRequests: make(chan chan BidderStatus),
+
+		downloads: make(map[AuctionID]bidderDownload),
 	}
 
 	b.network.OnAuctionStart(func(peer string, auctionID AuctionID, file FileID, stats FileStats) {
-		b.auctions <- bidderAuctionStarted{peer, auctionID, file, stats}
+		b.auctions <- bidderAuctionStarted{peer: peer, ID: auctionID, file: file, stats: stats, time: time.Now()}
+	})
+	b.network.OnAuctionEnd(func(peer string, auctionID AuctionID, winner string, price Price, downloadURL string) {
+		b.ends <- bidderAuctionEnded{peer, auctionID, winner, downloadURL}
+	})
+	b.network.OnPeerEvent(func(event PeerEvent, peer string, meta NodeMeta) {
+		if event == PeerLeft {
+			b.cancelDownloads(peer)
+		}
 	})
 
 	return b
@@ -55,35 +172,287 @@ func (b *Bidder) Serve() {
 		select {
 		case auction := <-b.auctions:
 			log.Println("Received auction " + string(auction.ID) + " from " + auction.peer + " for file " + auction.file.String())
-			freeSpace := ByteSize(b.volume.AvailableBytes())
-			if freeSpace < auction.stats.Size {
-				log.Println(auction.ID + ": not bidding - not enough space on volume.")
+			ctx := b.pricing[b.volumes[0].Volume.ID()].Context(PeerID(auction.peer), auction.ID)
+			if v := ctx.PeerMeta.Version; v != 0 && v != ProtocolVersion {
+				log.Printf("%s: not bidding - peer speaks protocol version %d.\n", auction.ID, v)
+				continue
+			}
+			if !b.schedule.AllowBid(ctx.Now) {
+				log.Println(auction.ID + ": not bidding - not allowed by schedule.")
+				continue
+			}
+			vol, price := b.bestVolume(auction)
+			if vol == nil {
+				log.Println(auction.ID + ": not bidding - no volume with enough space accepts the file.")
 				continue
 			}
-			price := b.priceFormula(auction.file, auction.stats, freeSpace)
 
 			if price == -1 {
 				log.Println("Not bidding. File not wanted.")
 				continue
 			}
+			auction.volume = vol.ID()
+			auction.path = auction.file.Path
 
-			_, err := b.volume.Stat(auction.file.Path)
-			if err != nil {
-				if os.IsNotExist(err) {
-					// Only bid, if we don't have this file locally.
-					url, err := b.fileServer.CreateUploadURL(FileID{
-						VolumeID: b.volume.ID(),
-						Path:     auction.file.Path,
-					})
-					if err != nil {
-						panic("Unable to create upload URL")
-					}
-					b.network.AuctionBid(auction.peer, auction.ID, price, url)
+			if local, ok := b.findContent(auction.stats); ok {
+				if b.Conflict == ConflictReplicated {
+					log.Println(string(auction.ID) + ": bidding as replica - file exists locally as " + local.String() + ".")
+					auction.replicated = true
+					b.bid(auction, price)
 					continue
 				}
+				log.Println("Ignoring - file exists locally as " + local.String() + ".")
+				continue
+			}
+
+			existing, info, err := b.volumeList().Stat(auction.file.Path)
+			if err != nil && !os.IsNotExist(err) {
 				panic("Stat error: " + err.Error())
 			}
-			log.Println("Ignoring - file exists locally.")
+			if err == nil && !b.resolveConflict(&auction, existing, info) {
+				continue
+			}
+			b.bid(auction, price)
+
+		case end := <-b.ends:
+			delete(b.bids, end.ID)
+			auction, ok := b.pulls[end.ID]
+			if !ok {
+				continue
+			}
+			delete(b.pulls, end.ID)
+			if end.winner != b.network.Name() {
+				continue
+			}
+			if end.downloadURL == "" {
+				log.Println(end.ID + ": won auction, but no download URL received.")
+				continue
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			b.downloadsMu.Lock()
+			b.downloads[auction.ID] = bidderDownload{auction.peer, FileID{auction.volume, auction.path}, auction.stats.Size, cancel}
+			b.downloadsMu.Unlock()
+			go b.pull(ctx, auction, end.downloadURL)
+
+		case reload := <-b.reloads:
+			b.volumes = reload.volumes
+			b.Conflict = reload.conflict
+
+		case reply := <-b.statusRequests:
+			reply <- b.status()
+		}
+	}
+}
+
+// status returns the open bids and running downloads. Must be called by Serve.
+func (b *Bidder) status() BidderStatus {
+	b.expirePulls()
+	status := BidderStatus{Bids: []OpenBid{}, Downloads: []DownloadStatus{}}
+	for id, bid := range b.bids {
+		mode := "push"
+		if bid.auction.replicated {
+			mode = "replicated"
+		} else if b.downloader != nil {
+			mode = "pull"
+		}
+		status.Bids = append(status.Bids, OpenBid{
+			Auction: id,
+			Peer:    bid.auction.peer,
+			File:    bid.auction.file,
+			Target:  FileID{bid.auction.volume, bid.auction.path},
+			Size:    bid.auction.stats.Size,
+			Price:   bid.price,
+			Mode:    mode,
+			Time:    bid.auction.time,
+		})
+	}
+
+	b.downloadsMu.Lock()
+	defer b.downloadsMu.Unlock()
+	for id, download := range b.downloads {
+		status.Downloads = append(status.Downloads, DownloadStatus{id, download.peer, download.file, download.size})
+	}
+	return status
+}
+
+// Status returns the open bids and running downloads. It blocks until Serve handles the request.
+func (b *Bidder) Status() BidderStatus {
+	reply := make(chan BidderStatus)
+	b.statusRequests <- reply
+	return <-reply
+}
+
+// Reload replaces the watermarks of the volumes and the ConflictPolicy. It is applied
+// by Serve between two auctions. The volumes must be the ones the Bidder was created with.
+func (b *Bidder) Reload(vols []VolumeConfig, conflict ConflictPolicy) {
+	b.reloads <- bidderReload{vols, conflict}
+}
+
+// resolveConflict applies the ConflictPolicy to an auctioned file existing locally on vol.
+// It returns false, if the Bidder must not bid.
+func (b *Bidder) resolveConflict(auction *bidderAuctionStarted, vol Volume, info os.FileInfo) bool {
+	switch b.Conflict {
+	case ConflictRename:
+		p, ok := renamePath(b.volumeList(), auction.file.Path)
+		if !ok {
+			log.Println("Ignoring - file exists locally and no free name was found.")
+			return false
+		}
+		log.Println(string(auction.ID) + ": file exists locally, bidding for " + p + ".")
+		auction.path = p
+		return true
+	case ConflictNewer:
+		if sameContent(auction.stats, info) {
+			log.Println("Ignoring - file exists locally with the same content.")
+			return false
+		}
+		if auction.stats.ModTime == nil || !auction.stats.ModTime.After(info.ModTime().Truncate(time.Second)) {
+			log.Println("Ignoring - file exists locally and is not older.")
+			return false
+		}
+		if b.downloader != nil && auction.stats.Hash == "" {
+			// The download replacing the local file must be verified against the announced hash.
+			log.Println("Ignoring - file exists locally and the seller announced no hash.")
+			return false
+		}
+		log.Println(string(auction.ID) + ": file exists locally, bidding for overwriting it.")
+		auction.volume = vol.ID()
+		auction.overwrite = true
+		return true
+	default:
+		log.Println("Ignoring - file exists locally.")
+		return false
+	}
+}
+
+// bid sends a bid for storing the auctioned file at auction.path.
+func (b *Bidder) bid(auction bidderAuctionStarted, price Price) {
+	b.expirePulls()
+	b.bids[auction.ID] = bidderBid{auction, price}
+	if auction.replicated {
+		b.network.AuctionBid(auction.peer, auction.ID, price, ReplicatedURL)
+		return
+	}
+	if b.downloader != nil {
+		b.pulls[auction.ID] = auction
+		b.network.AuctionBid(auction.peer, auction.ID, price, PullURL)
+		return
+	}
+
+	file := FileID{VolumeID: auction.volume, Path: auction.path}
+	var url string
+	var err error
+	if auction.overwrite {
+		url, err = b.fileServer.CreateOverwriteURL(file, PeerID(auction.peer), time.Now().Add(PullTimeout))
+	} else {
+		url, err = b.fileServer.CreateUploadURL(file, PeerID(auction.peer), time.Now().Add(PullTimeout))
+	}
+	if err != nil {
+		panic("Unable to create upload URL")
+	}
+	b.network.AuctionBid(auction.peer, auction.ID, price, url)
+}
+
+// bestVolume returns the volume with the highest price for the auctioned file. It returns nil,
+// if no volume has enough space for the file.
+func (b *Bidder) bestVolume(auction bidderAuctionStarted) (Volume, Price) {
+	var best Volume
+	bestPrice := Price(-1)
+	for _, vol := range b.volumes {
+		pricing := b.pricing[vol.Volume.ID()]
+		ctx := pricing.Context(PeerID(auction.peer), auction.ID)
+		if ctx.FreeSpace < auction.stats.Size || vol.fill(auction.stats.Size) > vol.high() || Ignored(vol.Volume, auction.file.Path) {
+			continue
+		}
+		if b.Draining != nil && b.Draining(vol.Volume.ID()) {
+			continue
+		}
+		price := pricing.Price(ctx, auction.file, auction.stats)
+		if best == nil || price > bestPrice {
+			best, bestPrice = vol.Volume, price
+		}
+	}
+	return best, bestPrice
+}
+
+// findContent returns a local file with the same content as an auctioned file, if its hash is known.
+func (b *Bidder) findContent(stats FileStats) (FileID, bool) {
+	if stats.Hash == "" {
+		return FileID{}, false
+	}
+	for _, vol := range b.volumes {
+		indexed, ok := vol.Volume.(*IndexedVolume)
+		if !ok {
+			continue
+		}
+		for _, entry := range indexed.FindHash(stats.Hash) {
+			if entry.Size == stats.Size {
+				return FileID{VolumeID: indexed.ID(), Path: entry.Path}, true
+			}
+		}
+	}
+	return FileID{}, false
+}
+
+func (b *Bidder) volumeList() Volumes {
+	vols := make(Volumes, len(b.volumes))
+	for i, vol := range b.volumes {
+		vols[i] = vol.Volume
+	}
+	return vols
+}
+
+// cancelDownloads aborts the downloads from peer.
+func (b *Bidder) cancelDownloads(peer string) {
+	b.downloadsMu.Lock()
+	defer b.downloadsMu.Unlock()
+	for id, download := range b.downloads {
+		if download.peer == peer {
+			log.Println(string(id) + ": cancelling download - " + peer + " left.")
+			download.cancel()
+		}
+	}
+}
+
+// pull downloads the file of a won auction and tells the seller about the result.
+func (b *Bidder) pull(ctx context.Context, auction bidderAuctionStarted, downloadURL string) {
+	defer func() {
+		b.downloadsMu.Lock()
+		b.downloads[auction.ID].cancel()
+		delete(b.downloads, auction.ID)
+		b.downloadsMu.Unlock()
+	}()
+
+	file := FileID{
+		VolumeID: auction.volume,
+		Path:     auction.path,
+	}
+	var err error
+	if auction.overwrite {
+		// The local file is only replaced once the download is complete.
+		err = b.downloader.Replace(ctx, file, auction.stats, auction.stats.Hash, PeerID(auction.peer), downloadURL)
+	} else {
+		err = b.downloader.Download(ctx, file, auction.stats, PeerID(auction.peer), downloadURL)
+	}
+	if err != nil {
+		log.Println(string(auction.ID) + ": download failed: " + err.Error())
+	}
+	if err := b.network.TransferDone(auction.peer, auction.ID, err == nil); err != nil {
+		log.Println(string(auction.ID) + ": failed to send transfer.done: " + err.Error())
+	}
+}
+
+// expirePulls forgets auctions which should have ended long ago.
+func (b *Bidder) expirePulls() {
+	for id, auction := range b.pulls {
+		if time.Since(auction.time) > 10*AuctionTimeout {
+			delete(b.pulls, id)
+		}
+	}
+	for id, bid := range b.bids {
+		if time.Since(bid.auction.time) > 10*AuctionTimeout {
+			delete(b.bids, id)
 		}
 	}
 }
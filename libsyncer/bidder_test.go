@@ -0,0 +1,54 @@
+package libsyncer
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBidderPullOverwrite(t *testing.T) {
+	content := "new content"
+	seller, fs, server, cleanup := newTestSeller(t, map[string]string{"movie.mkv": content})
+	defer cleanup()
+	seller.SetHash("movie.mkv", sha256Hex(content))
+	remote := FileID{VolumeID: "seller", Path: "movie.mkv"}
+
+	vol := newTestVolume("v", 1000)
+	vol.files["movie.mkv"] = []byte("old")
+	transport := &testTransport{}
+	downloader := &Downloader{Volumes: Volumes{vol}, Throttle: NewThrottle(ThrottleConfig{}), Name: "local"}
+	b := NewBidder(NetworkProtocol{transport}, []VolumeConfig{{Volume: vol}}, nil, nil, nil, downloader)
+	b.Conflict = ConflictNewer
+
+	info, _ := vol.Stat("movie.mkv")
+	modTime := info.ModTime().Add(time.Hour)
+	auction := bidderAuctionStarted{
+		peer:  "seller",
+		ID:    "a1",
+		file:  FileID{VolumeID: "seller", Path: "movie.mkv"},
+		stats: FileStats{Size: ByteSize(len(content)), ModTime: &modTime},
+		path:  "movie.mkv",
+	}
+
+	// Without an announced hash, the download can't be verified.
+	if b.resolveConflict(&auction, vol, info) {
+		t.Fatal("Expected no bid without an announced hash")
+	}
+	auction.stats.Hash = sha256Hex(content)
+	if !b.resolveConflict(&auction, vol, info) || !auction.overwrite || auction.path != "movie.mkv" {
+		t.Fatalf("Expected a bid for overwriting the file, got %+v", auction)
+	}
+
+	_, cancel := context.WithCancel(context.Background())
+	b.downloads[auction.ID] = bidderDownload{auction.peer, FileID{auction.volume, auction.path}, auction.stats.Size, cancel}
+	b.pull(context.Background(), auction, downloadURL(t, fs, server, remote))
+	if string(vol.files["movie.mkv"]) != content || len(vol.files) != 1 {
+		t.Fatalf("Expected the file to be overwritten, got %q", vol.files)
+	}
+	if len(transport.sent) != 1 || transport.sent[0] != "seller transfer.done a1\ttrue" {
+		t.Fatalf("Unexpected messages %q", transport.sent)
+	}
+	if _, ok := b.downloads[auction.ID]; ok {
+		t.Fatal("Expected the download to be removed")
+	}
+}
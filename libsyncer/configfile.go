@@ -0,0 +1,278 @@
+package libsyncer
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// ParseConfigFile parses a config file in a subset of TOML: keys with strings, numbers,
+// booleans or arrays of them as values, grouped by [tables]. Comments start with #.
+//
+// Keys within a table are prefixed with the name of the table, joined by "-", so
+//
+//	[trash]
+//	retention = "72h"
+//
+// sets "trash-retention". Dotted keys are joined the same way. Values are returned in their
+// string form, an array as several values.
+func ParseConfigFile(r io.Reader) (map[string][]string, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	p := &configParser{s: string(data), line: 1}
+	return p.parse()
+}
+
+type configParser struct {
+	s    string
+	pos  int
+	line int
+}
+
+func (p *configParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+func (p *configParser) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *configParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+// skipSpace skips spaces and tabs.
+func (p *configParser) skipSpace() {
+	for c := p.peek(); c == ' ' || c == '\t'; c = p.peek() {
+		p.pos++
+	}
+}
+
+// skipComment skips a comment up to the end of the line.
+func (p *configParser) skipComment() {
+	if p.peek() != '#' {
+		return
+	}
+	for !p.eof() && p.peek() != '\n' {
+		p.pos++
+	}
+}
+
+// skipBlank skips whitespace, newlines and comments, e.g. within arrays.
+func (p *configParser) skipBlank() {
+	for {
+		p.skipSpace()
+		p.skipComment()
+		switch p.peek() {
+		case '\n':
+			p.line++
+			p.pos++
+		case '\r':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+// endOfLine expects the end of a line, optionally after a comment.
+func (p *configParser) endOfLine() error {
+	p.skipSpace()
+	p.skipComment()
+	if p.peek() == '\r' {
+		p.pos++
+	}
+	if p.eof() {
+		return nil
+	}
+	if p.peek() != '\n' {
+		return p.errorf("unexpected %q", p.peek())
+	}
+	p.line++
+	p.pos++
+	return nil
+}
+
+func (p *configParser) parse() (map[string][]string, error) {
+	values := make(map[string][]string)
+	table := ""
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return values, nil
+		}
+
+		if p.peek() == '[' {
+			p.pos++
+			if p.peek() == '[' {
+				return nil, p.errorf("arrays of tables are not supported")
+			}
+			p.skipSpace()
+			key, err := p.key()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpace()
+			if p.peek() != ']' {
+				return nil, p.errorf("expected ] after table %s", key)
+			}
+			p.pos++
+			table = key + "-"
+		} else {
+			key, err := p.key()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpace()
+			if p.peek() != '=' {
+				return nil, p.errorf("expected = after key %s", key)
+			}
+			p.pos++
+			p.skipSpace()
+			value, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			key = table + key
+			if _, ok := values[key]; ok {
+				return nil, p.errorf("duplicate key %s", key)
+			}
+			values[key] = value
+		}
+
+		if err := p.endOfLine(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// key parses a bare or dotted key and returns its segments joined by "-".
+func (p *configParser) key() (string, error) {
+	var segments []string
+	for {
+		start := p.pos
+		for c := p.peek(); c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'; c = p.peek() {
+			p.pos++
+		}
+		if p.pos == start {
+			return "", p.errorf("expected a key, got %q", p.peek())
+		}
+		segments = append(segments, p.s[start:p.pos])
+		if p.peek() != '.' {
+			return strings.Join(segments, "-"), nil
+		}
+		p.pos++
+	}
+}
+
+// value parses a scalar or an array of scalars.
+func (p *configParser) value() ([]string, error) {
+	if p.peek() != '[' {
+		v, err := p.scalar()
+		if err != nil {
+			return nil, err
+		}
+		return []string{v}, nil
+	}
+
+	p.pos++
+	values := []string{}
+	for {
+		p.skipBlank()
+		if p.peek() == ']' {
+			p.pos++
+			return values, nil
+		}
+		v, err := p.scalar()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+
+		p.skipBlank()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+		default:
+			return nil, p.errorf("expected , or ] in array")
+		}
+	}
+}
+
+// scalar parses a string, number or boolean.
+func (p *configParser) scalar() (string, error) {
+	switch p.peek() {
+	case '"':
+		return p.basicString()
+	case '\'':
+		p.pos++
+		end := strings.IndexAny(p.s[p.pos:], "'\n")
+		if end < 0 || p.s[p.pos+end] != '\'' {
+			return "", p.errorf("unterminated string")
+		}
+		v := p.s[p.pos : p.pos+end]
+		p.pos += end + 1
+		return v, nil
+	case '[':
+		return "", p.errorf("nested arrays are not supported")
+	}
+
+	start := p.pos
+	for c := p.peek(); !p.eof() && !strings.ContainsRune(" \t\r\n,]#", rune(c)); c = p.peek() {
+		p.pos++
+	}
+	v := p.s[start:p.pos]
+	if v == "true" || v == "false" {
+		return v, nil
+	}
+	number := strings.Replace(v, "_", "", -1)
+	if _, err := strconv.ParseFloat(number, 64); err == nil && v != "" {
+		return number, nil
+	}
+	return "", p.errorf("invalid value %q, strings must be quoted", v)
+}
+
+// basicString parses a double quoted string with escape sequences.
+func (p *configParser) basicString() (string, error) {
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.s[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if p.eof() {
+				return "", p.errorf("unterminated string")
+			}
+			e := p.s[p.pos]
+			p.pos++
+			switch e {
+			case '"', '\\':
+				b.WriteByte(e)
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			default:
+				return "", p.errorf("invalid escape sequence \\%c", e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package libsyncer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfigFile(t *testing.T) {
+	values, err := ParseConfigFile(strings.NewReader(`
+# Node settings
+name = "pi" # trailing comment
+http-port = 8_080
+debug = true
+peers = []
+volume = [
+	"/mnt/disk1;high=0.9",  # first disk
+	'/mnt/disk2;price=size > 1GiB ? 2 : 1',
+]
+
+[price]
+formula = "static"
+static = 1.5
+
+[trash]
+retention = "72h"
+adaptive.target = 0.8
+quoted = "a \"b\"\tc"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{
+		"name":                  {"pi"},
+		"http-port":             {"8080"},
+		"debug":                 {"true"},
+		"peers":                 {},
+		"volume":                {"/mnt/disk1;high=0.9", "/mnt/disk2;price=size > 1GiB ? 2 : 1"},
+		"price-formula":         {"static"},
+		"price-static":          {"1.5"},
+		"trash-retention":       {"72h"},
+		"trash-adaptive-target": {"0.8"},
+		"trash-quoted":          {"a \"b\"\tc"},
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatalf("Expected %v, got %v", expected, values)
+	}
+}
+
+func TestParseConfigFileErrors(t *testing.T) {
+	for _, config := range []string{
+		`formula = static`,
+		`name = "pi"` + "\n" + `name = "nas"`,
+		`name = "pi`,
+		`name = "pi" "nas"`,
+		`volume = ["a" "b"]`,
+		`[[volume]]`,
+		`= 1`,
+	} {
+		if _, err := ParseConfigFile(strings.NewReader(config)); err == nil {
+			t.Errorf("Expected an error for %q", config)
+		}
+	}
+}
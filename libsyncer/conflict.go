@@ -0,0 +1,68 @@
+package libsyncer
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// ConflictPolicy decides how a Bidder bids on a file, which it already has at the same
+// path or with the same content. The policy is applied when bidding, so peers don't win
+// files which can't be stored.
+type ConflictPolicy string
+
+const (
+	// ConflictSkip doesn't bid on files existing locally.
+	ConflictSkip ConflictPolicy = "skip"
+
+	// ConflictRename keeps both files: the auctioned file is stored with a suffixed
+	// name, e.g. `movie (2).mkv`. Files with the same content are skipped.
+	ConflictRename ConflictPolicy = "rename"
+
+	// ConflictNewer overwrites the local file, if the auctioned file is newer. The local
+	// file is moved into the trash. Files with the same content are skipped: the hashes are
+	// compared if both are known. Local files without a recorded hash are not hashed while
+	// bidding, since reading a large file would outlast the auction, so only their ModTime
+	// is compared. A Bidder pulling files only overwrites files with an announced hash, which
+	// the download is verified against.
+	ConflictNewer ConflictPolicy = "newer"
+
+	// ConflictReplicated bids on files with the same content as a local file with
+	// ReplicatedURL: the seller drops its copy without transferring it, since the file is
+	// replicated already. Different files at the same path are skipped.
+	ConflictReplicated ConflictPolicy = "replicated"
+)
+
+// ParseConflictPolicy parses the name of a ConflictPolicy.
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(s); p {
+	case ConflictSkip, ConflictRename, ConflictNewer, ConflictReplicated:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q, expected skip, rename, newer or replicated", s)
+}
+
+// sameContent returns true if the hash recorded for the local file described by info equals
+// the announced hash of the auctioned file.
+func sameContent(stats FileStats, info os.FileInfo) bool {
+	entry, ok := info.Sys().(IndexEntry)
+	return ok && stats.Hash != "" && entry.Hash == stats.Hash && entry.Size == stats.Size
+}
+
+// maxConflictRenames limits the suffixes tried for a file by ConflictRename.
+const maxConflictRenames = 100
+
+// renamePath returns the first path not existing on any of the volumes by adding a
+// suffix to the name of p: `dir/movie.mkv` becomes `dir/movie (2).mkv`.
+func renamePath(vols Volumes, p string) (string, bool) {
+	ext := path.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	for i := 2; i < maxConflictRenames; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if _, _, err := vols.Stat(candidate); os.IsNotExist(err) {
+			return candidate, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,68 @@
+package libsyncer
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseConflictPolicy(t *testing.T) {
+	if p, err := ParseConflictPolicy("rename"); err != nil || p != ConflictRename {
+		t.Fatalf("Expected rename, got %v %v", p, err)
+	}
+	if _, err := ParseConflictPolicy("merge"); err == nil {
+		t.Fatalf("Expected an error for an unknown policy")
+	}
+}
+
+func TestRenamePath(t *testing.T) {
+	vol := newTestVolume("v", 1000)
+	vol.files["shows/movie.mkv"] = []byte("x")
+	vol.files["shows/movie (2).mkv"] = []byte("x")
+
+	p, ok := renamePath(Volumes{vol}, "shows/movie.mkv")
+	if !ok || p != "shows/movie (3).mkv" {
+		t.Fatalf("Expected shows/movie (3).mkv, got %q", p)
+	}
+}
+
+func TestOverwriteURL(t *testing.T) {
+	vol := newTestVolume("v", 1000)
+	fs := NewFileServer(FileServerConfig{Addr: "127.0.0.1", Port: 8080}, Volumes{vol}, nil)
+	file := FileID{VolumeID: "v", Path: "movie.mkv"}
+
+	overwrite, _ := fs.CreateOverwriteURL(file, "peer", time.Now().Add(PullTimeout))
+	upload, _ := fs.CreateUploadURL(file, "peer", time.Now().Add(PullTimeout))
+	for _, c := range []struct {
+		url      string
+		expected bool
+	}{{overwrite, true}, {upload, false}} {
+		u, err := url.Parse(c.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok := fs.verifyOverwrite(&http.Request{URL: u}); ok != c.expected {
+			t.Errorf("%s: expected %v, got %v", c.url, c.expected, ok)
+		}
+	}
+}
+
+func TestSameContent(t *testing.T) {
+	info := indexFileInfo{IndexEntry{Path: "movie.mkv", Size: 10, Hash: "h1"}}
+	for _, c := range []struct {
+		stats FileStats
+		same  bool
+	}{
+		{FileStats{Size: 10, Hash: "h1"}, true},
+		{FileStats{Size: 10, Hash: "h2"}, false},
+		{FileStats{Size: 10}, false},
+	} {
+		if sameContent(c.stats, info) != c.same {
+			t.Errorf("Expected sameContent(%+v) to be %v", c.stats, c.same)
+		}
+	}
+	if sameContent(FileStats{Size: 5, Hash: "h1"}, testFileInfo{"movie.mkv", 5}) {
+		t.Errorf("Expected files without a recorded hash to differ")
+	}
+}
@@ -0,0 +1,322 @@
+package libsyncer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CatalogPath is the path of the catalog on the FileServer of each peer.
+const CatalogPath = "/catalog"
+
+// CatalogEntry is a file with a known hash, as listed in the catalog of a peer.
+type CatalogEntry struct {
+	Hash string   `json:"hash"`
+	Size ByteSize `json:"size"`
+	File FileID   `json:"file"`
+}
+
+// Catalog lists the files of the indexed volumes, whose hash is known.
+func Catalog(vols Volumes) []CatalogEntry {
+	var catalog []CatalogEntry
+	for _, vol := range vols {
+		indexed, ok := vol.(*IndexedVolume)
+		if !ok {
+			continue
+		}
+		indexed.Entries(func(entry IndexEntry) error {
+			if entry.Hash != "" {
+				catalog = append(catalog, CatalogEntry{
+					Hash: entry.Hash,
+					Size: entry.Size,
+					File: FileID{VolumeID: vol.ID(), Path: entry.Path},
+				})
+			}
+			return nil
+		})
+	}
+	return catalog
+}
+
+// DedupConfig configures the detection of files stored more than once in the cluster.
+type DedupConfig struct {
+	// Interval is how often the catalogs of the peers are compared. 0 disables the detection.
+	Interval time.Duration
+
+	// Replicas is the number of copies of a file to keep in the cluster. Local copies beyond
+	// it are moved into the trash. 0 only reports the duplicates.
+	Replicas int
+}
+
+// DefaultDedupConfig reports duplicates every 6 hours.
+var DefaultDedupConfig = DedupConfig{Interval: 6 * time.Hour}
+
+// Replica is a copy of a file on a peer.
+type Replica struct {
+	Peer PeerID `json:"peer"`
+	File FileID `json:"file"`
+}
+
+// Duplicate is a content stored more than once in the cluster.
+type Duplicate struct {
+	Hash     string    `json:"hash"`
+	Size     ByteSize  `json:"size"`
+	Replicas []Replica `json:"replicas"`
+}
+
+// DuplicateReport is the result of a search for duplicates.
+type DuplicateReport struct {
+	Duplicates []Duplicate `json:"duplicates"`
+
+	// Skipped are the peers whose catalog couldn't be fetched, with the error. Their files
+	// are missing from the report, e.g. because the peers neither use TLS nor share the
+	// Secret of the FileServer.
+	Skipped map[PeerID]string `json:"skipped,omitempty"`
+}
+
+// The Deduplicator collects the catalogs of all peers and finds the files with the same
+// content. If configured, it retires the redundant local copies: all peers order the copies
+// of a file the same way and keep the first Replicas copies, preferring copies on different
+// peers. A copy is only retired after the copies to keep were confirmed to exist.
+// The catalogs of other peers can only be fetched with TLS or a shared FileServer Secret.
+type Deduplicator struct {
+	DedupConfig
+	Name      PeerID
+	Volumes   Volumes
+	Transport Transport
+	Clients   *PeerClients
+
+	// FileServer signs the requests to the FileServers of other peers, if set.
+	FileServer *FileServer
+
+	// Busy reports files which must not be retired, e.g. because they are being uploaded.
+	Busy func(file FileID) bool
+
+	mu     sync.Mutex
+	report DuplicateReport
+
+	stop chan struct{}
+}
+
+func NewDeduplicator(name PeerID, cfg DedupConfig, vols Volumes, t Transport, clients *PeerClients) *Deduplicator {
+	return &Deduplicator{
+		DedupConfig: cfg,
+		Name:        name,
+		Volumes:     vols,
+		Transport:   t,
+		Clients:     clients,
+		stop:        make(chan struct{}),
+	}
+}
+
+// dedupStartDelay is the time until the first Run, which lets the node join the network.
+const dedupStartDelay = 1 * time.Minute
+
+func (d *Deduplicator) Serve() {
+	if d.Interval <= 0 {
+		return
+	}
+	next := time.After(dedupStartDelay)
+	for {
+		select {
+		case <-next:
+			d.Run()
+			next = time.After(d.Interval)
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+func (d *Deduplicator) Stop() {
+	close(d.stop)
+}
+
+// Duplicates returns the duplicates found by the last Run and the peers it skipped.
+func (d *Deduplicator) Duplicates() DuplicateReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.report
+}
+
+// Run collects the catalogs, finds the duplicates and retires redundant local copies.
+func (d *Deduplicator) Run() {
+	catalogs := map[PeerID][]CatalogEntry{d.Name: Catalog(d.Volumes)}
+	skipped := make(map[PeerID]string)
+	peers := d.Transport.Peers()
+	for peer, meta := range peers {
+		if meta.URL == "" {
+			continue
+		}
+		catalog, err := d.fetchCatalog(PeerID(peer), meta.URL)
+		if err != nil {
+			log.Println("Failed to fetch the catalog of " + peer + ": " + err.Error())
+			skipped[PeerID(peer)] = err.Error()
+			continue
+		}
+		catalogs[PeerID(peer)] = catalog
+	}
+
+	duplicates := FindDuplicates(catalogs)
+	d.mu.Lock()
+	d.report = DuplicateReport{Duplicates: duplicates, Skipped: skipped}
+	d.mu.Unlock()
+	log.Printf("Found %d duplicate files in the catalogs of %d peers, skipped %d peers\n", len(duplicates), len(catalogs), len(skipped))
+
+	if d.Replicas > 0 {
+		for _, dup := range duplicates {
+			d.retire(dup, peers)
+		}
+	}
+}
+
+func (d *Deduplicator) fetchCatalog(peer PeerID, baseURL string) ([]CatalogEntry, error) {
+	var catalog []CatalogEntry
+	err := fetchJSON(d.Clients.Client(peer), d.Name, d.FileServer.SignURL(peerURL(baseURL, CatalogPath)), &catalog)
+	return catalog, err
+}
+
+// fetchJSON requests u from the FileServer of a peer as the peer name and decodes the
+// JSON response into v.
+func fetchJSON(client *http.Client, name PeerID, u string, v interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(PeerHeader, string(name))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// retire moves the local copies of dup beyond the Replicas to keep into the trash.
+func (d *Deduplicator) retire(dup Duplicate, peers map[string]NodeMeta) {
+	if len(dup.Replicas) <= d.Replicas {
+		return
+	}
+	keep, redundant := dup.Replicas[:d.Replicas], dup.Replicas[d.Replicas:]
+	for _, r := range redundant {
+		if r.Peer != d.Name || d.Busy != nil && d.Busy(r.File) {
+			continue
+		}
+		vol := d.Volumes.Get(r.File.VolumeID)
+		if vol == nil {
+			continue
+		}
+		for _, k := range keep {
+			if err := d.exists(k, peers); err != nil {
+				log.Printf("Keeping redundant %s, %s of %s is not available: %v\n", r.File, k.File, k.Peer, err)
+				return
+			}
+		}
+
+		log.Printf("Retiring %s, a redundant copy of %s\n", r.File, dup.Hash)
+		if err := TrashFile(vol, r.File.Path); err != nil {
+			log.Println("ERROR: Failed to trash " + r.File.String() + ": " + err.Error())
+		}
+	}
+}
+
+// exists checks that the replica still exists, asking its peer if it's not local.
+func (d *Deduplicator) exists(r Replica, peers map[string]NodeMeta) error {
+	if r.Peer == d.Name {
+		vol := d.Volumes.Get(r.File.VolumeID)
+		if vol == nil {
+			return fmt.Errorf("unknown volume")
+		}
+		_, err := vol.Stat(r.File.Path)
+		return err
+	}
+
+	meta, ok := peers[string(r.Peer)]
+	if !ok || meta.URL == "" {
+		return fmt.Errorf("peer is gone")
+	}
+	req, err := http.NewRequest("HEAD", d.FileServer.SignURL(peerURL(meta.URL, "/"+urlPath(r.File))), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(PeerHeader, string(d.Name))
+	resp, err := d.Clients.Client(r.Peer).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// peerURL returns the URL of path on the FileServer with the given base URL.
+func peerURL(baseURL, path string) string {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return baseURL + path
+	}
+	u.Path = path
+	return u.String()
+}
+
+// FindDuplicates returns the contents listed more than once in the catalogs, ordered by hash.
+// The replicas of each duplicate are ordered the same way on all peers: first one copy per
+// peer, then the second copies, each ordered by peer, volume and path.
+func FindDuplicates(catalogs map[PeerID][]CatalogEntry) []Duplicate {
+	type content struct {
+		hash string
+		size ByteSize
+	}
+	replicas := make(map[content][]Replica)
+	for peer, catalog := range catalogs {
+		for _, entry := range catalog {
+			c := content{entry.Hash, entry.Size}
+			replicas[c] = append(replicas[c], Replica{Peer: peer, File: entry.File})
+		}
+	}
+
+	var duplicates []Duplicate
+	for c, rs := range replicas {
+		if len(rs) < 2 {
+			continue
+		}
+		sort.Slice(rs, func(i, j int) bool {
+			if rs[i].Peer != rs[j].Peer {
+				return rs[i].Peer < rs[j].Peer
+			}
+			if rs[i].File.VolumeID != rs[j].File.VolumeID {
+				return rs[i].File.VolumeID < rs[j].File.VolumeID
+			}
+			return rs[i].File.Path < rs[j].File.Path
+		})
+		rank := make([]int, len(rs))
+		for i := 1; i < len(rs); i++ {
+			if rs[i].Peer == rs[i-1].Peer {
+				rank[i] = rank[i-1] + 1
+			}
+		}
+		ordered := make([]Replica, 0, len(rs))
+		for r := 0; len(ordered) < len(rs); r++ {
+			for i := range rs {
+				if rank[i] == r {
+					ordered = append(ordered, rs[i])
+				}
+			}
+		}
+		duplicates = append(duplicates, Duplicate{Hash: c.hash, Size: c.size, Replicas: ordered})
+	}
+	sort.Slice(duplicates, func(i, j int) bool {
+		return duplicates[i].Hash < duplicates[j].Hash
+	})
+	return duplicates
+}
@@ -0,0 +1,91 @@
+package libsyncer
+
+import (
+	"testing"
+)
+
+func TestFindDuplicates(t *testing.T) {
+	catalogs := map[PeerID][]CatalogEntry{
+		"b": {
+			{Hash: "h1", Size: 10, File: FileID{"vb", "movie.mkv"}},
+			{Hash: "h1", Size: 10, File: FileID{"vb", "copy of movie.mkv"}},
+			{Hash: "h2", Size: 20, File: FileID{"vb", "show.mkv"}},
+		},
+		"a": {
+			{Hash: "h1", Size: 10, File: FileID{"va", "movie.mkv"}},
+			{Hash: "h3", Size: 30, File: FileID{"va", "other.mkv"}},
+		},
+		"c": {
+			{Hash: "h3", Size: 31, File: FileID{"vc", "other.mkv"}},
+		},
+	}
+
+	duplicates := FindDuplicates(catalogs)
+	if len(duplicates) != 1 || duplicates[0].Hash != "h1" {
+		t.Fatalf("Unexpected duplicates %+v", duplicates)
+	}
+	expected := []Replica{
+		{"a", FileID{"va", "movie.mkv"}},
+		{"b", FileID{"vb", "copy of movie.mkv"}},
+		{"b", FileID{"vb", "movie.mkv"}},
+	}
+	for i, r := range duplicates[0].Replicas {
+		if r != expected[i] {
+			t.Errorf("Replica %d: expected %v, got %v", i, expected[i], r)
+		}
+	}
+}
+
+func TestDeduplicatorRetire(t *testing.T) {
+	vol := newTestVolume("v", 1000)
+	vol.files["a"] = []byte("x")
+	vol.files["b"] = []byte("x")
+	vol.files["c"] = []byte("x")
+
+	d := NewDeduplicator("local", DedupConfig{Replicas: 1}, Volumes{vol}, &testTransport{}, nil)
+	d.Busy = func(file FileID) bool { return file.Path == "c" }
+	d.retire(Duplicate{Hash: "h", Size: 1, Replicas: []Replica{
+		{"local", FileID{"v", "a"}},
+		{"local", FileID{"v", "b"}},
+		{"local", FileID{"v", "c"}},
+	}}, nil)
+	if _, ok := vol.files["b"]; ok {
+		t.Fatalf("Expected b to be retired")
+	}
+	if _, ok := vol.files["a"]; !ok {
+		t.Fatalf("Expected a to be kept")
+	}
+	if _, ok := vol.files["c"]; !ok {
+		t.Fatalf("Expected busy c to be kept")
+	}
+
+	// Copies are only retired if the copies to keep are available.
+	d.retire(Duplicate{Hash: "h", Size: 1, Replicas: []Replica{
+		{"gone", FileID{"v", "a"}},
+		{"local", FileID{"v", "a"}},
+	}}, nil)
+	if _, ok := vol.files["a"]; !ok {
+		t.Fatalf("Expected a to be kept")
+	}
+}
+
+func TestDeduplicatorRunSkipped(t *testing.T) {
+	_, remote, server, cleanup := newTestSeller(t, map[string]string{"movie.mkv": "x"})
+	defer cleanup()
+
+	transport := &testTransport{peers: map[string]NodeMeta{"remote": {URL: server.URL}}}
+	d := NewDeduplicator("local", DedupConfig{}, Volumes{newTestVolume("v", 1000)}, transport, nil)
+	d.FileServer = NewFileServer(FileServerConfig{Addr: "127.0.0.1", Port: 8080}, nil, nil)
+
+	// Without TLS or a shared secret, the catalog of the remote peer is forbidden.
+	d.Run()
+	if report := d.Duplicates(); len(report.Skipped) != 1 || report.Skipped["remote"] == "" {
+		t.Fatalf("Expected remote to be skipped, got %+v", report)
+	}
+
+	remote.secret = d.FileServer.secret
+	d.Run()
+	if report := d.Duplicates(); len(report.Skipped) != 0 {
+		t.Fatalf("Expected no skipped peers, got %+v", report)
+	}
+}
@@ -0,0 +1,141 @@
+package libsyncer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// The Downloader fetches files won in an auction from the FileServer of the seller.
+// It is used instead of the Uploader of the seller, if the seller can't reach the
+// FileServer of the winner, e.g. because the winner is behind a NAT.
+type Downloader struct {
+	Volumes  Volumes
+	Throttle *Throttle
+	Clients  *PeerClients
+
+	// Name is the local peer, sent along with downloads.
+	Name PeerID
+}
+
+// Download stores the file available at downloadURL as file on the local volume.
+// The download is verified against the expected size and the checksum sent by the seller.
+// A partially downloaded file is removed again, a complete one gets the metadata sent by
+// the seller. Cancelling ctx aborts the download.
+func (d *Downloader) Download(ctx context.Context, file FileID, stats FileStats, peer PeerID, downloadURL string) error {
+	log.Printf("Downloading file %s from %s\n", file, peer)
+
+	vol := d.Volumes.Get(file.VolumeID)
+	if vol == nil {
+		return fmt.Errorf("invalid volume-id %s", file.VolumeID)
+	}
+	if _, err := vol.Stat(file.Path); err == nil {
+		return fmt.Errorf("%s already exists", file)
+	}
+
+	header, hash, err := d.fetch(ctx, vol, file.Path, stats, "", false, peer, downloadURL)
+	if err != nil {
+		return err
+	}
+	d.finish(vol, file, header, hash)
+	return nil
+}
+
+// Replace downloads a copy of a file with the given hash, if not empty, and replaces the
+// existing file with it, e.g. to overwrite an older version or to repair a corrupt file.
+// The copy is downloaded to a temporary file next to the file and only swapped into place
+// once it is complete and verified. The replaced file is moved into the trash.
+func (d *Downloader) Replace(ctx context.Context, file FileID, stats FileStats, hash string, peer PeerID, downloadURL string) error {
+	log.Printf("Downloading file %s from %s to replace the local copy\n", file, peer)
+
+	vol := d.Volumes.Get(file.VolumeID)
+	if vol == nil {
+		return fmt.Errorf("invalid volume-id %s", file.VolumeID)
+	}
+	tmp := tempPath(file.Path)
+	header, actual, err := d.fetch(ctx, vol, tmp, stats, hash, true, peer, downloadURL)
+	if err != nil {
+		return err
+	}
+
+	if err := replaceFile(vol, tmp, file.Path); err != nil {
+		vol.Delete(tmp)
+		return err
+	}
+	d.finish(vol, file, header, actual)
+	return nil
+}
+
+// fetch downloads the file at downloadURL to path on vol and returns the metadata sent by
+// the seller and the hash of the content. If verify is set, the content must be verified by
+// expectedHash or the checksum sent by the seller. An incomplete or corrupt download is
+// removed again.
+func (d *Downloader) fetch(ctx context.Context, vol Volume, path string, stats FileStats, expectedHash string, verify bool, peer PeerID, downloadURL string) (http.Header, string, error) {
+	req, err := http.NewRequest("GET", downloadURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set(PeerHeader, string(d.Name))
+
+	resp, err := d.Clients.Client(peer).Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("download failed: %s", resp.Status)
+	}
+
+	if err := MakeRoom(vol, stats.Size); err != nil {
+		log.Println("ERROR: Failed to purge the trash: " + err.Error())
+	}
+	writer, err := vol.Write(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	checksum := sha256.New()
+	n, err := io.Copy(io.MultiWriter(writer, checksum), d.Throttle.Reader(peer, resp.Body))
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && ByteSize(n) != stats.Size {
+		err = fmt.Errorf("expected %d bytes, got %d", stats.Size, n)
+	}
+	hash := hex.EncodeToString(checksum.Sum(nil))
+	expected := resp.Header.Get(ChecksumHeader)
+	if err == nil && expected != "" && expected != hash {
+		err = fmt.Errorf("checksum mismatch")
+	}
+	if err == nil && verify && expected == "" && expectedHash == "" {
+		err = fmt.Errorf("no checksum received")
+	}
+	if err == nil && expectedHash != "" && expectedHash != hash {
+		err = fmt.Errorf("content differs from the expected hash")
+	}
+
+	if err != nil {
+		if deleteErr := vol.Delete(path); deleteErr != nil {
+			log.Println("ERROR: Failed to remove partial download " + path + ": " + deleteErr.Error())
+		}
+		return nil, "", err
+	}
+	return resp.Header, hash, nil
+}
+
+// finish restores the metadata of a downloaded file and records its hash.
+func (d *Downloader) finish(vol Volume, file FileID, header http.Header, hash string) {
+	if meta, err := ParseFileMeta(header); err != nil {
+		log.Println("ERROR: Ignoring metadata of " + file.String() + ": " + err.Error())
+	} else if err := WriteMeta(vol, file.Path, meta); err != nil {
+		log.Println("ERROR: Failed to restore metadata of " + file.String() + ": " + err.Error())
+	}
+	storeHash(vol, file.Path, hash)
+	log.Printf("Download of %v succeeded.\n", file)
+}
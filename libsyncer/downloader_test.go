@@ -0,0 +1,122 @@
+package libsyncer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestSeller serves the returned volume with a FileServer. The volume is indexed, so
+// the hash sent along with downloads can be changed with SetHash.
+func newTestSeller(t *testing.T, files map[string]string) (*IndexedVolume, *FileServer, *httptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "mediasyncer-seller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol := newTestVolume("seller", 1000)
+	for path, content := range files {
+		vol.files[path] = []byte(content)
+	}
+	indexed, err := OpenIndex(filepath.Join(dir, "seller.db"), vol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexed.Rescan()
+	fs := NewFileServer(FileServerConfig{Addr: "127.0.0.1", Port: 8080}, Volumes{indexed}, NewThrottle(ThrottleConfig{}))
+	server := httptest.NewServer(fs)
+	return indexed, fs, server, func() {
+		server.Close()
+		indexed.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// downloadURL returns the URL to download file from the test server of fs.
+func downloadURL(t *testing.T, fs *FileServer, server *httptest.Server, file FileID) string {
+	u, err := fs.CreateDownloadURL(file, "local", time.Now().Add(PullTimeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server.URL + "/" + strings.TrimPrefix(u, fs.URL())
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestDownloaderDownload(t *testing.T) {
+	content := "new content"
+	seller, fs, server, cleanup := newTestSeller(t, map[string]string{"movie.mkv": content})
+	defer cleanup()
+	remote := FileID{VolumeID: "seller", Path: "movie.mkv"}
+
+	vol := newTestVolume("v", 1000)
+	d := &Downloader{Volumes: Volumes{vol}, Throttle: NewThrottle(ThrottleConfig{}), Name: "local"}
+	file := FileID{VolumeID: "v", Path: "movie.mkv"}
+	stats := FileStats{Size: ByteSize(len(content))}
+
+	// The checksum sent by the seller doesn't match the content.
+	seller.SetHash("movie.mkv", sha256Hex("old content"))
+	if err := d.Download(context.Background(), file, stats, "seller", downloadURL(t, fs, server, remote)); err == nil {
+		t.Fatal("Expected the corrupt download to fail")
+	}
+	if _, ok := vol.files["movie.mkv"]; ok {
+		t.Fatal("Expected the corrupt download to be removed")
+	}
+
+	// Without an indexed hash, the seller computes it.
+	seller.SetHash("movie.mkv", "")
+	if err := d.Download(context.Background(), file, stats, "seller", downloadURL(t, fs, server, remote)); err != nil {
+		t.Fatal(err)
+	}
+	if string(vol.files["movie.mkv"]) != content {
+		t.Fatalf("Unexpected content %q", vol.files["movie.mkv"])
+	}
+}
+
+func TestDownloaderReplace(t *testing.T) {
+	content := "new content"
+	checksum := sha256Hex(content)
+	seller, fs, server, cleanup := newTestSeller(t, map[string]string{"movie.mkv": content})
+	defer cleanup()
+	remote := FileID{VolumeID: "seller", Path: "movie.mkv"}
+
+	vol := newTestVolume("v", 1000)
+	vol.files["movie.mkv"] = []byte("old")
+	d := &Downloader{Volumes: Volumes{vol}, Throttle: NewThrottle(ThrottleConfig{}), Name: "local"}
+	file := FileID{VolumeID: "v", Path: "movie.mkv"}
+	stats := FileStats{Size: ByteSize(len(content))}
+
+	for _, c := range []struct {
+		name            string
+		remote          FileID
+		sent, hash      string
+		ok              bool
+		expectedContent string
+	}{
+		{"failed download", FileID{VolumeID: "seller", Path: "gone.mkv"}, checksum, "", false, "old"},
+		{"corrupt download", remote, sha256Hex("old"), "", false, "old"},
+		{"unexpected hash", remote, checksum, sha256Hex("old"), false, "old"},
+		{"verified download", remote, checksum, checksum, true, content},
+	} {
+		seller.SetHash("movie.mkv", c.sent)
+		err := d.Replace(context.Background(), file, stats, c.hash, "seller", downloadURL(t, fs, server, c.remote))
+		if (err == nil) != c.ok {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		}
+		if string(vol.files["movie.mkv"]) != c.expectedContent {
+			t.Errorf("%s: expected %q, got %q", c.name, c.expectedContent, vol.files["movie.mkv"])
+		}
+		if len(vol.files) != 1 {
+			t.Errorf("%s: temporary file left behind: %v", c.name, vol.files)
+		}
+	}
+}
@@ -0,0 +1,630 @@
+// File expr.go implements a small expression language which can be used as a PriceFormula.
+//
+// An expression is parsed once and evaluated for every file. It has access to the
+// following variables:
+//
+//	size      size of the file in bytes
+//	age       seconds since the last modification of the file
+//	path      path of the file inside the volume
+//	ext       lowercased file extension without the leading dot
+//	free      free bytes on the local volume
+//	capacity  total bytes of the local volume
+//	peer      name of the peer selling the file
+//
+// Numbers may carry a size (B, KB, MB, GB, TB, KiB, MiB, GiB, TiB) or duration
+// (s, m, h, d, w) suffix, e.g. `size > 2GiB && age > 30d ? 1.5 : 0.5`.
+// Supported operators are `?:`, `||`, `&&`, `!`, `==`, `!=`, `<`, `<=`, `>`, `>=`,
+// `+`, `-`, `*`, `/` and `%`. The functions contains(s, sub), prefix(s, p),
+// suffix(s, s), glob(s, pattern), min(a, b), max(a, b) and label(name) are available.
+// label(name) is true if the selling peer has the given label, e.g. `label("battery") ? -1 : 1`.
+// The expression must evaluate to a number.
+
+package libsyncer
+
+import (
+	"fmt"
+	"math"
+	pathpkg "path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// PriceFormulaExpr parses expr and returns a PriceFormula evaluating it for each file.
+// If the expression references age and no ModTime is given, or the expression yields
+// NaN or an infinite price, e.g. by a division by zero, -1 is returned.
+func PriceFormulaExpr(expr string) (PriceFormula, error) {
+	e, err := ParseExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	if e.root.typ() != exprNumber {
+		return nil, fmt.Errorf("expression must evaluate to a number, got %s", e.root.typ())
+	}
+
+	usesAge := e.vars["age"]
+	return func(ctx PriceContext) Price {
+		var age float64
+		if ctx.Stats.ModTime != nil {
+			age = ctx.Now.Sub(*ctx.Stats.ModTime).Seconds()
+		} else if usesAge {
+			return -1
+		}
+		env := &exprEnv{
+			vars: map[string]exprValue{
+				"size":     exprNum(float64(ctx.Stats.Size)),
+				"age":      exprNum(age),
+				"path":     exprStr(ctx.File.Path),
+				"ext":      exprStr(strings.ToLower(strings.TrimPrefix(pathpkg.Ext(ctx.File.Path), "."))),
+				"free":     exprNum(float64(ctx.FreeSpace)),
+				"capacity": exprNum(float64(ctx.Capacity)),
+				"peer":     exprStr(string(ctx.Peer)),
+			},
+			ctx: ctx,
+		}
+		price := Price(e.root.eval(env).num)
+		if math.IsNaN(float64(price)) || math.IsInf(float64(price), 0) {
+			return -1
+		}
+		return price
+	}, nil
+}
+
+// Expr is a parsed expression.
+type Expr struct {
+	source string
+	root   exprNode
+
+	// vars are the variables referenced by the expression.
+	vars map[string]bool
+}
+
+func (e *Expr) String() string {
+	return e.source
+}
+
+// ParseExpr parses the given expression and checks it for type errors.
+func ParseExpr(source string) (*Expr, error) {
+	tokens, err := lexExpr(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens, vars: make(map[string]bool)}
+	root, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+	}
+	return &Expr{source, root, p.vars}, nil
+}
+
+// Values
+
+type exprType int
+
+const (
+	exprNumber exprType = iota
+	exprString
+	exprBool
+)
+
+func (t exprType) String() string {
+	switch t {
+	case exprNumber:
+		return "number"
+	case exprString:
+		return "string"
+	default:
+		return "bool"
+	}
+}
+
+type exprValue struct {
+	num float64
+	str string
+	b   bool
+}
+
+func exprNum(f float64) exprValue  { return exprValue{num: f} }
+func exprStr(s string) exprValue   { return exprValue{str: s} }
+func exprBoolean(b bool) exprValue { return exprValue{b: b} }
+
+// exprEnv holds the values of all variables and the PriceContext they were taken from.
+type exprEnv struct {
+	vars map[string]exprValue
+	ctx  PriceContext
+}
+
+// exprVariables lists all variables an expression may reference.
+var exprVariables = map[string]exprType{
+	"size":     exprNumber,
+	"age":      exprNumber,
+	"path":     exprString,
+	"ext":      exprString,
+	"free":     exprNumber,
+	"capacity": exprNumber,
+	"peer":     exprString,
+}
+
+type exprFunc struct {
+	args []exprType
+	ret  exprType
+	call func(env *exprEnv, args []exprValue) exprValue
+}
+
+var exprFuncs = map[string]exprFunc{
+	"contains": {[]exprType{exprString, exprString}, exprBool, func(env *exprEnv, a []exprValue) exprValue {
+		return exprBoolean(strings.Contains(a[0].str, a[1].str))
+	}},
+	"prefix": {[]exprType{exprString, exprString}, exprBool, func(env *exprEnv, a []exprValue) exprValue {
+		return exprBoolean(strings.HasPrefix(a[0].str, a[1].str))
+	}},
+	"suffix": {[]exprType{exprString, exprString}, exprBool, func(env *exprEnv, a []exprValue) exprValue {
+		return exprBoolean(strings.HasSuffix(a[0].str, a[1].str))
+	}},
+	"glob": {[]exprType{exprString, exprString}, exprBool, func(env *exprEnv, a []exprValue) exprValue {
+		ok, _ := pathpkg.Match(a[1].str, a[0].str)
+		return exprBoolean(ok)
+	}},
+	"min": {[]exprType{exprNumber, exprNumber}, exprNumber, func(env *exprEnv, a []exprValue) exprValue {
+		return exprNum(math.Min(a[0].num, a[1].num))
+	}},
+	"max": {[]exprType{exprNumber, exprNumber}, exprNumber, func(env *exprEnv, a []exprValue) exprValue {
+		return exprNum(math.Max(a[0].num, a[1].num))
+	}},
+	"label": {[]exprType{exprString}, exprBool, func(env *exprEnv, a []exprValue) exprValue {
+		return exprBoolean(env.ctx.HasLabel(a[0].str))
+	}},
+}
+
+// Lexer
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+	num  float64
+}
+
+var exprUnits = map[string]float64{
+	"B":   1,
+	"KB":  1000,
+	"MB":  1000 * 1000,
+	"GB":  1000 * 1000 * 1000,
+	"TB":  1000 * 1000 * 1000 * 1000,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+	"TiB": 1 << 40,
+	"s":   1,
+	"m":   time.Minute.Seconds(),
+	"h":   time.Hour.Seconds(),
+	"d":   24 * time.Hour.Seconds(),
+	"w":   7 * 24 * time.Hour.Seconds(),
+}
+
+var exprOperators = []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "%", "(", ")", ",", "?", ":"}
+
+func lexExpr(s string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(s) {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			start := i
+			for i < len(s) && (unicode.IsDigit(rune(s[i])) || s[i] == '.') {
+				i++
+			}
+			f, err := strconv.ParseFloat(s[start:i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at offset %d", s[start:i], start)
+			}
+			unitStart := i
+			for i < len(s) && unicode.IsLetter(rune(s[i])) {
+				i++
+			}
+			if unit := s[unitStart:i]; unit != "" {
+				factor, ok := exprUnits[unit]
+				if !ok {
+					return nil, fmt.Errorf("unknown unit %q at offset %d", unit, unitStart)
+				}
+				f *= factor
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: s[start:i], pos: start, num: f})
+		case c == '"':
+			start := i
+			i++
+			var str []byte
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				str = append(str, s[i])
+			}
+			if i >= len(s) {
+				return nil, fmt.Errorf("unterminated string at offset %d", start)
+			}
+			i++
+			tokens = append(tokens, token{kind: tokString, text: string(str), pos: start})
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(s) && (unicode.IsLetter(rune(s[i])) || unicode.IsDigit(rune(s[i])) || s[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: s[start:i], pos: start})
+		default:
+			op := ""
+			for _, candidate := range exprOperators {
+				if strings.HasPrefix(s[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q at offset %d", c, i)
+			}
+			tokens = append(tokens, token{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokEOF, text: "end of expression", pos: len(s)}), nil
+}
+
+// Parser
+
+type exprParser struct {
+	tokens []token
+	pos    int
+	vars   map[string]bool
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *exprParser) acceptOp(ops ...string) (string, bool) {
+	tok := p.peek()
+	if tok.kind != tokOp {
+		return "", false
+	}
+	for _, op := range ops {
+		if tok.text == op {
+			p.next()
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) expectOp(op string) error {
+	if _, ok := p.acceptOp(op); !ok {
+		tok := p.peek()
+		return fmt.Errorf("expected %q at offset %d, got %q", op, tok.pos, tok.text)
+	}
+	return nil
+}
+
+func (p *exprParser) parseTernary() (exprNode, error) {
+	cond, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := p.acceptOp("?"); !ok {
+		return cond, nil
+	}
+	then, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectOp(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if cond.typ() != exprBool {
+		return nil, fmt.Errorf("condition of ?: must be bool, got %s", cond.typ())
+	}
+	if then.typ() != otherwise.typ() {
+		return nil, fmt.Errorf("branches of ?: have different types %s and %s", then.typ(), otherwise.typ())
+	}
+	return &exprTernary{cond, then, otherwise}, nil
+}
+
+// exprPrecedence lists the binary operators from lowest to highest precedence.
+var exprPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *exprParser) parseBinary(level int) (exprNode, error) {
+	if level == len(exprPrecedence) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.acceptOp(exprPrecedence[level]...)
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left, err = newExprBinary(op, left, right)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if op, ok := p.acceptOp("!", "-"); ok {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if op == "!" && operand.typ() != exprBool {
+			return nil, fmt.Errorf("operand of ! must be bool, got %s", operand.typ())
+		}
+		if op == "-" && operand.typ() != exprNumber {
+			return nil, fmt.Errorf("operand of - must be number, got %s", operand.typ())
+		}
+		return &exprUnary{op, operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber:
+		return &exprLiteral{exprNumber, exprNum(tok.num)}, nil
+	case tokString:
+		return &exprLiteral{exprString, exprStr(tok.text)}, nil
+	case tokIdent:
+		if tok.text == "true" || tok.text == "false" {
+			return &exprLiteral{exprBool, exprBoolean(tok.text == "true")}, nil
+		}
+		if _, ok := p.acceptOp("("); ok {
+			return p.parseCall(tok)
+		}
+		t, ok := exprVariables[tok.text]
+		if !ok {
+			return nil, fmt.Errorf("unknown variable %q at offset %d", tok.text, tok.pos)
+		}
+		p.vars[tok.text] = true
+		return &exprVariable{tok.text, t}, nil
+	case tokOp:
+		if tok.text == "(" {
+			node, err := p.parseTernary()
+			if err != nil {
+				return nil, err
+			}
+			return node, p.expectOp(")")
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+}
+
+func (p *exprParser) parseCall(name token) (exprNode, error) {
+	fn, ok := exprFuncs[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at offset %d", name.text, name.pos)
+	}
+
+	var args []exprNode
+	if _, ok := p.acceptOp(")"); !ok {
+		for {
+			arg, err := p.parseTernary()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if _, ok := p.acceptOp(","); !ok {
+				break
+			}
+		}
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(args) != len(fn.args) {
+		return nil, fmt.Errorf("%s() expects %d arguments, got %d", name.text, len(fn.args), len(args))
+	}
+	for i, arg := range args {
+		if arg.typ() != fn.args[i] {
+			return nil, fmt.Errorf("argument %d of %s() must be %s, got %s", i+1, name.text, fn.args[i], arg.typ())
+		}
+	}
+	return &exprCall{fn, args}, nil
+}
+
+// AST
+
+type exprNode interface {
+	typ() exprType
+	eval(env *exprEnv) exprValue
+}
+
+type exprLiteral struct {
+	t exprType
+	v exprValue
+}
+
+func (n *exprLiteral) typ() exprType               { return n.t }
+func (n *exprLiteral) eval(env *exprEnv) exprValue { return n.v }
+
+type exprVariable struct {
+	name string
+	t    exprType
+}
+
+func (n *exprVariable) typ() exprType               { return n.t }
+func (n *exprVariable) eval(env *exprEnv) exprValue { return env.vars[n.name] }
+
+type exprUnary struct {
+	op      string
+	operand exprNode
+}
+
+func (n *exprUnary) typ() exprType { return n.operand.typ() }
+func (n *exprUnary) eval(env *exprEnv) exprValue {
+	v := n.operand.eval(env)
+	if n.op == "!" {
+		return exprBoolean(!v.b)
+	}
+	return exprNum(-v.num)
+}
+
+type exprBinary struct {
+	op          string
+	t           exprType
+	left, right exprNode
+}
+
+func newExprBinary(op string, left, right exprNode) (exprNode, error) {
+	lt, rt := left.typ(), right.typ()
+	if lt != rt {
+		return nil, fmt.Errorf("operands of %s have different types %s and %s", op, lt, rt)
+	}
+
+	t := exprBool
+	switch op {
+	case "||", "&&":
+		if lt != exprBool {
+			return nil, fmt.Errorf("operands of %s must be bool, got %s", op, lt)
+		}
+	case "==", "!=":
+	case "<", "<=", ">", ">=":
+		if lt == exprBool {
+			return nil, fmt.Errorf("operands of %s must not be bool", op)
+		}
+	default:
+		if lt != exprNumber {
+			return nil, fmt.Errorf("operands of %s must be number, got %s", op, lt)
+		}
+		t = exprNumber
+	}
+	return &exprBinary{op, t, left, right}, nil
+}
+
+func (n *exprBinary) typ() exprType { return n.t }
+func (n *exprBinary) eval(env *exprEnv) exprValue {
+	l := n.left.eval(env)
+
+	// Short-circuit the boolean operators.
+	switch n.op {
+	case "||":
+		if l.b {
+			return l
+		}
+		return n.right.eval(env)
+	case "&&":
+		if !l.b {
+			return l
+		}
+		return n.right.eval(env)
+	}
+
+	r := n.right.eval(env)
+	switch n.op {
+	case "==":
+		return exprBoolean(l == r)
+	case "!=":
+		return exprBoolean(l != r)
+	case "<", "<=", ">", ">=":
+		return exprBoolean(exprCompare(n.op, n.left.typ(), l, r))
+	case "+":
+		return exprNum(l.num + r.num)
+	case "-":
+		return exprNum(l.num - r.num)
+	case "*":
+		return exprNum(l.num * r.num)
+	case "/":
+		return exprNum(l.num / r.num)
+	default:
+		return exprNum(math.Mod(l.num, r.num))
+	}
+}
+
+func exprCompare(op string, t exprType, l, r exprValue) bool {
+	cmp := 0
+	if t == exprString {
+		cmp = strings.Compare(l.str, r.str)
+	} else if l.num < r.num {
+		cmp = -1
+	} else if l.num > r.num {
+		cmp = 1
+	}
+
+	switch op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+type exprTernary struct {
+	cond, then, otherwise exprNode
+}
+
+func (n *exprTernary) typ() exprType { return n.then.typ() }
+func (n *exprTernary) eval(env *exprEnv) exprValue {
+	if n.cond.eval(env).b {
+		return n.then.eval(env)
+	}
+	return n.otherwise.eval(env)
+}
+
+type exprCall struct {
+	fn   exprFunc
+	args []exprNode
+}
+
+func (n *exprCall) typ() exprType { return n.fn.ret }
+func (n *exprCall) eval(env *exprEnv) exprValue {
+	values := make([]exprValue, len(n.args))
+	for i, arg := range n.args {
+		values[i] = arg.eval(env)
+	}
+	return n.fn.call(env, values)
+}
@@ -0,0 +1,150 @@
+package libsyncer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPriceFormulaExpr(t *testing.T) {
+	now := time.Date(2016, 01, 01, 0, 0, 0, 0, time.FixedZone("UTC", 0))
+	modTime := time.Date(2015, 12, 31, 0, 0, 0, 0, time.FixedZone("UTC", 0))
+
+	file := FileID{
+		VolumeID: "vol1",
+		Path:     "shows/my-show/Episode.MKV",
+	}
+	stats := FileStats{
+		Size:    ByteSize(3 << 30),
+		ModTime: &modTime,
+	}
+	ctx := PriceContext{
+		File:       file,
+		Stats:      stats,
+		FreeSpace:  ByteSize(1024),
+		Capacity:   ByteSize(2048),
+		Peer:       "laptop",
+		PeerLabels: []string{"battery"},
+		Now:        now,
+	}
+
+	tests := []struct {
+		expr  string
+		price Price
+	}{
+		{"1.5", 1.5},
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"-1", -1},
+		{"10 % 4", 2},
+		{"size > 2GiB ? 2 : 1", 2},
+		{"size > 2GiB && age > 2d ? 2 : 1", 1},
+		{"age == 1d ? 1 : 0", 1},
+		{"ext == \"mkv\" ? 1 : 0", 1},
+		{"prefix(path, \"shows/\") && !contains(path, \"movies\") ? 1 : 0", 1},
+		{"glob(path, \"shows/*/*.MKV\") ? 1 : 0", 1},
+		{"free / capacity", 0.5},
+		{"max(free, 10KB) / 10000", 1},
+		{"min(1, 2) + max(1, 2)", 3},
+		{"peer == \"laptop\" ? 1 : 0", 1},
+		{"label(\"battery\") ? -1 : 1", -1},
+		{"label(\"always-on\") ? -1 : 1", 1},
+		{"\"abc\" < \"abd\" ? 1 : 0", 1},
+	}
+
+	for _, test := range tests {
+		f, err := PriceFormulaExpr(test.expr)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.expr, err)
+		}
+		if price := f(ctx); price != test.price {
+			t.Errorf("%s: expected %v, but got %v", test.expr, test.price, price)
+		}
+	}
+}
+
+func TestPriceFormulaExpr_Errors(t *testing.T) {
+	tests := []string{
+		"",
+		"size >",
+		"(1 + 2",
+		"1 2",
+		"unknown",
+		"unknown(1)",
+		"10XB",
+		"\"unterminated",
+		"path",
+		"size > 1",
+		"size + path",
+		"size ? 1 : 2",
+		"size > 1 ? 1 : path",
+		"min(1)",
+		"contains(size, path)",
+		"!size",
+		"label(1)",
+		"true < false",
+	}
+
+	for _, expr := range tests {
+		if _, err := PriceFormulaExpr(expr); err == nil {
+			t.Errorf("%s: expected an error", expr)
+		}
+	}
+}
+
+func TestPriceFormulaExpr_Invalid(t *testing.T) {
+	ctx := PriceContext{
+		File:  FileID{VolumeID: "vol1", Path: "movie.mkv"},
+		Stats: FileStats{Size: ByteSize(1024)},
+	}
+
+	tests := []struct {
+		expr  string
+		price Price
+	}{
+		{"size / 1KiB", 1},
+		{"age > 1d ? 2 : 1", -1},
+		{"free / capacity", -1},
+		{"size / capacity", -1},
+		{"-size / capacity", -1},
+		{"size * 1TB * 1TB * 1TB", -1},
+	}
+
+	for _, test := range tests {
+		f, err := PriceFormulaExpr(test.expr)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.expr, err)
+		}
+		if price := f(ctx); price != test.price {
+			t.Errorf("%s: expected %v, but got %v", test.expr, test.price, price)
+		}
+	}
+}
+
+func TestPriceFormulaExpr_MatchesAge(t *testing.T) {
+	now := time.Date(2016, 01, 01, 0, 0, 0, 0, time.FixedZone("UTC", 0))
+	age := AdaptPriceFormula(PriceFormulaAge(true, 60*24*time.Hour, Price(1.0), Price(0.5), staticClock(now)))
+	expr, err := PriceFormulaExpr("age > 60d ? 1.0 : 0.5")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	file := FileID{
+		VolumeID: "vol1",
+		Path:     "/testing.txt",
+	}
+	for _, modTime := range []time.Time{
+		time.Date(2015, 12, 31, 0, 0, 0, 0, time.FixedZone("UTC", 0)),
+		time.Date(2015, 03, 10, 0, 0, 0, 0, time.FixedZone("UTC", 0)),
+	} {
+		ctx := PriceContext{
+			File: file,
+			Stats: FileStats{
+				ModTime: &modTime,
+			},
+			Now: now,
+		}
+		if expr(ctx) != age(ctx) {
+			t.Fatalf("Expected expression to match PriceFormulaAge for %v", modTime)
+		}
+	}
+}
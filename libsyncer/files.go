@@ -0,0 +1,136 @@
+package libsyncer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// FilesPath is the path of the file listing on the FileServer of each peer. The files can be
+// filtered with `?match=PATTERN`, see MatchFile.
+const FilesPath = "/files"
+
+// ErrFileExists is returned by StoreFile for existing files, which must not be overwritten.
+var ErrFileExists = errors.New("file exists")
+
+// FileStatus describes a file of a volume, as listed by ListFiles. Peer is set for files
+// found in the cluster.
+type FileStatus struct {
+	Peer    PeerID    `json:"peer,omitempty"`
+	File    FileID    `json:"file"`
+	Size    ByteSize  `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Hash    string    `json:"hash,omitempty"`
+	Pinned  bool      `json:"pinned,omitempty"`
+}
+
+// MatchFile returns true if the path of a file matches pattern. Patterns containing `*`, `?`
+// or `[` are globs (see path.Match) for the whole path or the name of the file, other
+// patterns match any part of the path, ignoring case. The empty pattern matches all files.
+func MatchFile(pattern, p string) bool {
+	if pattern == "" {
+		return true
+	}
+	if !strings.ContainsAny(pattern, "*?[") {
+		return strings.Contains(strings.ToLower(p), strings.ToLower(pattern))
+	}
+	if ok, _ := path.Match(pattern, p); ok {
+		return true
+	}
+	ok, _ := path.Match(pattern, path.Base(p))
+	return ok
+}
+
+// ListFiles returns the files of the volumes matching pattern, ordered by volume and path.
+func ListFiles(vols Volumes, pattern string, pins *Pins) []FileStatus {
+	files := []FileStatus{}
+	for _, vol := range vols {
+		vol.Walk(func(p string, info os.FileInfo, err error) error {
+			if err != nil || !MatchFile(pattern, p) {
+				return nil
+			}
+			files = append(files, fileStatus(FileID{VolumeID: vol.ID(), Path: p}, info, pins))
+			return nil
+		})
+	}
+	return files
+}
+
+// tempPath returns the path of a temporary file next to path, e.g. for downloading a file
+// replacing the file at path.
+func tempPath(p string) string {
+	return path.Join(path.Dir(p), fmt.Sprintf(".mediasyncer-%d-%s", time.Now().UnixNano(), path.Base(p)))
+}
+
+// replaceFile moves the file at p into the trash and renames the file at tmp to p.
+func replaceFile(vol Volume, tmp, p string) error {
+	if _, err := vol.Stat(p); err == nil {
+		if err := TrashFile(vol, p); err != nil {
+			return fmt.Errorf("failed to trash the replaced file: %v", err)
+		}
+	}
+	return RenameFile(vol, tmp, p)
+}
+
+func fileStatus(file FileID, info os.FileInfo, pins *Pins) FileStatus {
+	status := FileStatus{
+		File:    file,
+		Size:    ByteSize(info.Size()),
+		ModTime: info.ModTime(),
+		Pinned:  pins.Pinned(file),
+	}
+	if entry, ok := info.Sys().(IndexEntry); ok {
+		status.Hash = entry.Hash
+	}
+	return status
+}
+
+// StoreFile writes the content of r to path on vol and restores the metadata of the file.
+// An existing file is replaced if overwrite is set, otherwise ErrFileExists is returned: the
+// content is written to a temporary file first and the existing file is only moved into the
+// trash once the content is complete. size is the expected size of the file, if known, to
+// make room in the trash.
+func StoreFile(vol Volume, path string, r io.Reader, size int64, meta FileMeta, overwrite bool) error {
+	target := path
+	_, err := vol.Stat(path)
+	if err == nil {
+		if !overwrite {
+			return ErrFileExists
+		}
+		log.Printf("Overwriting %s on volume %s\n", path, vol.ID())
+		target = tempPath(path)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if size > 0 {
+		if err := MakeRoom(vol, ByteSize(size)); err != nil {
+			log.Println("ERROR: Failed to purge the trash: " + err.Error())
+		}
+	}
+
+	writer, err := vol.Write(target)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, r)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && target != path {
+		err = replaceFile(vol, target, path)
+	}
+	if err != nil {
+		vol.Delete(target)
+		return err
+	}
+	if err := WriteMeta(vol, path, meta); err != nil {
+		log.Println("ERROR: Failed to restore metadata of " + path + ": " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package libsyncer
+
+import (
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestMatchFile(t *testing.T) {
+	for _, c := range []struct {
+		pattern, path string
+		match         bool
+	}{
+		{"", "movies/a.mkv", true},
+		{"*.mkv", "movies/a.mkv", true},
+		{"movies/*", "movies/a.mkv", true},
+		{"*.mkv", "movies/a.mp4", false},
+		{"MOVIES", "movies/a.mkv", true},
+		{"a.mk", "movies/a.mkv", true},
+		{"series", "movies/a.mkv", false},
+	} {
+		if MatchFile(c.pattern, c.path) != c.match {
+			t.Errorf("Expected MatchFile(%q, %q) to be %v", c.pattern, c.path, c.match)
+		}
+	}
+}
+
+func TestStoreFile(t *testing.T) {
+	vol := newTestVolume("v", 1000)
+	if err := StoreFile(vol, "a", strings.NewReader("hello"), 5, FileMeta{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := StoreFile(vol, "a", strings.NewReader("again"), 5, FileMeta{}, false); err != ErrFileExists {
+		t.Fatalf("Expected ErrFileExists, got %v", err)
+	}
+	if err := StoreFile(vol, "a", strings.NewReader("again"), 5, FileMeta{}, true); err != nil {
+		t.Fatal(err)
+	}
+	if string(vol.files["a"]) != "again" {
+		t.Fatalf("Expected the file to be overwritten, got %q", vol.files["a"])
+	}
+
+	pins := &Pins{files: map[FileID]bool{{"v", "a"}: true}}
+	files := ListFiles(Volumes{vol}, "a", pins)
+	if len(files) != 1 || files[0].File.Path != "a" || files[0].Size != 5 || !files[0].Pinned {
+		t.Fatalf("Unexpected files %+v", files)
+	}
+}
+
+func TestStoreFileKeepsFileOnFailure(t *testing.T) {
+	vol := newTestVolume("v", 1000)
+	vol.files["a"] = []byte("hello")
+	if err := StoreFile(vol, "a", iotest.TimeoutReader(strings.NewReader("again")), 5, FileMeta{}, true); err == nil {
+		t.Fatal("Expected an error for a failed upload")
+	}
+	if string(vol.files["a"]) != "hello" || len(vol.files) != 1 {
+		t.Fatalf("Expected the existing file to be kept, got %v", vol.files)
+	}
+}
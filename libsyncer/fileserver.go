@@ -1,31 +1,78 @@
 package libsyncer
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// PeerHeader is the HTTP header peers send their name in when talking to a FileServer.
+	// It is informational only, the FileServer identifies peers by their certificate or the
+	// signature of the URL.
+	PeerHeader = "X-Mediasyncer-Peer"
+
+	// ChecksumHeader is the HTTP header containing the hex encoded SHA-256 of a downloaded file.
+	ChecksumHeader = "X-Mediasyncer-Sha256"
 )
 
 type FileServerConfig struct {
 	Addr string
 	Port int
+
+	// TLS enables HTTPS with client certificates, if configured.
+	TLS TLSConfig
+
+	// Secret signs the download URLs. If all peers share the same Secret, they can sign
+	// requests to each other, e.g. to fetch the catalog, without TLS. A random secret is
+	// used if empty.
+	Secret []byte
 }
 
 type FileServer struct {
 	FileServerConfig
 
-	Volume Volume
+	Volumes  Volumes
+	Throttle *Throttle
+
+	// Name is the local peer, which requests signed with SignURL are issued for.
+	Name PeerID
+
+	// Pins are reported in the file listing, if set.
+	Pins *Pins
+
+	// secret is used to sign download URLs and requests to other peers.
+	secret []byte
 
 	l net.Listener
 }
 
-func NewFileServer(cfg FileServerConfig, vol Volume) *FileServer {
+func NewFileServer(cfg FileServerConfig, vols Volumes, throttle *Throttle) *FileServer {
+	secret := cfg.Secret
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			panic("Failed to create secret: " + err.Error())
+		}
+	}
+
 	return &FileServer{
 		FileServerConfig: cfg,
-		Volume:           vol,
+		Volumes:          vols,
+		Throttle:         throttle,
+		secret:           secret,
 	}
 }
 
@@ -34,6 +81,13 @@ func (fs *FileServer) Serve() {
 	if err != nil {
 		panic(err.Error())
 	}
+	if fs.TLS.Enabled() {
+		cfg, err := fs.TLS.ServerConfig()
+		if err != nil {
+			panic("Failed to load TLS config: " + err.Error())
+		}
+		l = tls.NewListener(l, cfg)
+	}
 	fs.l = l
 
 	if err := http.Serve(fs.l, fs); err != nil {
@@ -50,23 +104,213 @@ func (fs *FileServer) Close() {
 // CreateUploadURL returns an URL that can be used to PUT the given file.
 // The URL may be signed or have any number of query parameter.
 // A client performing the upload MUST NOT modify this URL.
-func (fs *FileServer) CreateUploadURL(file FileID) (string, error) {
-	if file.VolumeID != fs.Volume.ID() {
-		panic("Invalid volume id")
+// The URL is signed for peer until it expires, so the upload counts against the bandwidth
+// limit of peer.
+func (fs *FileServer) CreateUploadURL(file FileID, peer PeerID, expires time.Time) (string, error) {
+	if fs.Volumes.Get(file.VolumeID) == nil {
+		return "", fmt.Errorf("invalid volume-id %s", file.VolumeID)
+	}
+
+	return fs.fileURL(urlPath(file), fs.signature(urlPath(file), expires, peer)), nil
+}
+
+// CreateDownloadURL returns a URL signed for peer that can be used to GET the given file
+// until it expires.
+func (fs *FileServer) CreateDownloadURL(file FileID, peer PeerID, expires time.Time) (string, error) {
+	if fs.Volumes.Get(file.VolumeID) == nil {
+		return "", fmt.Errorf("invalid volume-id %s", file.VolumeID)
+	}
+
+	return fs.fileURL(urlPath(file), fs.signature(urlPath(file), expires, peer)), nil
+}
+
+// peerRequestExpiry is how long the requests signed with SignURL are valid.
+const peerRequestExpiry = 5 * time.Minute
+
+// SignURL signs u, an URL of the FileServer of another peer, for a request sent right away.
+// The peer only accepts the signature if it shares the Secret. A nil FileServer returns u
+// unchanged.
+func (fs *FileServer) SignURL(u string) string {
+	if fs == nil {
+		return u
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	query := parsed.Query()
+	for k, v := range fs.signature(strings.TrimPrefix(parsed.Path, "/"), time.Now().Add(peerRequestExpiry), fs.Name) {
+		query[k] = v
+	}
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
+
+// signature returns the query parameters signing path for peer until it expires.
+func (fs *FileServer) signature(path string, expires time.Time, peer PeerID) url.Values {
+	expiresAt := strconv.FormatInt(expires.Unix(), 10)
+	query := url.Values{}
+	query.Set("expires", expiresAt)
+	query.Set("peer", string(peer))
+	query.Set("signature", fs.sign(path, expiresAt, peer))
+	return query
+}
+
+// CreateOverwriteURL returns a URL signed for peer that can be used to PUT the given file
+// until it expires, replacing the existing file. The existing file is moved into the trash.
+func (fs *FileServer) CreateOverwriteURL(file FileID, peer PeerID, expires time.Time) (string, error) {
+	if fs.Volumes.Get(file.VolumeID) == nil {
+		return "", fmt.Errorf("invalid volume-id %s", file.VolumeID)
+	}
+
+	query := fs.signature("overwrite\n"+urlPath(file), expires, peer)
+	query.Set("overwrite", "1")
+	return fs.fileURL(urlPath(file), query), nil
+}
+
+// urlPath returns the path of file in the URLs of the FileServer: the volume ID followed by
+// the path within the volume.
+func urlPath(file FileID) string {
+	return file.VolumeID + "/" + strings.TrimPrefix(file.Path, "/")
+}
+
+// file returns the file a request refers to.
+func (fs *FileServer) file(req *http.Request) (Volume, FileID, bool) {
+	v := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)
+	if len(v) != 2 || v[1] == "" {
+		return nil, FileID{}, false
+	}
+	vol := fs.Volumes.Get(v[0])
+	if vol == nil {
+		return nil, FileID{}, false
+	}
+	return vol, FileID{VolumeID: v[0], Path: v[1]}, true
+}
+
+// URL returns the base URL of the FileServer.
+func (fs *FileServer) URL() string {
+	return fs.fileURL("", nil)
+}
+
+func (fs *FileServer) fileURL(path string, query url.Values) string {
+	scheme := "http"
+	if fs.TLS.Enabled() {
+		scheme = "https"
+	}
+	u := url.URL{
+		Scheme:   scheme,
+		Host:     net.JoinHostPort(fs.Addr, strconv.Itoa(fs.Port)),
+		Path:     "/" + path,
+		RawQuery: query.Encode(),
 	}
+	return u.String()
+}
 
-	// TODO: End signature
-	// TODO: End expire date
-	return fmt.Sprintf("http://%s:%d/%s", fs.Addr, fs.Port, file.Path), nil
+func (fs *FileServer) sign(path, expires string, peer PeerID) string {
+	mac := hmac.New(sha256.New, fs.secret)
+	io.WriteString(mac, path+"\n"+expires+"\n"+string(peer))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// authenticated returns true if the request was sent by a peer with a verified client
+// certificate, or signed by CreateDownloadURL or SignURL.
+func (fs *FileServer) authenticated(req *http.Request) bool {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	return fs.verifySignature(req)
+}
+
+// peer returns the authenticated peer sending req: the name of its verified client
+// certificate, or the peer a signed URL was issued for. It is empty for other requests,
+// which are only limited by the global rate of the Throttle.
+func (fs *FileServer) peer(req *http.Request) PeerID {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		return PeerID(req.TLS.VerifiedChains[0][0].Subject.CommonName)
+	}
+	if fs.verifySignature(req) || fs.verifyOverwrite(req) {
+		return PeerID(req.URL.Query().Get("peer"))
+	}
+	return ""
+}
+
+// verifySignature checks the signature of a URL created by CreateDownloadURL or SignURL.
+func (fs *FileServer) verifySignature(req *http.Request) bool {
+	query := req.URL.Query()
+	signature := query.Get("signature")
+	if signature == "" {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	expected := fs.sign(req.URL.Path[1:], query.Get("expires"), PeerID(query.Get("peer")))
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
+
+// verifyOverwrite checks the signature of an upload URL created by CreateOverwriteURL.
+func (fs *FileServer) verifyOverwrite(req *http.Request) bool {
+	query := req.URL.Query()
+	if query.Get("overwrite") == "" {
+		return false
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	expected := fs.sign("overwrite\n"+req.URL.Path[1:], query.Get("expires"), PeerID(query.Get("peer")))
+	return hmac.Equal([]byte(query.Get("signature")), []byte(expected))
+}
+
+// contentHash returns the hash of file recorded in the index, or computes it. The hash
+// isn't recorded here: that is left to the Scrubber, which reads the file at its own rate.
+func contentHash(file io.ReadSeeker, info os.FileInfo) (string, error) {
+	if entry, ok := info.Sys().(IndexEntry); ok && entry.Hash != "" {
+		return entry.Hash, nil
+	}
+	checksum := sha256.New()
+	if _, err := io.Copy(checksum, file); err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(checksum.Sum(nil)), nil
 }
 
 // HTTP Handler Implementation
 
 func (fs *FileServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
-	if req.Method == "HEAD" || req.Method == "GET" {
-		filepath := req.RequestURI
-		stats, err := fs.Volume.Stat(filepath)
+	// The PeerHeader is chosen by the client, only authenticated names select the
+	// bandwidth limit of a peer.
+	peer := fs.peer(req)
+	if req.Method == "GET" && (req.URL.Path == CatalogPath || req.URL.Path == FilesPath) {
+		// The listings reveal all files of the node to other peers only.
+		if !fs.authenticated(req) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if req.URL.Path == CatalogPath {
+			writeJSON(w, Catalog(fs.Volumes))
+		} else {
+			writeJSON(w, ListFiles(fs.Volumes, req.URL.Query().Get("match"), fs.Pins))
+		}
+	} else if req.Method == "HEAD" || req.Method == "GET" {
+		if !fs.authenticated(req) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		vol, fileID, ok := fs.file(req)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		filepath := fileID.Path
+		stats, err := vol.Stat(filepath)
 		if err != nil {
 			if os.IsNotExist(err) {
 				w.WriteHeader(http.StatusNotFound)
@@ -76,48 +320,66 @@ func (fs *FileServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		file, err := fs.Volume.Read(filepath)
+		file, err := vol.Read(filepath)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		http.ServeContent(w, req, req.RequestURI, stats.ModTime(), file)
-	} else if req.Method == "PUT" {
-		path := req.RequestURI
+		if closer, ok := file.(io.Closer); ok {
+			defer closer.Close()
+		}
 
-		file := FileID{
-			VolumeID: fs.Volume.ID(),
-			Path:     path,
+		if meta, err := ReadMeta(vol, filepath); err == nil {
+			meta.SetHeader(w.Header())
 		}
-		size := req.Header.Get("Content-Length")
 
-		log.Println("Receiving upload for " + file.String() + " (size=" + size + ")")
+		// Full downloads carry a checksum of the content, so the client can verify them. It has
+		// to be sent as a header: ServeContent sets the Content-Length, and trailers are only
+		// sent with chunked responses.
+		if req.Method == "GET" && req.Header.Get("Range") == "" {
+			checksum, err := contentHash(file, stats)
+			if err != nil {
+				log.Println("ERROR: Failed to hash " + fileID.String() + ": " + err.Error())
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set(ChecksumHeader, checksum)
+		}
 
-		// We expect a does-not-exist error here.
-		// no error => File exists => forbidden
-		// does-not-exist => No file there => OK, go on
-		// other error => internal server error
-		_, err := fs.Volume.Stat(path)
-		if err == nil {
-			w.WriteHeader(http.StatusForbidden)
+		http.ServeContent(&throttledResponseWriter{w, fs.Throttle.Writer(peer, w)}, req, filepath, stats.ModTime(), file)
+	} else if req.Method == "PUT" {
+		vol, file, ok := fs.file(req)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
 			return
-		} else if !os.IsNotExist(err) {
-			log.Println("ERROR Stat(): " + err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
+		}
+		path := file.Path
+		if Ignored(vol, path) {
+			log.Println("Rejecting upload for ignored file " + file.String())
+			w.WriteHeader(http.StatusForbidden)
 			return
 		}
+		size := req.Header.Get("Content-Length")
 
-		writer, err := fs.Volume.Write(path)
+		log.Println("Receiving upload for " + file.String() + " (size=" + size + ")")
+
+		meta, err := ParseFileMeta(req.Header)
 		if err != nil {
-			log.Println("ERROR Write(): " + err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("ERROR: Invalid metadata: " + err.Error())
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		defer writer.Close()
 
-		if _, err := io.Copy(writer, req.Body); err != nil {
-			log.Println("ERROR: Failed to upload file: " + err.Error())
+		err = StoreFile(vol, path, fs.Throttle.Reader(peer, req.Body), req.ContentLength, meta, fs.verifyOverwrite(req))
+		if err == ErrFileExists {
+			log.Println("Rejecting upload for existing file " + file.String())
+			w.WriteHeader(http.StatusConflict)
+			return
+		} else if err != nil {
+			log.Println("ERROR: Failed to upload " + file.String() + ": " + err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
 		w.WriteHeader(http.StatusCreated)
 		log.Printf("Upload of %v succeeded.\n", file)
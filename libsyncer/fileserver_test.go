@@ -0,0 +1,103 @@
+package libsyncer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileServerAuthentication(t *testing.T) {
+	vol := newTestVolume("v", 1000)
+	vol.files["movie.mkv"] = []byte("hello")
+	secret := []byte("0123456789abcdef")
+	fs := NewFileServer(FileServerConfig{Addr: "127.0.0.1", Port: 8080, Secret: secret}, Volumes{vol}, NewThrottle(ThrottleConfig{}))
+	peer := NewFileServer(FileServerConfig{Addr: "127.0.0.1", Port: 8081, Secret: secret}, Volumes{vol}, nil)
+	stranger := NewFileServer(FileServerConfig{Addr: "127.0.0.1", Port: 8082}, Volumes{vol}, nil)
+
+	file := FileID{VolumeID: "v", Path: "movie.mkv"}
+	plain := fs.URL() + urlPath(file)
+	download, _ := fs.CreateDownloadURL(file, "peer", time.Now().Add(PullTimeout))
+	expired, _ := fs.CreateDownloadURL(file, "peer", time.Now().Add(-1*time.Minute))
+	for _, c := range []struct {
+		method, url string
+		status      int
+	}{
+		{"GET", plain, http.StatusForbidden},
+		{"HEAD", plain, http.StatusForbidden},
+		{"GET", download, http.StatusOK},
+		{"HEAD", download, http.StatusOK},
+		{"GET", expired, http.StatusForbidden},
+		{"GET", peer.SignURL(plain), http.StatusOK},
+		{"GET", stranger.SignURL(plain), http.StatusForbidden},
+		{"GET", fs.URL() + strings.TrimPrefix(CatalogPath, "/"), http.StatusForbidden},
+		{"GET", fs.URL() + strings.TrimPrefix(FilesPath, "/"), http.StatusForbidden},
+		{"GET", peer.SignURL(fs.URL() + strings.TrimPrefix(FilesPath, "/") + "?match=movie"), http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		fs.ServeHTTP(w, httptest.NewRequest(c.method, c.url, nil))
+		if w.Code != c.status {
+			t.Errorf("%s %s: expected %d, got %d", c.method, c.url, c.status, w.Code)
+		}
+	}
+
+	// Peers with a verified client certificate need no signature.
+	req := httptest.NewRequest("GET", plain, nil)
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	w := httptest.NewRecorder()
+	fs.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Fatalf("Expected the file for a verified peer, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestCreateDownloadURLUnknownVolume(t *testing.T) {
+	fs := NewFileServer(FileServerConfig{Addr: "127.0.0.1", Port: 8080}, Volumes{newTestVolume("v", 1000)}, nil)
+	if _, err := fs.CreateDownloadURL(FileID{VolumeID: "gone", Path: "a"}, "peer", time.Now().Add(PullTimeout)); err == nil {
+		t.Fatal("Expected an error for an unknown volume")
+	}
+}
+
+func TestFileServerPeer(t *testing.T) {
+	vol := newTestVolume("v", 1000)
+	secret := []byte("0123456789abcdef")
+	fs := NewFileServer(FileServerConfig{Addr: "127.0.0.1", Port: 8080, Secret: secret}, Volumes{vol}, nil)
+	other := NewFileServer(FileServerConfig{Addr: "127.0.0.1", Port: 8081, Secret: secret}, Volumes{vol}, nil)
+	other.Name = "node2"
+
+	file := FileID{VolumeID: "v", Path: "movie.mkv"}
+	plain := fs.URL() + urlPath(file)
+	download, _ := fs.CreateDownloadURL(file, "pi1", time.Now().Add(PullTimeout))
+	overwrite, _ := fs.CreateOverwriteURL(file, "pi1", time.Now().Add(PullTimeout))
+	upload, _ := fs.CreateUploadURL(file, "pi1", time.Now().Add(PullTimeout))
+	for _, c := range []struct {
+		name string
+		url  string
+		peer PeerID
+	}{
+		{"plain", plain, ""},
+		{"download", download, "pi1"},
+		{"overwrite", overwrite, "pi1"},
+		{"upload", upload, "pi1"},
+		{"tampered", strings.Replace(download, "peer=pi1", "peer=pi2", 1), ""},
+		{"signed by a peer", other.SignURL(plain), "node2"},
+	} {
+		req := httptest.NewRequest("GET", c.url, nil)
+		// The header is chosen by the client and ignored.
+		req.Header.Set(PeerHeader, "pi3")
+		if peer := fs.peer(req); peer != c.peer {
+			t.Errorf("%s: expected %q, got %q", c.name, c.peer, peer)
+		}
+	}
+
+	req := httptest.NewRequest("GET", plain, nil)
+	cert := &x509.Certificate{}
+	cert.Subject.CommonName = "pi4"
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	if peer := fs.peer(req); peer != "pi4" {
+		t.Errorf("Expected the name of the certificate, got %q", peer)
+	}
+}
@@ -0,0 +1,327 @@
+package libsyncer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFile contains gitignore-style patterns for the files of its directory and all
+// subdirectories. Ignored files are never auctioned nor accepted.
+const IgnoreFile = ".mediasyncerignore"
+
+// DefaultExcludes are files created by operating systems and download tools, which should
+// not be synced.
+var DefaultExcludes = []string{".DS_Store", "Thumbs.db", "desktop.ini", "*.part", "*.crdownload", "*.!qB"}
+
+// IgnoreRules are the patterns of an IgnoreFile (or global excludes), relative to the
+// directory Base.
+type IgnoreRules struct {
+	Base     string
+	patterns []ignorePattern
+}
+
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// NewIgnoreRules compiles gitignore-style patterns: `*` and `?` match within a path segment,
+// `**` across segments, a leading `!` re-includes files, a trailing `/` only matches
+// directories and patterns containing a `/` are relative to base instead of matching
+// at any level. Empty patterns and comments starting with `#` are skipped.
+func NewIgnoreRules(base string, patterns []string) (*IgnoreRules, error) {
+	rules := &IgnoreRules{Base: base}
+	for _, p := range patterns {
+		p = strings.TrimRight(p, " \t\r")
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+
+		var pattern ignorePattern
+		if strings.HasPrefix(p, "!") {
+			pattern.negate = true
+			p = p[1:]
+		} else if strings.HasPrefix(p, `\`) {
+			p = p[1:]
+		}
+		if strings.HasSuffix(p, "/") {
+			pattern.dirOnly = true
+			p = strings.TrimRight(p, "/")
+		}
+		if p == "" {
+			continue
+		}
+
+		anchored := strings.Contains(p, "/")
+		p = strings.TrimPrefix(p, "/")
+		expr := globToRegexp(p)
+		if !anchored {
+			expr = "(.*/)?" + expr
+		}
+		re, err := regexp.Compile("^" + expr + "$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignore pattern %q: %v", p, err)
+		}
+		pattern.re = re
+		rules.patterns = append(rules.patterns, pattern)
+	}
+	return rules, nil
+}
+
+// ParseIgnoreRules reads the patterns of an IgnoreFile in the directory base.
+func ParseIgnoreRules(base string, r io.Reader) (*IgnoreRules, error) {
+	var patterns []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewIgnoreRules(base, patterns)
+}
+
+func globToRegexp(glob string) string {
+	var expr strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			expr.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				expr.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end
+		case c == '\\' && i+1 < len(glob):
+			i++
+			expr.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return expr.String()
+}
+
+// match reports whether any pattern matches p, a slash separated path, and if so whether
+// the last matching pattern ignores it.
+func (rules *IgnoreRules) match(p string, isDir bool) (matched, ignored bool) {
+	if rules.Base != "" {
+		if !strings.HasPrefix(p, rules.Base+"/") {
+			return false, false
+		}
+		p = strings.TrimPrefix(p, rules.Base+"/")
+	}
+	for _, pattern := range rules.patterns {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		if pattern.re.MatchString(p) {
+			matched, ignored = true, !pattern.negate
+		}
+	}
+	return matched, ignored
+}
+
+// ignored checks a file against the rules, which must be ordered from the least to the
+// most specific. A file inside an ignored directory is always ignored.
+func ignored(rules []*IgnoreRules, file string) bool {
+	segments := strings.Split(file, "/")
+	for i := range segments {
+		p := strings.Join(segments[:i+1], "/")
+		isDir := i < len(segments)-1
+
+		result := false
+		for _, r := range rules {
+			if matched, ignored := r.match(p, isDir); matched {
+				result = ignored
+			}
+		}
+		if result {
+			return true
+		}
+	}
+	return false
+}
+
+// IgnoreVolume applies the IgnoreFiles of a Volume and global excludes to any Volume
+// implementation: ignored files are skipped by Walk and can't be written.
+type IgnoreVolume struct {
+	Volume
+	excludes *IgnoreRules
+}
+
+// NewIgnoreVolume wraps vol, ignoring files matching the IgnoreFiles in vol and excludes.
+func NewIgnoreVolume(vol Volume, excludes []string) (*IgnoreVolume, error) {
+	rules, err := NewIgnoreRules("", append([]string{IgnoreFile}, excludes...))
+	if err != nil {
+		return nil, err
+	}
+	return &IgnoreVolume{vol, rules}, nil
+}
+
+// Ignored returns true if the file at p must not be synced.
+func (v *IgnoreVolume) Ignored(p string) bool {
+	p = filepath.ToSlash(filepath.Clean(strings.TrimPrefix(p, "/")))
+	return ignored(v.rules(path.Dir(p), nil), p)
+}
+
+// rules returns the global excludes followed by the IgnoreFiles of all directories from the
+// root of the volume down to dir. The rules of each directory are cached in cache, if given.
+func (v *IgnoreVolume) rules(dir string, cache map[string]*IgnoreRules) []*IgnoreRules {
+	rules := []*IgnoreRules{v.excludes}
+	dirs := []string{""}
+	if dir != "." {
+		segments := strings.Split(dir, "/")
+		for i := range segments {
+			dirs = append(dirs, strings.Join(segments[:i+1], "/"))
+		}
+	}
+
+	for _, d := range dirs {
+		r, ok := cache[d]
+		if !ok {
+			r = v.load(d)
+			if cache != nil {
+				cache[d] = r
+			}
+		}
+		if r != nil {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// load reads the IgnoreFile of dir, if it exists.
+func (v *IgnoreVolume) load(dir string) *IgnoreRules {
+	reader, err := v.Volume.Read(path.Join(dir, IgnoreFile))
+	if err != nil {
+		return nil
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	rules, err := ParseIgnoreRules(dir, reader)
+	if err != nil {
+		log.Println("ERROR: Invalid " + path.Join(dir, IgnoreFile) + ": " + err.Error())
+		return nil
+	}
+	return rules
+}
+
+// Walk walks all files of the volume, which are not ignored.
+func (v *IgnoreVolume) Walk(f filepath.WalkFunc) error {
+	cache := make(map[string]*IgnoreRules)
+	return v.Volume.Walk(func(p string, info os.FileInfo, err error) error {
+		slashed := filepath.ToSlash(p)
+		if ignored(v.rules(path.Dir(slashed), cache), slashed) {
+			return nil
+		}
+		return f(p, info, err)
+	})
+}
+
+// Write refuses to write ignored files.
+func (v *IgnoreVolume) Write(p string) (io.WriteCloser, error) {
+	if v.Ignored(p) {
+		return nil, fmt.Errorf("%s is ignored", p)
+	}
+	return v.Volume.Write(p)
+}
+
+// Rename refuses to rename files to an ignored path.
+func (v *IgnoreVolume) Rename(from, to string) error {
+	if v.Ignored(to) {
+		return fmt.Errorf("%s is ignored", to)
+	}
+	return RenameFile(v.Volume, from, to)
+}
+
+// Watch watches the wrapped volume, skipping ignored files. Changing an IgnoreFile
+// triggers a rescan.
+func (v *IgnoreVolume) Watch(stop <-chan struct{}, changed func(path string), rescan func()) error {
+	return Watch(v.Volume, stop, func(p string) {
+		if filepath.Base(p) == IgnoreFile {
+			rescan()
+		} else if !v.Ignored(p) {
+			changed(p)
+		}
+	}, rescan)
+}
+
+// Move moves the file to another volume, if the wrapped volume is a Mover.
+func (v *IgnoreVolume) Move(p string, to Volume) error {
+	mover, ok := v.Volume.(Mover)
+	if !ok {
+		return fmt.Errorf("volume %s can't move files", v.ID())
+	}
+	if target, ok := to.(*IgnoreVolume); ok {
+		if target.Ignored(p) {
+			return fmt.Errorf("%s is ignored", p)
+		}
+		to = target.Volume
+	}
+	return mover.Move(p, to)
+}
+
+// ReadMeta returns the metadata of a file of the wrapped volume.
+func (v *IgnoreVolume) ReadMeta(p string) (FileMeta, error) {
+	return ReadMeta(v.Volume, p)
+}
+
+// WriteMeta restores the metadata of a file, if the wrapped volume is a MetaVolume.
+func (v *IgnoreVolume) WriteMeta(p string, meta FileMeta) error {
+	return WriteMeta(v.Volume, p, meta)
+}
+
+// Trash moves a file into the trash of the wrapped volume or deletes it.
+func (v *IgnoreVolume) Trash(p string) error {
+	return TrashFile(v.Volume, p)
+}
+
+// TrashEntries returns the files in the trash of the wrapped volume.
+func (v *IgnoreVolume) TrashEntries() ([]TrashEntry, error) {
+	return ListTrash(v.Volume)
+}
+
+// Restore moves a file out of the trash of the wrapped volume.
+func (v *IgnoreVolume) Restore(id string) (string, error) {
+	return RestoreFile(v.Volume, id)
+}
+
+// Purge purges the trash of the wrapped volume.
+func (v *IgnoreVolume) Purge(need ByteSize) error {
+	return MakeRoom(v.Volume, need)
+}
+
+// Ignored returns true if vol ignores the file at path.
+func Ignored(vol Volume, path string) bool {
+	if v, ok := vol.(interface{ Ignored(string) bool }); ok {
+		return v.Ignored(path)
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package libsyncer
+
+import (
+	"os"
+	"testing"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	rules, err := NewIgnoreRules("", []string{"# comment", "*.part", "/state/", "tmp/", "**/cache/**", "!keep.part", "Thumbs.db", "a?c.[ot]xt"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := map[string]bool{
+		"movie.mkv":          false,
+		"movie.mkv.part":     true,
+		"dir/movie.mkv.part": true,
+		"keep.part":          false,
+		"state/app.db":       true,
+		"dir/state/app.db":   false,
+		"dir/tmp/file":       true,
+		"tmp":                false,
+		"x/cache/y/z":        true,
+		"dir/Thumbs.db":      true,
+		"abc.txt":            true,
+		"abc.ext":            false,
+	}
+	for path, expected := range tests {
+		if got := ignored([]*IgnoreRules{rules}, path); got != expected {
+			t.Errorf("%s: expected ignored=%v, got %v", path, expected, got)
+		}
+	}
+}
+
+func TestIgnoreVolume(t *testing.T) {
+	vol := newTestVolume("v", 1000)
+	vol.files[IgnoreFile] = []byte("*.nfo\n")
+	vol.files["shows/"+IgnoreFile] = []byte("!important.nfo\nextras/\n")
+	vol.files["movie.mkv"] = []byte("m")
+	vol.files["movie.nfo"] = []byte("n")
+	vol.files[".DS_Store"] = []byte("x")
+	vol.files["shows/important.nfo"] = []byte("i")
+	vol.files["shows/other.nfo"] = []byte("o")
+	vol.files["shows/extras/bonus.mkv"] = []byte("b")
+
+	v, err := NewIgnoreVolume(vol, DefaultExcludes)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var walked []string
+	v.Walk(func(path string, info os.FileInfo, err error) error {
+		walked = append(walked, path)
+		return nil
+	})
+	if len(walked) != 2 || walked[0] != "movie.mkv" || walked[1] != "shows/important.nfo" {
+		t.Fatalf("Unexpected files %v", walked)
+	}
+
+	if !Ignored(v, "/shows/extras/new.mkv") {
+		t.Errorf("Expected new file in ignored directory to be ignored")
+	}
+	if _, err := v.Write("new.nfo"); err == nil {
+		t.Errorf("Expected writing an ignored file to fail")
+	}
+	if _, err := v.Write("new.mkv"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
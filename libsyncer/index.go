@@ -0,0 +1,534 @@
+package libsyncer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	indexBucket = []byte("files")
+
+	// hashBucket maps the hashes of the files to their paths. The keys are the hash, a
+	// zero byte and the path.
+	hashBucket = []byte("hashes")
+)
+
+// IndexEntry describes an indexed file.
+type IndexEntry struct {
+	Path    string    `json:"path"`
+	Size    ByteSize  `json:"size"`
+	ModTime time.Time `json:"mtime"`
+
+	// Hash is the hex encoded SHA-256 of the file. It is empty until the content of the file
+	// was hashed, e.g. when transferring it.
+	Hash string `json:"hash,omitempty"`
+
+	// Verified is when the content of the file was hashed last.
+	Verified time.Time `json:"verified,omitempty"`
+}
+
+// IndexedVolume keeps the files of a Volume in a persistent index, so walking the volume
+// does not touch the disk. The index is updated by writes and deletes through the
+// IndexedVolume, by watching the volume with Watch and by rescanning it with Rescan.
+type IndexedVolume struct {
+	Volume
+	db *bolt.DB
+
+	// lastWrite contains the files written recently, observed while watching the volume.
+	// Writes through the IndexedVolume itself, i.e. transfers, are tracked in own instead:
+	// a zero time while the file is written, afterwards when its metadata was restored.
+	mu        sync.Mutex
+	lastWrite map[string]time.Time
+	own       map[string]time.Time
+}
+
+// watchFlushInterval is how often changes observed while watching are written to the index.
+const watchFlushInterval = 2 * time.Second
+
+// OpenIndex opens (or creates) the index of vol stored at path.
+func OpenIndex(path string, vol Volume) (*IndexedVolume, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		files, err := tx.CreateBucketIfNotExists(indexBucket)
+		if err != nil {
+			return err
+		}
+		if tx.Bucket(hashBucket) != nil {
+			return nil
+		}
+		// Indexes created before hashBucket existed.
+		hashes, err := tx.CreateBucket(hashBucket)
+		if err != nil {
+			return err
+		}
+		return files.ForEach(func(k, data []byte) error {
+			var entry IndexEntry
+			if json.Unmarshal(data, &entry) != nil || entry.Hash == "" {
+				return nil
+			}
+			return hashes.Put(hashKey(entry.Hash, entry.Path), nil)
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &IndexedVolume{Volume: vol, db: db, lastWrite: make(map[string]time.Time), own: make(map[string]time.Time)}, nil
+}
+
+// Close closes the index.
+func (v *IndexedVolume) Close() error {
+	return v.db.Close()
+}
+
+// Lookup returns the index entry of path.
+func (v *IndexedVolume) Lookup(path string) (IndexEntry, bool) {
+	var entry IndexEntry
+	found := false
+	v.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(indexBucket).Get([]byte(path))
+		if data != nil {
+			found = json.Unmarshal(data, &entry) == nil
+		}
+		return nil
+	})
+	return entry, found
+}
+
+// Entries calls f for each indexed file, ordered by path.
+func (v *IndexedVolume) Entries(f func(entry IndexEntry) error) error {
+	var entries []IndexEntry
+	err := v.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(indexBucket).ForEach(func(k, data []byte) error {
+			var entry IndexEntry
+			if err := json.Unmarshal(data, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// f may modify the index, so it is called outside of the transaction.
+	for _, entry := range entries {
+		if err := f(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindHash returns the indexed files with the given hash.
+func (v *IndexedVolume) FindHash(hash string) []IndexEntry {
+	var entries []IndexEntry
+	prefix := hashKey(hash, "")
+	v.db.View(func(tx *bolt.Tx) error {
+		files := tx.Bucket(indexBucket)
+		c := tx.Bucket(hashBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			var entry IndexEntry
+			if data := files.Get(k[len(prefix):]); data != nil && json.Unmarshal(data, &entry) == nil {
+				entries = append(entries, entry)
+			}
+		}
+		return nil
+	})
+	return entries
+}
+
+func hashKey(hash, path string) []byte {
+	return []byte(hash + "\x00" + path)
+}
+
+func (v *IndexedVolume) put(entries ...IndexEntry) error {
+	return v.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(indexBucket)
+		for _, entry := range entries {
+			if err := unhash(tx, entry.Path); err != nil {
+				return err
+			}
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(entry.Path), data); err != nil {
+				return err
+			}
+			if entry.Hash != "" {
+				if err := tx.Bucket(hashBucket).Put(hashKey(entry.Hash, entry.Path), nil); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// unhash removes the hash of the indexed file at path from the hashBucket.
+func unhash(tx *bolt.Tx, path string) error {
+	var old IndexEntry
+	data := tx.Bucket(indexBucket).Get([]byte(path))
+	if data == nil || json.Unmarshal(data, &old) != nil || old.Hash == "" {
+		return nil
+	}
+	return tx.Bucket(hashBucket).Delete(hashKey(old.Hash, old.Path))
+}
+
+func (v *IndexedVolume) remove(paths ...string) error {
+	return v.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(indexBucket)
+		for _, path := range paths {
+			if err := unhash(tx, path); err != nil {
+				return err
+			}
+			if err := b.Delete([]byte(path)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// removeDir removes all entries below the directory dir.
+func (v *IndexedVolume) removeDir(dir string) error {
+	prefix := []byte(dir + "/")
+	return v.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(indexBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			if err := unhash(tx, string(k)); err != nil {
+				return err
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Refresh updates the index entry of path from the volume. The hash is kept if the size
+// and the modification time did not change. If path was a directory, all its files are removed.
+func (v *IndexedVolume) Refresh(path string) error {
+	info, err := v.Volume.Stat(path)
+	if os.IsNotExist(err) {
+		if err := v.remove(path); err != nil {
+			return err
+		}
+		return v.removeDir(path)
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+	entry := IndexEntry{Path: path, Size: ByteSize(info.Size()), ModTime: info.ModTime()}
+	if old, ok := v.Lookup(path); ok && old.Size == entry.Size && old.ModTime.Equal(entry.ModTime) {
+		return nil
+	}
+	return v.put(entry)
+}
+
+// SetHash stores the hash of an indexed file, which was just computed from its content.
+func (v *IndexedVolume) SetHash(path, hash string) error {
+	entry, ok := v.Lookup(path)
+	if !ok {
+		return os.ErrNotExist
+	}
+	entry.Hash = hash
+	entry.Verified = time.Now()
+	return v.put(entry)
+}
+
+// Rescan walks the volume and brings the index up to date: new and changed files are
+// added, deleted files are removed.
+func (v *IndexedVolume) Rescan() error {
+	start := time.Now()
+	seen := make(map[string]struct{})
+	var changed []IndexEntry
+	err := v.Volume.Walk(func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		seen[path] = struct{}{}
+		entry := IndexEntry{Path: path, Size: ByteSize(info.Size()), ModTime: info.ModTime()}
+		if old, ok := v.Lookup(path); ok && old.Size == entry.Size && old.ModTime.Equal(entry.ModTime) {
+			return nil
+		}
+		changed = append(changed, entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var removed []string
+	v.Entries(func(entry IndexEntry) error {
+		if _, ok := seen[entry.Path]; !ok {
+			removed = append(removed, entry.Path)
+		}
+		return nil
+	})
+
+	if err := v.put(changed...); err != nil {
+		return err
+	}
+	if err := v.remove(removed...); err != nil {
+		return err
+	}
+	log.Printf("Indexed volume %s in %v: %d files, %d changed, %d removed\n", v.ID(), time.Since(start), len(seen), len(changed), len(removed))
+	return nil
+}
+
+// Watch updates the index with the changes of the wrapped volume until stop is closed.
+// The changes are collected and written every few seconds.
+func (v *IndexedVolume) Watch(stop <-chan struct{}) error {
+	var pendingMu sync.Mutex
+	pending := make(map[string]struct{})
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(watchFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+
+			pendingMu.Lock()
+			paths := pending
+			pending = make(map[string]struct{})
+			pendingMu.Unlock()
+			for path := range paths {
+				if err := v.Refresh(path); err != nil {
+					log.Println("ERROR: Failed to index " + path + ": " + err.Error())
+				}
+			}
+			v.forgetWrites()
+		}
+	}()
+
+	return Watch(v.Volume, stop, func(path string) {
+		v.mu.Lock()
+		if t, ok := v.own[path]; !ok || !t.IsZero() && time.Since(t) > watchFlushInterval {
+			v.lastWrite[path] = time.Now()
+		}
+		v.mu.Unlock()
+
+		pendingMu.Lock()
+		pending[path] = struct{}{}
+		pendingMu.Unlock()
+	}, func() {
+		if err := v.Rescan(); err != nil {
+			log.Println("ERROR: Failed to rescan volume " + v.ID() + ": " + err.Error())
+		}
+	})
+}
+
+// LastWrite returns when a write to path was observed last while watching the volume.
+func (v *IndexedVolume) LastWrite(path string) time.Time {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.lastWrite[path]
+}
+
+// forgetWrites drops the writes observed long enough ago to consider the files settled.
+func (v *IndexedVolume) forgetWrites() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for path, t := range v.lastWrite {
+		if time.Since(t) > 24*time.Hour {
+			delete(v.lastWrite, path)
+		}
+	}
+	for path, t := range v.own {
+		if !t.IsZero() && time.Since(t) > watchFlushInterval {
+			delete(v.own, path)
+		}
+	}
+}
+
+// settled marks a file written through the IndexedVolume as complete. The events of
+// the write, which may still arrive while watching, are not counted as a write.
+func (v *IndexedVolume) settled(path string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.own[path] = time.Now()
+	delete(v.lastWrite, path)
+}
+
+// Walk calls f for each indexed file, without touching the volume.
+func (v *IndexedVolume) Walk(f filepath.WalkFunc) error {
+	return v.Entries(func(entry IndexEntry) error {
+		return f(entry.Path, indexFileInfo{entry}, nil)
+	})
+}
+
+// Stat answers from the index and only falls back to the volume for unknown files.
+func (v *IndexedVolume) Stat(path string) (os.FileInfo, error) {
+	if entry, ok := v.Lookup(path); ok {
+		return indexFileInfo{entry}, nil
+	}
+	return v.Volume.Stat(path)
+}
+
+// Write writes a file and indexes it once the writer is closed.
+func (v *IndexedVolume) Write(path string) (io.WriteCloser, error) {
+	w, err := v.Volume.Write(path)
+	if err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	v.own[path] = time.Time{}
+	v.mu.Unlock()
+	return &indexWriter{w, v, path}, nil
+}
+
+// Rename renames a file of the wrapped volume and moves its index entry. The renamed
+// file counts as written through the IndexedVolume.
+func (v *IndexedVolume) Rename(from, to string) error {
+	v.mu.Lock()
+	v.own[to] = time.Time{}
+	v.mu.Unlock()
+	err := RenameFile(v.Volume, from, to)
+	v.settled(to)
+	if err != nil {
+		return err
+	}
+	if err := v.remove(from); err != nil {
+		return err
+	}
+	return v.Refresh(to)
+}
+
+// ReadMeta returns the metadata of a file of the wrapped volume.
+func (v *IndexedVolume) ReadMeta(path string) (FileMeta, error) {
+	return ReadMeta(v.Volume, path)
+}
+
+// WriteMeta restores the metadata of a file and updates its index entry. A file written
+// through the IndexedVolume counts as written at the restored ModTime afterwards.
+func (v *IndexedVolume) WriteMeta(path string, meta FileMeta) error {
+	err := WriteMeta(v.Volume, path, meta)
+	v.settled(path)
+	if refreshErr := v.Refresh(path); err == nil {
+		err = refreshErr
+	}
+	return err
+}
+
+// Delete deletes a file and removes it from the index.
+func (v *IndexedVolume) Delete(path string) error {
+	if err := v.Volume.Delete(path); err != nil {
+		return err
+	}
+	return v.remove(path)
+}
+
+// Trash moves a file into the trash of the wrapped volume, or deletes it, and removes it
+// from the index.
+func (v *IndexedVolume) Trash(path string) error {
+	if err := TrashFile(v.Volume, path); err != nil {
+		return err
+	}
+	return v.remove(path)
+}
+
+// TrashEntries returns the files in the trash of the wrapped volume.
+func (v *IndexedVolume) TrashEntries() ([]TrashEntry, error) {
+	return ListTrash(v.Volume)
+}
+
+// Restore moves a file out of the trash of the wrapped volume and indexes it again.
+func (v *IndexedVolume) Restore(id string) (string, error) {
+	path, err := RestoreFile(v.Volume, id)
+	if err != nil {
+		return "", err
+	}
+	return path, v.Refresh(path)
+}
+
+// Purge purges the trash of the wrapped volume.
+func (v *IndexedVolume) Purge(need ByteSize) error {
+	return MakeRoom(v.Volume, need)
+}
+
+// Move moves the file to another volume, if the wrapped volume is a Mover.
+func (v *IndexedVolume) Move(path string, to Volume) error {
+	mover, ok := v.Volume.(Mover)
+	if !ok {
+		return os.ErrInvalid
+	}
+	target, indexed := to.(*IndexedVolume)
+	if indexed {
+		to = target.Volume
+	}
+	if err := mover.Move(path, to); err != nil {
+		return err
+	}
+	if indexed {
+		target.Refresh(path)
+	}
+	return v.remove(path)
+}
+
+// Ignored returns true if the wrapped volume ignores path.
+func (v *IndexedVolume) Ignored(path string) bool {
+	return Ignored(v.Volume, path)
+}
+
+// storeHash remembers the hash of a file, if vol is indexed.
+func storeHash(vol Volume, path, hash string) {
+	if v, ok := vol.(*IndexedVolume); ok {
+		if err := v.SetHash(path, hash); err != nil {
+			log.Println("ERROR: Failed to store hash of " + path + ": " + err.Error())
+		}
+	}
+}
+
+type indexWriter struct {
+	io.WriteCloser
+	v    *IndexedVolume
+	path string
+}
+
+func (w *indexWriter) Close() error {
+	err := w.WriteCloser.Close()
+	w.v.settled(w.path)
+	if refreshErr := w.v.Refresh(w.path); err == nil {
+		err = refreshErr
+	}
+	return err
+}
+
+// indexFileInfo implements os.FileInfo for an IndexEntry.
+type indexFileInfo struct {
+	entry IndexEntry
+}
+
+func (fi indexFileInfo) Name() string       { return filepath.Base(fi.entry.Path) }
+func (fi indexFileInfo) Size() int64        { return int64(fi.entry.Size) }
+func (fi indexFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi indexFileInfo) ModTime() time.Time { return fi.entry.ModTime }
+func (fi indexFileInfo) IsDir() bool        { return false }
+func (fi indexFileInfo) Sys() interface{}   { return fi.entry }
@@ -0,0 +1,82 @@
+package libsyncer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIndexedVolume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mediasyncer-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	vol := newTestVolume("v", 1000)
+	vol.files["a"] = []byte("aaa")
+	vol.files["b/c"] = []byte("cc")
+
+	v, err := OpenIndex(filepath.Join(dir, "v.db"), vol)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := v.Rescan(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Changes outside of the IndexedVolume are only seen after a rescan.
+	delete(vol.files, "a")
+	if _, ok := v.Lookup("a"); !ok {
+		t.Fatalf("Expected a to be indexed")
+	}
+	w, _ := v.Write("d")
+	w.Write([]byte("dddd"))
+	w.Close()
+	if err := v.SetHash("d", "1234"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if entries := v.FindHash("1234"); len(entries) != 1 || entries[0].Path != "d" {
+		t.Fatalf("Unexpected entries for hash: %+v", entries)
+	}
+
+	var paths []string
+	v.Walk(func(path string, info os.FileInfo, err error) error {
+		paths = append(paths, path)
+		return nil
+	})
+	if len(paths) != 3 || paths[0] != "a" || paths[1] != "b/c" || paths[2] != "d" {
+		t.Fatalf("Unexpected files %v", paths)
+	}
+
+	if err := v.Rescan(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := v.Lookup("a"); ok {
+		t.Fatalf("Expected a to be removed by the rescan")
+	}
+	if entry, _ := v.Lookup("d"); entry.Size != 4 || entry.Hash != "1234" {
+		t.Fatalf("Unexpected entry %+v", entry)
+	}
+
+	// The index survives a restart.
+	v.Close()
+	v, err = OpenIndex(filepath.Join(dir, "v.db"), vol)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer v.Close()
+	if err := v.Delete("d"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := v.Lookup("b/c"); !ok {
+		t.Fatalf("Expected b/c to be indexed")
+	}
+	if _, ok := v.Lookup("d"); ok {
+		t.Fatalf("Expected d to be removed")
+	}
+	if entries := v.FindHash("1234"); len(entries) != 0 {
+		t.Fatalf("Expected hash of d to be removed, got %+v", entries)
+	}
+}
@@ -1,53 +1,463 @@
 package libsyncer
 
 import (
+	"log"
+	"path/filepath"
 	"sync"
+	"time"
 )
 
 type Config struct {
 	Transport        Transport
 	PriceFormula     PriceFormula
-	Volume           Volume
 	FileServerConfig FileServerConfig
+	ThrottleConfig   ThrottleConfig
+
+	// Volume is used with PriceFormula, if no Volumes are configured.
+	Volume Volume
+
+	// Volumes are the volumes of this node, each with its own pricing and watermarks.
+	Volumes []VolumeConfig
+
+	// IndexDir is the directory the indexes of the volumes are stored in. Empty disables
+	// the indexes, walking the volumes for every auction instead.
+	IndexDir string
+
+	// RescanInterval is how often the indexed volumes are rescanned. Defaults to 6h.
+	RescanInterval time.Duration
+
+	// Scrub configures the verification of the files of the indexed volumes. Scrubbing is
+	// disabled if its Interval is 0.
+	Scrub ScrubConfig
+
+	// Dedup configures the detection of duplicate files in the cluster. It is disabled if
+	// its Interval is 0.
+	Dedup DedupConfig
+
+	// PinsFile is the file the pinned files are persisted in. Empty keeps the pins in memory.
+	PinsFile string
+
+	// Excludes are gitignore-style patterns of files never to sync, in addition to the
+	// IgnoreFiles in the volumes.
+	Excludes []string
+
+	// Pull lets the bidder download won files from the seller, instead of the
+	// seller uploading them.
+	Pull bool
+
+	// Conflict decides how the bidder bids on files existing locally. Defaults to ConflictSkip.
+	Conflict ConflictPolicy
+
+	// AdminAddr is the address the AdminServer listens on. Empty disables the AdminServer.
+	AdminAddr string
+
+	// AdminToken must be sent as bearer token to the AdminServer. Empty disables the
+	// authentication.
+	AdminToken string
+
+	// PeerLabels are passed to the PriceFormula for the selling peer.
+	PeerLabels PeerLabels
+
+	// Labels describe the local node and are advertised to the other peers.
+	Labels []string
+
+	// MetaInterval is how often the NodeMeta of the local node is refreshed. Defaults to 30s.
+	MetaInterval time.Duration
+
+	// Schedule defines when auctions and bids are allowed. nil allows them at any time.
+	Schedule *Schedule
+
+	// Clock is used for the PriceContext and the Schedule. Defaults to time.Now.
+	Clock Clock
 }
 type Syncer struct {
+	// Config is guarded by mu, since Reload changes it.
 	Config
+	mu      sync.Mutex
 	running sync.WaitGroup
+	stop    chan struct{}
 
 	FileServer *FileServer
 	Bidder     *Bidder
-	Auctioneer *Auctioneer
+	Throttle   *Throttle
+	Admin      *AdminServer
+
+	// Auctioneers auction the files of each volume.
+	Auctioneers  []*Auctioneer
+	Rebalancer   *Rebalancer
+	Scrubber     *Scrubber
+	Deduplicator *Deduplicator
+	Pins         *Pins
+
+	pricing map[string]*Pricing
 }
 
 func New(cfg Config) *Syncer {
 	proto := NetworkProtocol{cfg.Transport}
+	name := PeerID(cfg.Transport.Name())
+
+	if cfg.Clock == nil {
+		cfg.Clock = time.Now
+	}
+	if cfg.Schedule == nil {
+		// The Schedule is shared, so Reload can change it.
+		cfg.Schedule = &Schedule{}
+	}
+	if len(cfg.Volumes) == 0 {
+		cfg.Volumes = []VolumeConfig{{Volume: cfg.Volume}}
+	}
+	var volumes Volumes
+	pricing := make(map[string]*Pricing)
+	for i, vol := range cfg.Volumes {
+		ignoring, err := NewIgnoreVolume(vol.Volume, cfg.Excludes)
+		if err != nil {
+			panic("Invalid excludes: " + err.Error())
+		}
+		vol.Volume = ignoring
+		if cfg.IndexDir != "" {
+			indexed, err := OpenIndex(filepath.Join(cfg.IndexDir, ignoring.ID()+".db"), ignoring)
+			if err != nil {
+				panic("Failed to open index: " + err.Error())
+			}
+			vol.Volume = indexed
+		}
+		cfg.Volumes[i].Volume = vol.Volume
+		if vol.PriceFormula == nil {
+			cfg.Volumes[i].PriceFormula = cfg.PriceFormula
+		}
+		volumes = append(volumes, vol.Volume)
+		pricing[vol.Volume.ID()] = &Pricing{
+			Formula: cfg.Volumes[i].PriceFormula,
+			Volume:  vol.Volume,
+			Labels:  cfg.PeerLabels,
+			Clock:   cfg.Clock,
+
+			Transport: cfg.Transport,
+		}
+	}
+
+	pins, err := LoadPins(cfg.PinsFile)
+	if err != nil {
+		panic("Failed to load pins: " + err.Error())
+	}
+
+	throttle := NewThrottle(cfg.ThrottleConfig)
+	throttle.Schedule = cfg.Schedule
+	throttle.Clock = cfg.Clock
+	proto.OnPeerEvent(func(event PeerEvent, peer string, meta NodeMeta) {
+		if event == PeerLeft {
+			throttle.RemovePeer(PeerID(peer))
+		}
+	})
+
+	clients, err := NewPeerClients(cfg.FileServerConfig.TLS)
+	if err != nil {
+		panic("Failed to load TLS config: " + err.Error())
+	}
+
+	fs := NewFileServer(cfg.FileServerConfig, volumes, throttle)
+	fs.Pins = pins
+	fs.Name = PeerID(cfg.Transport.Name())
+	uploader := &Uploader{
+		Volumes:  volumes,
+		Throttle: throttle,
+		Clients:  clients,
+		Retry:    DefaultRetryPolicy,
+		Name:     name,
+	}
+	var auctioneers []*Auctioneer
+	for _, vol := range cfg.Volumes {
+		auctioneer := NewAuctioneer(proto, pricing[vol.Volume.ID()], vol.Volume, uploader, fs)
+		auctioneer.Schedule = cfg.Schedule
+		auctioneer.Clock = cfg.Clock
+		auctioneers = append(auctioneers, auctioneer)
+	}
+	downloader := &Downloader{
+		Volumes:  volumes,
+		Throttle: throttle,
+		Clients:  clients,
+		Name:     name,
+	}
+	var bidderDownloader *Downloader
+	if cfg.Pull {
+		bidderDownloader = downloader
+	}
+	bidder := NewBidder(proto, cfg.Volumes, pricing, fs, cfg.Schedule, bidderDownloader)
+	bidder.Conflict = cfg.Conflict
+
+	draining := func(volume string) bool {
+		for _, a := range auctioneers {
+			if a.Volume.ID() == volume {
+				return a.Draining()
+			}
+		}
+		return false
+	}
+	bidder.Draining = draining
 
-	fs := NewFileServer(cfg.FileServerConfig, cfg.Volume)
+	uploading := func(file FileID) bool {
+		for _, a := range auctioneers {
+			if a.Busy(file) {
+				return true
+			}
+		}
+		return false
+	}
+	scrubber := NewScrubber(proto, cfg.Scrub, volumes, fs, downloader)
+	scrubber.Busy = uploading
+	for _, a := range auctioneers {
+		a.Skip = func(file FileID) bool {
+			return scrubber.Corrupt(file) || pins.Pinned(file)
+		}
+	}
 
-	uploader := &Uploader{cfg.Volume}
-	auctioneer := NewAuctioneer(proto, cfg.PriceFormula, cfg.Volume, uploader)
-	bidder := NewBidder(proto, cfg.Volume, cfg.PriceFormula, fs)
+	deduplicator := NewDeduplicator(name, cfg.Dedup, volumes, cfg.Transport, clients)
+	deduplicator.FileServer = fs
+	deduplicator.Busy = func(file FileID) bool {
+		return uploading(file) || scrubber.Corrupt(file) || pins.Pinned(file)
+	}
+
+	rebalancer := NewRebalancer(name, cfg.Volumes, pricing)
+	rebalancer.Busy = func(file FileID) bool {
+		return uploading(file) || scrubber.Corrupt(file) || pins.Pinned(file)
+	}
+	rebalancer.Draining = draining
+
+	var admin *AdminServer
+	if cfg.AdminAddr != "" {
+		admin = NewAdminServer(cfg.AdminAddr, throttle, cfg.Transport)
+		admin.Token = cfg.AdminToken
+		admin.Scrubber = scrubber
+		admin.Deduplicator = deduplicator
+		admin.Auctioneers = auctioneers
+		admin.Bidder = bidder
+		admin.Volumes = volumes
+		admin.Pins = pins
+		admin.Clients = clients
+		admin.FileServer = fs
+	}
 
-	return &Syncer{
+	if cfg.MetaInterval == 0 {
+		cfg.MetaInterval = 30 * time.Second
+	}
+	if cfg.RescanInterval == 0 {
+		cfg.RescanInterval = 6 * time.Hour
+	}
+
+	s := &Syncer{
 		Config: cfg,
+		stop:   make(chan struct{}),
 
-		Auctioneer: auctioneer,
-		FileServer: fs,
-		Bidder:     bidder,
+		Auctioneers:  auctioneers,
+		Rebalancer:   rebalancer,
+		Scrubber:     scrubber,
+		Deduplicator: deduplicator,
+		Pins:         pins,
+		FileServer:   fs,
+		Bidder:       bidder,
+		Throttle:     throttle,
+		Admin:        admin,
+
+		pricing: pricing,
+	}
+	if admin != nil {
+		admin.Config = s.ConfigStatus
+	}
+	return s
+}
+
+// Reload applies the settings of cfg, which can be changed without a restart: the price
+// formulas, peer labels, watermarks, schedule, bandwidth limits, conflict policy and scrub
+// rate. The volumes of cfg are matched with the running volumes by ID. All other settings,
+// including added or removed volumes, require a restart.
+func (s *Syncer) Reload(cfg Config) {
+	configured := make(map[string]VolumeConfig)
+	for _, vol := range cfg.Volumes {
+		configured[vol.Volume.ID()] = vol
+	}
+	vols := make([]VolumeConfig, len(s.Volumes))
+	for i, running := range s.Volumes {
+		id := running.Volume.ID()
+		vol, ok := configured[id]
+		if !ok {
+			log.Println("Volume " + id + " was removed from the config, restart to apply.")
+			vols[i] = running
+			continue
+		}
+		delete(configured, id)
+
+		// Options of the volume itself, like the trash, apply after a restart.
+		vol.Volume = running.Volume
+		if vol.PriceFormula == nil {
+			vol.PriceFormula = cfg.PriceFormula
+		}
+		vols[i] = vol
+		s.pricing[id].Reload(vol.PriceFormula, cfg.PeerLabels)
+	}
+	for id := range configured {
+		log.Println("Volume " + id + " was added to the config, restart to apply.")
 	}
+
+	s.mu.Lock()
+	s.Volumes = vols
+	s.PriceFormula = cfg.PriceFormula
+	s.PeerLabels = cfg.PeerLabels
+	s.Conflict = cfg.Conflict
+	s.ThrottleConfig = cfg.ThrottleConfig
+	s.Scrub.Rate = cfg.Scrub.Rate
+	s.mu.Unlock()
+
+	s.Bidder.Reload(vols, cfg.Conflict)
+	s.Rebalancer.Reload(vols)
+	s.Schedule.Reload(cfg.Schedule)
+	s.Throttle.Reload(cfg.ThrottleConfig)
+	s.Scrubber.bucket.SetRate(cfg.Scrub.Rate)
+	log.Println("Reloaded the config.")
 }
 
 func (s *Syncer) Serve() {
 	go s.FileServer.Serve()
-	go s.Auctioneer.Serve()
+	for _, a := range s.Auctioneers {
+		go a.Serve()
+	}
+	go s.Rebalancer.Serve()
+	go s.Deduplicator.Serve()
 	go s.Bidder.Serve()
+	if s.Admin != nil {
+		go s.Admin.Serve()
+	}
+
+	s.running.Add(4)
+	go s.advertise()
+	go s.rescan()
+	go s.purgeTrash()
+	go s.scrub()
+}
 
+// scrub runs the Scrubber until the Syncer is stopped, so the indexes are only closed
+// after it stopped using them.
+func (s *Syncer) scrub() {
+	defer s.running.Done()
+	s.Scrubber.Serve()
+}
+
+// trashPurgeInterval is how often files exceeding the retention period or the size of
+// the trash are purged.
+const trashPurgeInterval = 1 * time.Hour
+
+// purgeTrash purges the trash of the volumes every trashPurgeInterval, until the Syncer
+// is stopped.
+func (s *Syncer) purgeTrash() {
+	defer s.running.Done()
+
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for {
+		for _, vol := range s.FileServer.Volumes {
+			if err := MakeRoom(vol, 0); err != nil {
+				log.Println("ERROR: Failed to purge the trash of volume " + vol.ID() + ": " + err.Error())
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// rescan updates the indexes of the volumes after starting and every RescanInterval.
+// After the first rescan, the volumes are watched for changes, if they support it.
+func (s *Syncer) rescan() {
+	defer s.running.Done()
+
+	ticker := time.NewTicker(s.RescanInterval)
+	defer ticker.Stop()
+	watching := false
+	for {
+		for _, vol := range s.FileServer.Volumes {
+			if indexed, ok := vol.(*IndexedVolume); ok {
+				if err := indexed.Rescan(); err != nil {
+					log.Println("ERROR: Failed to rescan volume " + vol.ID() + ": " + err.Error())
+				}
+				if !watching {
+					s.running.Add(1)
+					go s.watch(indexed)
+				}
+			}
+		}
+		watching = true
+
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Meta returns the metadata of the local node.
+func (s *Syncer) Meta() NodeMeta {
+	meta := NodeMeta{
+		URL:     s.FileServer.URL(),
+		Volumes: s.FileServer.Volumes.IDs(),
+		Labels:  s.Labels,
+		Version: ProtocolVersion,
+	}
+	for _, vol := range s.FileServer.Volumes {
+		meta.Capacity += ByteSize(vol.Capacity())
+		meta.Free += ByteSize(vol.AvailableBytes())
+	}
+	return meta
+}
+
+// advertise publishes the metadata of the local node every MetaInterval, until the
+// Syncer is stopped.
+func (s *Syncer) advertise() {
+	defer s.running.Done()
+
+	ticker := time.NewTicker(s.MetaInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.Transport.SetMeta(s.Meta()); err != nil {
+			log.Println("Failed to advertise node metadata: " + err.Error())
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// watch keeps the index of vol up to date until the Syncer is stopped.
+func (s *Syncer) watch(vol *IndexedVolume) {
+	defer s.running.Done()
+	if err := vol.Watch(s.stop); err != nil {
+		log.Println("Not watching volume " + vol.ID() + ": " + err.Error())
+	}
 }
 
 func (s *Syncer) Stop() {
-	s.Auctioneer.Stop()
+	close(s.stop)
+	for _, a := range s.Auctioneers {
+		a.Stop()
+	}
+	s.Rebalancer.Stop()
+	s.Scrubber.Stop()
+	s.Deduplicator.Stop()
 	s.Bidder.Stop()
 	s.FileServer.Close()
+	if s.Admin != nil {
+		s.Admin.Close()
+	}
 
 	s.running.Wait()
+	for _, vol := range s.FileServer.Volumes {
+		if indexed, ok := vol.(*IndexedVolume); ok {
+			indexed.Close()
+		}
+	}
 }
@@ -0,0 +1,117 @@
+package libsyncer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ModTimeHeader is the HTTP header carrying the modification time of a transferred file.
+	ModTimeHeader = "X-Mediasyncer-Mtime"
+
+	// ModeHeader is the HTTP header carrying the octal permissions of a transferred file.
+	ModeHeader = "X-Mediasyncer-Mode"
+
+	// XattrHeader is the HTTP header carrying an extended attribute of a transferred file as
+	// name=value, with the value base64 encoded. It is repeated for each attribute.
+	XattrHeader = "X-Mediasyncer-Xattr"
+)
+
+// maxXattrSize limits the size of an extended attribute sent along with a file, as the
+// attributes are transferred as HTTP headers.
+const maxXattrSize = 4 * 1024
+
+// FileMeta is the metadata of a file, which is preserved when transferring the file.
+type FileMeta struct {
+	ModTime time.Time
+	Mode    os.FileMode
+
+	// Xattrs are the extended attributes of the file, if the volume supports them.
+	Xattrs map[string][]byte
+}
+
+// MetaVolume is implemented by volumes which can restore the metadata of their files.
+type MetaVolume interface {
+	ReadMeta(path string) (FileMeta, error)
+
+	// WriteMeta restores the metadata of a file. Zero fields are left untouched.
+	WriteMeta(path string, meta FileMeta) error
+}
+
+// ReadMeta returns the metadata of the file at path. For volumes other than a MetaVolume
+// only the modification time and the permissions are returned.
+func ReadMeta(vol Volume, path string) (FileMeta, error) {
+	if v, ok := vol.(MetaVolume); ok {
+		return v.ReadMeta(path)
+	}
+	info, err := vol.Stat(path)
+	if err != nil {
+		return FileMeta{}, err
+	}
+	return FileMeta{ModTime: info.ModTime(), Mode: info.Mode().Perm()}, nil
+}
+
+// WriteMeta restores the metadata of the file at path, if vol is a MetaVolume.
+func WriteMeta(vol Volume, path string, meta FileMeta) error {
+	if v, ok := vol.(MetaVolume); ok {
+		return v.WriteMeta(path, meta)
+	}
+	return nil
+}
+
+// SetHeader adds the metadata to the HTTP headers h. Large extended attributes are skipped.
+func (m FileMeta) SetHeader(h http.Header) {
+	if !m.ModTime.IsZero() {
+		h.Set(ModTimeHeader, m.ModTime.UTC().Format(time.RFC3339Nano))
+	}
+	if m.Mode != 0 {
+		h.Set(ModeHeader, fmt.Sprintf("%#o", m.Mode.Perm()))
+	}
+	for name, value := range m.Xattrs {
+		if len(value) > maxXattrSize {
+			log.Printf("Skipping extended attribute %s of %d bytes\n", name, len(value))
+			continue
+		}
+		h.Add(XattrHeader, name+"="+base64.RawURLEncoding.EncodeToString(value))
+	}
+}
+
+// ParseFileMeta reads the metadata set by SetHeader from the HTTP headers h.
+func ParseFileMeta(h http.Header) (FileMeta, error) {
+	var meta FileMeta
+	if v := h.Get(ModTimeHeader); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return FileMeta{}, fmt.Errorf("invalid %s: %v", ModTimeHeader, err)
+		}
+		meta.ModTime = t
+	}
+	if v := h.Get(ModeHeader); v != "" {
+		mode, err := strconv.ParseUint(v, 0, 32)
+		if err != nil {
+			return FileMeta{}, fmt.Errorf("invalid %s: %v", ModeHeader, err)
+		}
+		meta.Mode = os.FileMode(mode).Perm()
+	}
+	for _, v := range h[http.CanonicalHeaderKey(XattrHeader)] {
+		i := strings.LastIndex(v, "=")
+		if i <= 0 {
+			return FileMeta{}, fmt.Errorf("invalid %s: %s", XattrHeader, v)
+		}
+		value, err := base64.RawURLEncoding.DecodeString(v[i+1:])
+		if err != nil {
+			return FileMeta{}, fmt.Errorf("invalid %s: %v", XattrHeader, err)
+		}
+		if meta.Xattrs == nil {
+			meta.Xattrs = make(map[string][]byte)
+		}
+		meta.Xattrs[v[:i]] = value
+	}
+	return meta, nil
+}
@@ -0,0 +1,35 @@
+package libsyncer
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFileMetaHeader(t *testing.T) {
+	meta := FileMeta{
+		ModTime: time.Date(2015, 3, 1, 12, 30, 0, 500, time.UTC),
+		Mode:    0640,
+		Xattrs:  map[string][]byte{"user.a=b": []byte("value"), "user.empty": {}},
+	}
+	h := make(http.Header)
+	meta.SetHeader(h)
+
+	parsed, err := ParseFileMeta(h)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !parsed.ModTime.Equal(meta.ModTime) || parsed.Mode != meta.Mode {
+		t.Fatalf("Unexpected metadata %+v", parsed)
+	}
+	if len(parsed.Xattrs) != 2 || string(parsed.Xattrs["user.a=b"]) != "value" || len(parsed.Xattrs["user.empty"]) != 0 {
+		t.Fatalf("Unexpected xattrs %v", parsed.Xattrs)
+	}
+
+	if parsed, err := ParseFileMeta(make(http.Header)); err != nil || !parsed.ModTime.IsZero() || parsed.Mode != 0 {
+		t.Fatalf("Expected empty metadata, got %+v, %v", parsed, err)
+	}
+	if _, err := ParseFileMeta(http.Header{ModeHeader: {"rw"}}); err == nil {
+		t.Fatalf("Expected an error for an invalid mode")
+	}
+}
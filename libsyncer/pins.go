@@ -0,0 +1,121 @@
+package libsyncer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Pins are files kept on their volume: they are never auctioned, moved to another volume by
+// the Rebalancer or retired as redundant copies. A nil Pins has no pinned files.
+type Pins struct {
+	// Path is the file the pins are persisted in. If empty, the pins are not persisted.
+	Path string
+
+	mu    sync.Mutex
+	files map[FileID]bool
+}
+
+// LoadPins loads the pins persisted at path, if the file exists.
+func LoadPins(path string) (*Pins, error) {
+	p := &Pins{Path: path, files: make(map[FileID]bool)}
+	if path == "" {
+		return p, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return nil, err
+	}
+	var files []FileID
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		p.files[file] = true
+	}
+	return p, nil
+}
+
+// Pinned returns true if the file is pinned.
+func (p *Pins) Pinned(file FileID) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.files[file]
+}
+
+// Files returns the pinned files, ordered by volume and path.
+func (p *Pins) Files() []FileID {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.list()
+}
+
+// Pin pins the file and persists the pins.
+func (p *Pins) Pin(file FileID) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.files[file] {
+		return nil
+	}
+	p.files[file] = true
+	if err := p.save(); err != nil {
+		delete(p.files, file)
+		return err
+	}
+	return nil
+}
+
+// Unpin removes the pin of the file and persists the pins.
+func (p *Pins) Unpin(file FileID) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.files[file] {
+		return fmt.Errorf("%s is not pinned", file)
+	}
+	delete(p.files, file)
+	if err := p.save(); err != nil {
+		p.files[file] = true
+		return err
+	}
+	return nil
+}
+
+// list returns the pinned files, ordered by volume and path. Must be called with mu held.
+func (p *Pins) list() []FileID {
+	files := make([]FileID, 0, len(p.files))
+	for file := range p.files {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].VolumeID != files[j].VolumeID {
+			return files[i].VolumeID < files[j].VolumeID
+		}
+		return files[i].Path < files[j].Path
+	})
+	return files
+}
+
+// save persists the pins. Must be called with mu held.
+func (p *Pins) save() error {
+	if p.Path == "" {
+		return nil
+	}
+	data, err := json.Marshal(p.list())
+	if err != nil {
+		return err
+	}
+	tmp := p.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.Path)
+}
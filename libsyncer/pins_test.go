@@ -0,0 +1,48 @@
+package libsyncer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pins.json")
+
+	pins, err := LoadPins(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := FileID{"v", "a"}, FileID{"v", "b"}
+	for _, file := range []FileID{b, a} {
+		if err := pins.Pin(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pins.Unpin(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := pins.Unpin(b); err == nil {
+		t.Fatalf("Expected an error for a file not pinned")
+	}
+
+	loaded, err := LoadPins(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.Files(), []FileID{a}) || !loaded.Pinned(a) || loaded.Pinned(b) {
+		t.Fatalf("Unexpected pins %v", loaded.Files())
+	}
+
+	var none *Pins
+	if none.Pinned(a) {
+		t.Fatalf("Expected no pins")
+	}
+}
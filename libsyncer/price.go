@@ -2,6 +2,7 @@ package libsyncer
 
 import (
 	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -12,18 +13,131 @@ func init() {
 // Clock defines a function that tells us the current time.
 type Clock func() time.Time
 
+// PriceContext describes everything known about a file when calculating a price for it.
+type PriceContext struct {
+	File      FileID
+	Stats     FileStats
+	FreeSpace ByteSize
+
+	// Capacity is the total size of the local volume.
+	Capacity ByteSize
+
+	// Peer is the peer selling the file. When the auctioneer calculates the price
+	// of its own files, this is the local peer.
+	Peer PeerID
+
+	// AuctionID is the auction the price is calculated for. It is empty when the
+	// auctioneer calculates the price of its own files.
+	AuctionID AuctionID
+
+	// PeerLabels are the labels configured or advertised for Peer, e.g. `always-on` or `battery`.
+	PeerLabels []string
+
+	// PeerMeta is the metadata advertised by Peer. It is empty if the peer did not
+	// advertise any metadata yet.
+	PeerMeta NodeMeta
+
+	// Now is the time the price is calculated at.
+	Now time.Time
+}
+
+// HasLabel returns true if the selling peer has the given label.
+func (ctx PriceContext) HasLabel(label string) bool {
+	for _, l := range ctx.PeerLabels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
 // PriceFormula calculates a price to bid when storing the file. Returns -1 if the file should not be stored.
-type PriceFormula func(file FileID, stats FileStats, freeSpace ByteSize) Price
+type PriceFormula func(ctx PriceContext) Price
+
+// FilePriceFormula calculates a price only based on the file and the free space.
+// Use AdaptPriceFormula to turn it into a PriceFormula.
+type FilePriceFormula func(file FileID, stats FileStats, freeSpace ByteSize) Price
+
+// AdaptPriceFormula returns a PriceFormula that ignores everything of the PriceContext
+// besides the file, its stats and the free space.
+func AdaptPriceFormula(f FilePriceFormula) PriceFormula {
+	return func(ctx PriceContext) Price {
+		return f(ctx.File, ctx.Stats, ctx.FreeSpace)
+	}
+}
+
+// PeerLabels maps peers to their labels.
+type PeerLabels map[PeerID][]string
+
+// Pricing combines a PriceFormula with the information required to build a PriceContext.
+// The Formula and Labels can be changed with Reload while the Pricing is used.
+type Pricing struct {
+	Formula PriceFormula
+	Volume  Volume
+	Labels  PeerLabels
+	Clock   Clock
+
+	// Transport provides the metadata advertised by the peers. Optional.
+	Transport Transport
+
+	mu sync.RWMutex
+}
+
+// Reload replaces the Formula and Labels.
+func (p *Pricing) Reload(formula PriceFormula, labels PeerLabels) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Formula = formula
+	p.Labels = labels
+}
+
+// Context returns a PriceContext for the given peer and auction, without any file information.
+// Use it with Price() to calculate prices for several files at once.
+func (p *Pricing) Context(peer PeerID, auctionID AuctionID) PriceContext {
+	clock := p.Clock
+	if clock == nil {
+		clock = time.Now
+	}
+	p.mu.RLock()
+	labels := p.Labels[peer]
+	p.mu.RUnlock()
+	ctx := PriceContext{
+		FreeSpace:  ByteSize(p.Volume.AvailableBytes()),
+		Capacity:   ByteSize(p.Volume.Capacity()),
+		Peer:       peer,
+		AuctionID:  auctionID,
+		PeerLabels: labels,
+		Now:        clock(),
+	}
+	if p.Transport != nil {
+		ctx.PeerMeta = p.Transport.Peers()[string(peer)]
+		if len(ctx.PeerMeta.Labels) > 0 {
+			labels := make([]string, 0, len(ctx.PeerLabels)+len(ctx.PeerMeta.Labels))
+			ctx.PeerLabels = append(append(labels, ctx.PeerLabels...), ctx.PeerMeta.Labels...)
+		}
+	}
+	return ctx
+}
+
+// Price calculates the price of file within the given context.
+func (p *Pricing) Price(ctx PriceContext, file FileID, stats FileStats) Price {
+	ctx.File = file
+	ctx.Stats = stats
+	p.mu.RLock()
+	formula := p.Formula
+	p.mu.RUnlock()
+	return formula(ctx)
+}
 
 // PriceFormulaStatic always returns the staticPrice when calculating a price.
-func PriceFormulaStatic(staticPrice Price) PriceFormula {
+func PriceFormulaStatic(staticPrice Price) FilePriceFormula {
 	return func(file FileID, stats FileStats, freeSpace ByteSize) Price {
 		return staticPrice
 	}
 }
 
 // PriceFormulaRandom returns a random price between 0 and 2.
-func PriceFormulaRandom() PriceFormula {
+func PriceFormulaRandom() FilePriceFormula {
 	return func(file FileID, stats FileStats, freeSpace ByteSize) Price {
 		return Price(rand.Float32() * 2)
 	}
@@ -38,13 +152,13 @@ func PriceFormulaRandom() PriceFormula {
 // or to keep new files on the server that downloaded them.
 //
 // Pass time.Now as the clock to use the current system time for this function.
-func PriceFormulaAge(preferOlder bool, age time.Duration, agePrice, defaultPrice Price, clock Clock) PriceFormula {
+func PriceFormulaAge(preferOlder bool, age time.Duration, agePrice, defaultPrice Price, clock Clock) FilePriceFormula {
 	return func(file FileID, stats FileStats, freeSpace ByteSize) Price {
 		if stats.ModTime == nil {
 			return -1
 		}
 
-		timeBoundary := clock().Add(-1*age)
+		timeBoundary := clock().Add(-1 * age)
 		if preferOlder && stats.ModTime.Before(timeBoundary) {
 			return agePrice
 		}
@@ -4,6 +4,9 @@ package libsyncer
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -14,8 +17,42 @@ const (
 	MessageAuctionStart MessageType = "auction.start"
 	MessageAuctionBid   MessageType = "auction.bid"
 	MessageAuctionEnd   MessageType = "auction.end"
+	MessageTransferDone MessageType = "transfer.done"
+	MessageReplicaWant  MessageType = "replica.want"
+	MessageReplicaHave  MessageType = "replica.have"
 )
 
+// PullURL is sent as the upload URL of a bid by peers that want to download the file
+// themselves if they win, instead of the seller uploading it.
+const PullURL = "pull:"
+
+// ReplicatedURL is sent as the upload URL of a bid by peers that store a file with the
+// same content already. If they win, the seller drops its copy without transferring it.
+// It is only accepted for auctions announcing the hash of the file.
+const ReplicatedURL = "replicated:"
+
+// MaxMessageSize is the largest message a Transport must deliver. Larger messages are rejected.
+const MaxMessageSize = 64 * 1024
+
+// BroadcastError reports the peers a broadcast could not be delivered to.
+type BroadcastError struct {
+	Errors map[string]error
+}
+
+func (e *BroadcastError) Error() string {
+	peers := make([]string, 0, len(e.Errors))
+	for peer := range e.Errors {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+
+	msgs := make([]string, len(peers))
+	for i, peer := range peers {
+		msgs[i] = peer + ": " + e.Errors[peer].Error()
+	}
+	return fmt.Sprintf("broadcast failed for %d peers: %s", len(peers), strings.Join(msgs, "; "))
+}
+
 type MessageFormatter struct {
 	Type   MessageType
 	Format string
@@ -29,9 +66,12 @@ func (m *MessageFormatter) Deserialize(msg string, args ...interface{}) {
 }
 
 var (
-	AuctionStartSerializer = &MessageFormatter{MessageAuctionStart, "%s\t%s\t%s\t%d\t%s"}
+	AuctionStartSerializer = &MessageFormatter{MessageAuctionStart, "%s\t%s\t%s\t%d\t%s\t%s"}
 	AuctionBidSerializer   = &MessageFormatter{MessageAuctionBid, "%s\t%g\t%s"}
-	AuctionEndSerializer   = &MessageFormatter{MessageAuctionEnd, "%s\t%s"}
+	AuctionEndSerializer   = &MessageFormatter{MessageAuctionEnd, "%s\t%s\t%g\t%s"}
+	TransferDoneSerializer = &MessageFormatter{MessageTransferDone, "%s\t%t"}
+	ReplicaWantSerializer  = &MessageFormatter{MessageReplicaWant, "%s\t%d"}
+	ReplicaHaveSerializer  = &MessageFormatter{MessageReplicaHave, "%s\t%s"}
 )
 
 type Price float32
@@ -39,6 +79,32 @@ type PeerID string
 type AuctionID string
 type ByteSize uint64
 
+var byteSizeUnits = []struct {
+	suffix string
+	factor ByteSize
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000}, {"TB", 1000 * 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+// ParseByteSize parses sizes like 512, 10KB or 1.5GiB.
+func ParseByteSize(s string) (ByteSize, error) {
+	factor := ByteSize(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSuffix(s, unit.suffix)
+			factor = unit.factor
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return ByteSize(f * float64(factor)), nil
+}
+
 type FileID struct {
 	// The volume where the file is located
 	VolumeID string
@@ -58,8 +124,52 @@ func (file FileID) Equals(other FileID) bool {
 type FileStats struct {
 	Size    ByteSize
 	ModTime *time.Time
+
+	// Hash is the hex encoded SHA-256 of the file, if known.
+	Hash string
 }
 
+// ProtocolVersion is advertised in the NodeMeta. Peers ignore auctions from peers
+// with a different version.
+const ProtocolVersion = 1
+
+// NodeMeta is the metadata a peer advertises about itself. The JSON keys are short,
+// since transports may limit the size of the metadata.
+type NodeMeta struct {
+	// URL is the base URL of the FileServer of the peer.
+	URL string `json:"u,omitempty"`
+
+	// Volumes are the IDs of the volumes of the peer.
+	Volumes []string `json:"v,omitempty"`
+
+	Capacity ByteSize `json:"c,omitempty"`
+	Free     ByteSize `json:"f,omitempty"`
+
+	// Labels describe the peer, e.g. `always-on`, `battery` or `room:office`.
+	Labels []string `json:"l,omitempty"`
+
+	Version int `json:"p"`
+}
+
+// HasLabel returns true if the peer advertised the given label.
+func (m NodeMeta) HasLabel(label string) bool {
+	for _, l := range m.Labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// PeerEvent describes a change of the members of the network.
+type PeerEvent string
+
+const (
+	PeerJoined  PeerEvent = "join"
+	PeerLeft    PeerEvent = "leave"
+	PeerUpdated PeerEvent = "update"
+)
+
 type Transport interface {
 	// Peer name of the local node
 	Name() string
@@ -68,13 +178,37 @@ type Transport interface {
 	// arriving over the transport.
 	Subscribe(messageType MessageType, callback func(peer string, messageType MessageType, message string))
 
-	// BroadcastTCP sends a message to each peer in the network, aborting on the first error.
-	// This message can reach, 0, all or any number of members.
+	// BroadcastTCP reliably sends a message to each peer in the network. A failure for one
+	// peer does not stop the broadcast to the others; the failed peers are reported with
+	// a *BroadcastError. Messages larger than MaxMessageSize are rejected.
 	BroadcastTCP(messageType MessageType, message string) error
 
 	// Send sends message tagged with messageType to the given peer. If the peers
 	// has any subscriptions for messageType, their callbacks will be invoked.
 	Send(peer string, messageType MessageType, message string) error
+
+	// SetMeta updates the metadata advertised for the local node.
+	SetMeta(meta NodeMeta) error
+
+	// Peers returns the metadata of all other peers in the network, keyed by peer name.
+	Peers() map[string]NodeMeta
+
+	// OnPeerEvent invokes callback whenever another peer joins, leaves (or dies) or updates
+	// its metadata.
+	OnPeerEvent(callback func(event PeerEvent, peer string, meta NodeMeta))
+}
+
+// KeyManager is implemented by Transports which encrypt their messages and support
+// rotating the keys at runtime.
+type KeyManager interface {
+	// InstallKey adds a key to decrypt messages with.
+	InstallKey(key []byte) error
+
+	// UseKey makes an installed key the key to encrypt messages with.
+	UseKey(key []byte) error
+
+	// RemoveKey removes a key which is not the primary key anymore.
+	RemoveKey(key []byte) error
 }
 
 type NetworkProtocol struct {
@@ -85,12 +219,24 @@ func (np *NetworkProtocol) Name() string {
 	return np.T.Name()
 }
 
+// OnPeerEvent invokes callback whenever another peer joins, leaves or updates its metadata.
+func (np *NetworkProtocol) OnPeerEvent(callback func(event PeerEvent, peer string, meta NodeMeta)) {
+	np.T.OnPeerEvent(callback)
+}
+
+// PeerMeta returns the metadata advertised by peer.
+func (np *NetworkProtocol) PeerMeta(peer string) (NodeMeta, bool) {
+	meta, ok := np.T.Peers()[peer]
+	return meta, ok
+}
+
 // AuctionStart
 func (np *NetworkProtocol) AuctionStart(auctionID AuctionID, file FileID, stats FileStats) error {
 	msg := AuctionStartSerializer.Serialize(
 		string(auctionID),
 		file.VolumeID, file.Path,
 		stats.Size, stats.ModTime.Format(time.RFC3339),
+		stats.Hash,
 	)
 
 	return np.T.BroadcastTCP(MessageAuctionStart, msg)
@@ -109,6 +255,7 @@ func (np *NetworkProtocol) OnAuctionStart(cb func(peer string, auctionID Auction
 			&file.Path,
 			&stats.Size,
 			&modTime,
+			&stats.Hash,
 		)
 		t, err := time.Parse(time.RFC3339, modTime)
 		if err != nil {
@@ -135,15 +282,62 @@ func (np *NetworkProtocol) OnAuctionBid(cb func(peer string, auctionID AuctionID
 	})
 }
 
-func (np *NetworkProtocol) AuctionEnd(auctionID AuctionID, winnerPeer string) error {
-	return np.T.BroadcastTCP(MessageAuctionEnd, AuctionEndSerializer.Serialize(auctionID, winnerPeer))
+// AuctionEnd announces the winner of an auction and the price it was won with.
+// If the winner bid with PullURL, downloadURL is the URL it can download the file from.
+func (np *NetworkProtocol) AuctionEnd(auctionID AuctionID, winnerPeer string, price Price, downloadURL string) error {
+	return np.T.BroadcastTCP(MessageAuctionEnd, AuctionEndSerializer.Serialize(auctionID, winnerPeer, float32(price), downloadURL))
 }
 
-func (np *NetworkProtocol) OnAuctionEnd(cb func(peer string, auctionID AuctionID, winnerPeer string)) {
+func (np *NetworkProtocol) OnAuctionEnd(cb func(peer string, auctionID AuctionID, winnerPeer string, price Price, downloadURL string)) {
 	np.T.Subscribe(MessageAuctionEnd, func(peer string, mtype MessageType, msg string) {
 		var auctionID AuctionID
 		var winnerPeer string
-		AuctionEndSerializer.Deserialize(msg, &auctionID, &winnerPeer)
-		cb(peer, auctionID, winnerPeer)
+		var price Price
+		var downloadURL string
+		AuctionEndSerializer.Deserialize(msg, &auctionID, &winnerPeer, &price, &downloadURL)
+		cb(peer, auctionID, winnerPeer, price, downloadURL)
+	})
+}
+
+// TransferDone tells the seller of an auction, whether the winner downloaded the file successfully.
+func (np *NetworkProtocol) TransferDone(peer string, auctionID AuctionID, success bool) error {
+	return np.T.Send(peer, MessageTransferDone, TransferDoneSerializer.Serialize(auctionID, success))
+}
+
+func (np *NetworkProtocol) OnTransferDone(cb func(peer string, auctionID AuctionID, success bool)) {
+	np.T.Subscribe(MessageTransferDone, func(peer string, mtype MessageType, msg string) {
+		var auctionID AuctionID
+		var success bool
+		TransferDoneSerializer.Deserialize(msg, &auctionID, &success)
+		cb(peer, auctionID, success)
+	})
+}
+
+// ReplicaWant asks all peers for a copy of a file with the given hash and size, e.g. to
+// repair a corrupt file.
+func (np *NetworkProtocol) ReplicaWant(hash string, size ByteSize) error {
+	return np.T.BroadcastTCP(MessageReplicaWant, ReplicaWantSerializer.Serialize(hash, size))
+}
+
+func (np *NetworkProtocol) OnReplicaWant(cb func(peer string, hash string, size ByteSize)) {
+	np.T.Subscribe(MessageReplicaWant, func(peer string, mtype MessageType, msg string) {
+		var hash string
+		var size ByteSize
+		ReplicaWantSerializer.Deserialize(msg, &hash, &size)
+		cb(peer, hash, size)
+	})
+}
+
+// ReplicaHave offers a peer the copy of the file with the given hash at downloadURL.
+func (np *NetworkProtocol) ReplicaHave(peer string, hash string, downloadURL string) error {
+	return np.T.Send(peer, MessageReplicaHave, ReplicaHaveSerializer.Serialize(hash, downloadURL))
+}
+
+func (np *NetworkProtocol) OnReplicaHave(cb func(peer string, hash string, downloadURL string)) {
+	np.T.Subscribe(MessageReplicaHave, func(peer string, mtype MessageType, msg string) {
+		var hash string
+		var downloadURL string
+		ReplicaHaveSerializer.Deserialize(msg, &hash, &downloadURL)
+		cb(peer, hash, downloadURL)
 	})
 }
@@ -0,0 +1,257 @@
+package libsyncer
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScheduleWindow defines what a node may do during certain hours on certain weekdays.
+type ScheduleWindow struct {
+	// Days on which the window is active, indexed by time.Weekday.
+	Days [7]bool
+
+	// From and To are the offsets since midnight the window starts and ends at.
+	// If To is before From, the window ends on the next day.
+	From time.Duration
+	To   time.Duration
+
+	// Auction defines whether the node may start auctions during the window.
+	Auction bool
+
+	// Bid defines whether the node may bid on auctions during the window.
+	Bid bool
+
+	// Bandwidth limits the transfers in bytes per second. 0 means unlimited.
+	Bandwidth ByteSize
+}
+
+// Contains returns true if t is within the window.
+func (w ScheduleWindow) Contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+
+	if w.From <= w.To {
+		return w.Days[t.Weekday()] && offset >= w.From && offset < w.To
+	}
+
+	// The window wraps around midnight. After midnight it belongs to the previous day.
+	if offset >= w.From {
+		return w.Days[t.Weekday()]
+	}
+	return offset < w.To && w.Days[(t.Weekday()+6)%7]
+}
+
+// Schedule is a list of ScheduleWindows. The first window containing a given time
+// applies. Outside of all windows, everything is allowed without a bandwidth limit.
+// A nil Schedule allows everything at any time.
+type Schedule struct {
+	Windows []ScheduleWindow
+
+	mu sync.RWMutex
+}
+
+// Reload replaces the windows with the windows of other, which may be nil.
+func (s *Schedule) Reload(other *Schedule) {
+	var windows []ScheduleWindow
+	if other != nil {
+		other.mu.RLock()
+		windows = other.Windows
+		other.mu.RUnlock()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Windows = windows
+}
+
+var alwaysWindow = ScheduleWindow{Auction: true, Bid: true}
+
+// Snapshot returns a copy of the windows.
+func (s *Schedule) Snapshot() []ScheduleWindow {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]ScheduleWindow(nil), s.Windows...)
+}
+
+// Window returns the window applying at t.
+func (s *Schedule) Window(t time.Time) ScheduleWindow {
+	if s == nil {
+		return alwaysWindow
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, w := range s.Windows {
+		if w.Contains(t) {
+			return w
+		}
+	}
+	return alwaysWindow
+}
+
+// AllowAuction returns true if auctions may be started at t.
+func (s *Schedule) AllowAuction(t time.Time) bool {
+	return s.Window(t).Auction
+}
+
+// AllowBid returns true if the node may bid on auctions at t.
+func (s *Schedule) AllowBid(t time.Time) bool {
+	return s.Window(t).Bid
+}
+
+// Bandwidth returns the bandwidth limit in bytes per second at t. 0 means unlimited.
+func (s *Schedule) Bandwidth(t time.Time) ByteSize {
+	return s.Window(t).Bandwidth
+}
+
+// ParseSchedule parses each of the windows with ParseScheduleWindow.
+func ParseSchedule(windows []string) (*Schedule, error) {
+	s := &Schedule{}
+	for _, window := range windows {
+		w, err := ParseScheduleWindow(window)
+		if err != nil {
+			return nil, err
+		}
+		s.Windows = append(s.Windows, w)
+	}
+	return s, nil
+}
+
+// String returns the window in the format parsed by ParseScheduleWindow.
+func (w ScheduleWindow) String() string {
+	var days []string
+	for d, ok := range w.Days {
+		if ok {
+			days = append(days, strings.ToLower(time.Weekday(d).String()[:3]))
+		}
+	}
+	if len(days) == len(w.Days) {
+		days = []string{"*"}
+	}
+	s := fmt.Sprintf("%s %02d:%02d-%02d:%02d", strings.Join(days, ","),
+		int(w.From.Hours()), int(w.From.Minutes())%60, int(w.To.Hours()), int(w.To.Minutes())%60)
+	if !w.Auction {
+		s += " auction=off"
+	}
+	if !w.Bid {
+		s += " bid=off"
+	}
+	if w.Bandwidth > 0 {
+		s += fmt.Sprintf(" bandwidth=%d", w.Bandwidth)
+	}
+	return s
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ParseScheduleWindow parses a window definition like
+//
+//	mon-fri 18:00-23:00 auction=off bid=on bandwidth=512KiB
+//
+// The days are a comma separated list of weekdays or weekday ranges, or `*` for every day.
+// The hours may wrap around midnight, e.g. `22:00-06:00`. Options that are not given
+// default to auction=on, bid=on and an unlimited bandwidth.
+func ParseScheduleWindow(s string) (ScheduleWindow, error) {
+	w := alwaysWindow
+
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return w, fmt.Errorf("invalid schedule window %q: expected days and hours", s)
+	}
+
+	if err := parseScheduleDays(fields[0], &w.Days); err != nil {
+		return w, fmt.Errorf("invalid schedule window %q: %v", s, err)
+	}
+
+	hours := strings.SplitN(fields[1], "-", 2)
+	if len(hours) != 2 {
+		return w, fmt.Errorf("invalid schedule window %q: expected hours like 18:00-23:00", s)
+	}
+	var err error
+	if w.From, err = parseScheduleTime(hours[0]); err != nil {
+		return w, fmt.Errorf("invalid schedule window %q: %v", s, err)
+	}
+	if w.To, err = parseScheduleTime(hours[1]); err != nil {
+		return w, fmt.Errorf("invalid schedule window %q: %v", s, err)
+	}
+
+	for _, option := range fields[2:] {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return w, fmt.Errorf("invalid schedule window %q: expected key=value, got %q", s, option)
+		}
+		switch kv[0] {
+		case "auction":
+			w.Auction, err = parseScheduleSwitch(kv[1])
+		case "bid":
+			w.Bid, err = parseScheduleSwitch(kv[1])
+		case "bandwidth":
+			w.Bandwidth, err = ParseByteSize(kv[1])
+		default:
+			err = fmt.Errorf("unknown option %q", kv[0])
+		}
+		if err != nil {
+			return w, fmt.Errorf("invalid schedule window %q: %v", s, err)
+		}
+	}
+	return w, nil
+}
+
+func parseScheduleDays(s string, days *[7]bool) error {
+	if s == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return nil
+	}
+
+	for _, r := range strings.Split(s, ",") {
+		bounds := strings.SplitN(strings.ToLower(r), "-", 2)
+		from, ok := weekdays[bounds[0]]
+		if !ok {
+			return fmt.Errorf("unknown weekday %q", bounds[0])
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, ok = weekdays[bounds[1]]; !ok {
+				return fmt.Errorf("unknown weekday %q", bounds[1])
+			}
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func parseScheduleTime(s string) (time.Duration, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m > 0) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+func parseScheduleSwitch(s string) (bool, error) {
+	switch s {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("expected on or off, got %q", s)
+}
@@ -0,0 +1,88 @@
+package libsyncer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduleWindow(t *testing.T) {
+	w, err := ParseScheduleWindow("mon-fri 18:00-23:00 auction=off bandwidth=512KiB")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if w.Days[time.Sunday] || !w.Days[time.Monday] || !w.Days[time.Friday] || w.Days[time.Saturday] {
+		t.Fatalf("Unexpected days %v", w.Days)
+	}
+	if w.From != 18*time.Hour || w.To != 23*time.Hour {
+		t.Fatalf("Unexpected hours %v-%v", w.From, w.To)
+	}
+	if w.Auction || !w.Bid || w.Bandwidth != 512*1024 {
+		t.Fatalf("Unexpected options %+v", w)
+	}
+
+	for _, invalid := range []string{"", "mon", "xyz 10:00-12:00", "mon 10:00", "mon 25:00-26:00", "mon 10:00-12:00 auction=maybe", "mon 10:00-12:00 foo=bar"} {
+		if _, err := ParseScheduleWindow(invalid); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+}
+
+func TestSchedule_Window(t *testing.T) {
+	s, err := ParseSchedule([]string{
+		"sat,sun 22:00-06:00 bid=off",
+		"* 18:00-23:00 auction=off bandwidth=1MB",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	utc := time.FixedZone("UTC", 0)
+	tests := []struct {
+		t         time.Time
+		auction   bool
+		bid       bool
+		bandwidth ByteSize
+	}{
+		// Friday
+		{time.Date(2016, 01, 01, 12, 0, 0, 0, utc), true, true, 0},
+		{time.Date(2016, 01, 01, 22, 30, 0, 0, utc), false, true, 1000 * 1000},
+		// Saturday
+		{time.Date(2016, 01, 02, 22, 30, 0, 0, utc), true, false, 0},
+		{time.Date(2016, 01, 02, 3, 0, 0, 0, utc), true, true, 0},
+		// Monday morning still belongs to the sunday window
+		{time.Date(2016, 01, 04, 5, 59, 0, 0, utc), true, false, 0},
+		{time.Date(2016, 01, 04, 6, 0, 0, 0, utc), true, true, 0},
+	}
+
+	for _, test := range tests {
+		if s.AllowAuction(test.t) != test.auction || s.AllowBid(test.t) != test.bid || s.Bandwidth(test.t) != test.bandwidth {
+			t.Errorf("%v: unexpected window %+v", test.t, s.Window(test.t))
+		}
+	}
+
+	var nilSchedule *Schedule
+	if !nilSchedule.AllowAuction(time.Now()) || !nilSchedule.AllowBid(time.Now()) {
+		t.Errorf("Expected nil schedule to allow everything")
+	}
+}
+
+func TestScheduleWindow_String(t *testing.T) {
+	for _, s := range []string{
+		"mon-fri 18:00-23:00 auction=off bandwidth=512KiB",
+		"* 22:30-06:00 bid=off",
+		"sat,sun 00:00-24:00",
+	} {
+		w, err := ParseScheduleWindow(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := ParseScheduleWindow(w.String())
+		if err != nil {
+			t.Fatalf("%s: %v", w, err)
+		}
+		if parsed != w {
+			t.Errorf("%s: expected %+v, got %+v", s, w, parsed)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package libsyncer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ScrubConfig configures how often and how fast the Scrubber verifies the stored files.
+type ScrubConfig struct {
+	// Interval is how often each file is verified. 0 disables scrubbing.
+	Interval time.Duration
+
+	// Rate limits how many bytes per second are read when verifying files. 0 is unlimited.
+	Rate ByteSize
+}
+
+// DefaultScrubConfig verifies each file once a month, reading 10MiB per second.
+var DefaultScrubConfig = ScrubConfig{Interval: 30 * 24 * time.Hour, Rate: 10 * 1024 * 1024}
+
+// scrubCheckInterval is how often the Scrubber looks for files due for verification.
+const scrubCheckInterval = 1 * time.Hour
+
+var errScrubStopped = errors.New("scrubber stopped")
+
+// ScrubReport describes a corrupt file found by the Scrubber.
+type ScrubReport struct {
+	File FileID   `json:"file"`
+	Size ByteSize `json:"size"`
+
+	// Expected is the hash recorded for the file, Actual the hash of its current content.
+	Expected string    `json:"expected"`
+	Actual   string    `json:"actual"`
+	Found    time.Time `json:"found"`
+
+	// Repaired is set once the file was replaced by a healthy copy from a peer.
+	Repaired bool `json:"repaired"`
+}
+
+// The Scrubber periodically re-hashes the files of the indexed volumes and compares them
+// with the hash recorded when the file was transferred or verified before. Corrupt files
+// are reported and repaired from a peer having a copy with the recorded hash, if any.
+type Scrubber struct {
+	ScrubConfig
+	Volumes    Volumes
+	FileServer *FileServer
+	Downloader *Downloader
+
+	// Busy reports files which must not be verified, e.g. because they are being uploaded.
+	Busy func(file FileID) bool
+
+	network NetworkProtocol
+	bucket  *TokenBucket
+
+	// reports contains the corrupt files, keyed by file. It is guarded by mu.
+	mu        sync.Mutex
+	reports   map[string]*ScrubReport
+	repairing map[string]bool
+
+	stop chan struct{}
+}
+
+// NewScrubber creates a Scrubber and subscribes to the replica requests of other peers.
+func NewScrubber(n NetworkProtocol, cfg ScrubConfig, vols Volumes, fs *FileServer, downloader *Downloader) *Scrubber {
+	s := &Scrubber{
+		ScrubConfig: cfg,
+		Volumes:     vols,
+		FileServer:  fs,
+		Downloader:  downloader,
+		network:     n,
+		bucket:      NewTokenBucket(cfg.Rate),
+		reports:     make(map[string]*ScrubReport),
+		repairing:   make(map[string]bool),
+		stop:        make(chan struct{}),
+	}
+	n.OnReplicaWant(s.replicaWanted)
+	n.OnReplicaHave(s.replicaOffered)
+	return s
+}
+
+func (s *Scrubber) Serve() {
+	if s.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(scrubCheckInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.Scrub(); err == errScrubStopped {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *Scrubber) Stop() {
+	close(s.stop)
+}
+
+// Scrub verifies all files which were not verified within the Interval.
+func (s *Scrubber) Scrub() error {
+	for _, vol := range s.Volumes {
+		indexed, ok := vol.(*IndexedVolume)
+		if !ok {
+			continue
+		}
+		err := indexed.Entries(func(entry IndexEntry) error {
+			file := FileID{VolumeID: vol.ID(), Path: entry.Path}
+			if time.Since(entry.Verified) < s.Interval || s.Corrupt(file) || s.Busy != nil && s.Busy(file) {
+				return nil
+			}
+			if indexed.LastWrite(entry.Path).After(time.Now().Add(-1 * time.Hour)) {
+				// Might still be written.
+				return nil
+			}
+			return s.verify(indexed, entry)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify hashes the file of entry and compares it with the recorded hash. Files without a
+// hash get the hash of their current content.
+func (s *Scrubber) verify(vol *IndexedVolume, entry IndexEntry) error {
+	file := FileID{VolumeID: vol.ID(), Path: entry.Path}
+	hash, err := s.hash(vol, entry.Path)
+	if err == errScrubStopped {
+		return err
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			vol.Refresh(entry.Path)
+		} else {
+			log.Println("ERROR: Failed to verify " + file.String() + ": " + err.Error())
+		}
+		return nil
+	}
+
+	// The file may have been changed while hashing it.
+	if err := vol.Refresh(entry.Path); err != nil {
+		return nil
+	}
+	current, ok := vol.Lookup(entry.Path)
+	if !ok || current.Size != entry.Size || !current.ModTime.Equal(entry.ModTime) {
+		return nil
+	}
+	if current.Hash == "" || current.Hash == hash {
+		if err := vol.SetHash(entry.Path, hash); err != nil {
+			log.Println("ERROR: Failed to store hash of " + file.String() + ": " + err.Error())
+		}
+		return nil
+	}
+
+	log.Printf("ERROR: %s is corrupt: expected sha256 %s, got %s\n", file, current.Hash, hash)
+	s.mu.Lock()
+	s.reports[file.String()] = &ScrubReport{
+		File:     file,
+		Size:     current.Size,
+		Expected: current.Hash,
+		Actual:   hash,
+		Found:    time.Now(),
+	}
+	s.mu.Unlock()
+
+	if err := s.network.ReplicaWant(current.Hash, current.Size); err != nil {
+		log.Printf("%s: replica.want not delivered: %v\n", file, err)
+	}
+	return nil
+}
+
+// hash returns the hex encoded SHA-256 of the file, reading it at the configured Rate.
+func (s *Scrubber) hash(vol Volume, path string) (string, error) {
+	reader, err := vol.Read(path)
+	if err != nil {
+		return "", err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	checksum := sha256.New()
+	buf := make([]byte, throttleChunkSize)
+	for {
+		select {
+		case <-s.stop:
+			return "", errScrubStopped
+		default:
+		}
+
+		n, err := reader.Read(buf)
+		if n > 0 {
+			s.bucket.Wait(n)
+			checksum.Write(buf[:n])
+		}
+		if err == io.EOF {
+			return hex.EncodeToString(checksum.Sum(nil)), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// Corrupt returns true if the file was found corrupt and not repaired yet. Corrupt files
+// are neither auctioned nor moved.
+func (s *Scrubber) Corrupt(file FileID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report, ok := s.reports[file.String()]
+	return ok && !report.Repaired
+}
+
+// Reports returns the corrupt files found since the start, ordered by the time they were found.
+func (s *Scrubber) Reports() []ScrubReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reports := make([]ScrubReport, 0, len(s.reports))
+	for _, report := range s.reports {
+		reports = append(reports, *report)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Found.Before(reports[j].Found)
+	})
+	return reports
+}
+
+// replicaWanted offers a local copy with the given hash to a peer repairing a corrupt file.
+func (s *Scrubber) replicaWanted(peer string, hash string, size ByteSize) {
+	for _, vol := range s.Volumes {
+		indexed, ok := vol.(*IndexedVolume)
+		if !ok {
+			continue
+		}
+		for _, entry := range indexed.FindHash(hash) {
+			file := FileID{VolumeID: vol.ID(), Path: entry.Path}
+			if entry.Size != size || s.Corrupt(file) {
+				continue
+			}
+			downloadURL, err := s.FileServer.CreateDownloadURL(file, PeerID(peer), time.Now().Add(PullTimeout))
+			if err != nil {
+				continue
+			}
+			log.Printf("Offering %s to %s as replica of %s\n", file, peer, hash)
+			if err := s.network.ReplicaHave(peer, hash, downloadURL); err != nil {
+				log.Printf("%s: replica.have not delivered to %s: %v\n", file, peer, err)
+			}
+			return
+		}
+	}
+}
+
+// replicaOffered repairs the corrupt files with the given hash from the offered copy.
+func (s *Scrubber) replicaOffered(peer string, hash string, downloadURL string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, report := range s.reports {
+		if report.Expected != hash || report.Repaired || s.repairing[key] {
+			continue
+		}
+		s.repairing[key] = true
+		go s.repair(*report, PeerID(peer), downloadURL)
+	}
+}
+
+// repair replaces the corrupt file with the copy of peer, once the copy is downloaded and
+// matches the recorded hash. The corrupt file is kept in the trash of the volume, if it has one.
+func (s *Scrubber) repair(report ScrubReport, peer PeerID, downloadURL string) {
+	key := report.File.String()
+	defer func() {
+		s.mu.Lock()
+		delete(s.repairing, key)
+		s.mu.Unlock()
+	}()
+
+	vol := s.Volumes.Get(report.File.VolumeID)
+	if vol == nil {
+		return
+	}
+	log.Printf("Repairing %s from %s\n", report.File, peer)
+	err := s.Downloader.Replace(context.Background(), report.File, FileStats{Size: report.Size}, report.Expected, peer, downloadURL)
+	if err != nil {
+		log.Printf("ERROR: Failed to repair %s from %s: %v\n", report.File, peer, err)
+		return
+	}
+
+	s.mu.Lock()
+	if r, ok := s.reports[key]; ok {
+		r.Repaired = true
+	}
+	s.mu.Unlock()
+	log.Printf("Repaired %s from %s\n", report.File, peer)
+}
@@ -0,0 +1,118 @@
+package libsyncer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testTransport records the broadcasted and sent messages. Messages from other peers are
+// delivered to the subscribers with receive.
+type testTransport struct {
+	name        string
+	broadcasts  []string
+	sent        []string
+	subscribers map[MessageType][]func(peer string, messageType MessageType, message string)
+	peers       map[string]NodeMeta
+}
+
+func (t *testTransport) Name() string {
+	if t.name == "" {
+		return "local"
+	}
+	return t.name
+}
+func (t *testTransport) Subscribe(messageType MessageType, callback func(peer string, messageType MessageType, message string)) {
+	if t.subscribers == nil {
+		t.subscribers = make(map[MessageType][]func(peer string, messageType MessageType, message string))
+	}
+	t.subscribers[messageType] = append(t.subscribers[messageType], callback)
+}
+func (t *testTransport) receive(peer string, messageType MessageType, message string) {
+	for _, cb := range t.subscribers[messageType] {
+		cb(peer, messageType, message)
+	}
+}
+func (t *testTransport) BroadcastTCP(messageType MessageType, message string) error {
+	t.broadcasts = append(t.broadcasts, string(messageType)+" "+message)
+	return nil
+}
+func (t *testTransport) Send(peer string, messageType MessageType, message string) error {
+	t.sent = append(t.sent, peer+" "+string(messageType)+" "+message)
+	return nil
+}
+func (t *testTransport) SetMeta(meta NodeMeta) error { return nil }
+func (t *testTransport) Peers() map[string]NodeMeta  { return t.peers }
+func (t *testTransport) OnPeerEvent(callback func(event PeerEvent, peer string, meta NodeMeta)) {
+}
+
+func TestScrubber(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mediasyncer-scrub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	vol := newTestVolume("v", 1000)
+	vol.files["a"] = []byte("hello")
+	v, err := OpenIndex(filepath.Join(dir, "v.db"), vol)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer v.Close()
+	v.Rescan()
+
+	transport := &testTransport{}
+	s := NewScrubber(NetworkProtocol{transport}, ScrubConfig{Interval: time.Hour}, Volumes{v}, nil, nil)
+
+	// The first pass records the hash.
+	if err := s.Scrub(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	entry, _ := v.Lookup("a")
+	if entry.Hash != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Fatalf("Unexpected hash %q", entry.Hash)
+	}
+
+	// Files verified within the interval are skipped.
+	vol.files["a"] = []byte("hallo")
+	s.Scrub()
+	if len(s.Reports()) != 0 {
+		t.Fatalf("Unexpected reports %+v", s.Reports())
+	}
+
+	s.Interval = time.Nanosecond
+	s.Scrub()
+	reports := s.Reports()
+	if len(reports) != 1 || reports[0].File.Path != "a" || reports[0].Expected != entry.Hash {
+		t.Fatalf("Unexpected reports %+v", reports)
+	}
+	if !s.Corrupt(FileID{VolumeID: "v", Path: "a"}) {
+		t.Fatalf("Expected a to be corrupt")
+	}
+	if len(transport.broadcasts) != 1 || transport.broadcasts[0] != "replica.want "+entry.Hash+"\t5" {
+		t.Fatalf("Unexpected broadcasts %q", transport.broadcasts)
+	}
+
+	// A replica with different content keeps the corrupt file in place.
+	replica := "hullo"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(replica))
+	}))
+	defer server.Close()
+	s.Downloader = &Downloader{Volumes: Volumes{v}, Throttle: NewThrottle(ThrottleConfig{}), Name: "local"}
+	s.repair(reports[0], "peer", server.URL)
+	if string(vol.files["a"]) != "hallo" || len(vol.files) != 1 || !s.Corrupt(reports[0].File) {
+		t.Fatalf("Expected the corrupt file to be kept, got %q", vol.files)
+	}
+
+	replica = "hello"
+	s.repair(reports[0], "peer", server.URL)
+	if string(vol.files["a"]) != "hello" || len(vol.files) != 1 || s.Corrupt(reports[0].File) {
+		t.Fatalf("Expected the file to be repaired, got %q", vol.files)
+	}
+}
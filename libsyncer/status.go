@@ -0,0 +1,114 @@
+package libsyncer
+
+// ConfigStatus is the effective config of a node, as reported by the AdminServer.
+type ConfigStatus struct {
+	Name      string         `json:"name"`
+	URL       string         `json:"url"`
+	Pull      bool           `json:"pull"`
+	Conflict  ConflictPolicy `json:"conflict"`
+	IndexDir  string         `json:"index_dir"`
+	Excludes  []string       `json:"excludes"`
+	Labels    []string       `json:"labels"`
+	Schedule  []string       `json:"schedule"`
+	AdminAddr string         `json:"admin_addr"`
+	TLS       bool           `json:"tls"`
+
+	PeerLabels     PeerLabels          `json:"peer_labels"`
+	Bandwidth      ByteSize            `json:"bandwidth"`
+	PeerBandwidths map[PeerID]ByteSize `json:"peer_bandwidths"`
+
+	ScrubInterval string   `json:"scrub_interval"`
+	ScrubRate     ByteSize `json:"scrub_rate"`
+	DedupInterval string   `json:"dedup_interval"`
+	Replicas      int      `json:"replicas"`
+
+	Volumes []VolumeStatus `json:"volumes"`
+}
+
+// VolumeStatus describes the space and watermarks of a volume. Reserved is the size of the
+// files of open bids and running downloads for the volume. Draining is set while the volume
+// is drained.
+type VolumeStatus struct {
+	ID            string   `json:"id"`
+	Capacity      ByteSize `json:"capacity"`
+	Free          ByteSize `json:"free"`
+	Fill          float64  `json:"fill"`
+	HighWatermark float64  `json:"high_watermark"`
+	LowWatermark  float64  `json:"low_watermark"`
+	Reserved      ByteSize `json:"reserved"`
+	Draining      bool     `json:"draining"`
+}
+
+// ConfigStatus returns the effective config, including the changes applied by Reload.
+func (s *Syncer) ConfigStatus() ConfigStatus {
+	s.mu.Lock()
+	cfg := s.Config
+	s.mu.Unlock()
+
+	status := ConfigStatus{
+		Name:      s.Transport.Name(),
+		URL:       s.FileServer.URL(),
+		Pull:      cfg.Pull,
+		Conflict:  cfg.Conflict,
+		IndexDir:  cfg.IndexDir,
+		Excludes:  cfg.Excludes,
+		Labels:    cfg.Labels,
+		Schedule:  []string{},
+		AdminAddr: cfg.AdminAddr,
+		TLS:       cfg.FileServerConfig.TLS.Enabled(),
+
+		PeerLabels:     cfg.PeerLabels,
+		Bandwidth:      cfg.ThrottleConfig.Rate,
+		PeerBandwidths: cfg.ThrottleConfig.PeerRates,
+
+		ScrubInterval: cfg.Scrub.Interval.String(),
+		ScrubRate:     cfg.Scrub.Rate,
+		DedupInterval: cfg.Dedup.Interval.String(),
+		Replicas:      cfg.Dedup.Replicas,
+
+		Volumes: s.VolumeStatus(),
+	}
+	if cfg.Conflict == "" {
+		status.Conflict = ConflictSkip
+	}
+	for _, w := range cfg.Schedule.Snapshot() {
+		status.Schedule = append(status.Schedule, w.String())
+	}
+	return status
+}
+
+// VolumeStatus returns the space and watermarks of the volumes.
+func (s *Syncer) VolumeStatus() []VolumeStatus {
+	reserved := make(map[string]ByteSize)
+	bidder := s.Bidder.Status()
+	for _, bid := range bidder.Bids {
+		reserved[bid.Target.VolumeID] += bid.Size
+	}
+	for _, download := range bidder.Downloads {
+		reserved[download.File.VolumeID] += download.Size
+	}
+
+	s.mu.Lock()
+	vols := s.Volumes
+	s.mu.Unlock()
+
+	draining := make(map[string]bool)
+	for _, a := range s.Auctioneers {
+		draining[a.Volume.ID()] = a.Draining()
+	}
+
+	status := make([]VolumeStatus, 0, len(vols))
+	for _, vol := range vols {
+		status = append(status, VolumeStatus{
+			ID:            vol.Volume.ID(),
+			Capacity:      ByteSize(vol.Volume.Capacity()),
+			Free:          ByteSize(vol.Volume.AvailableBytes()),
+			Fill:          vol.fill(0),
+			HighWatermark: vol.high(),
+			LowWatermark:  vol.low(),
+			Reserved:      reserved[vol.Volume.ID()],
+			Draining:      draining[vol.Volume.ID()],
+		})
+	}
+	return status
+}
@@ -0,0 +1,379 @@
+package libsyncer
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// throttleChunkSize limits how many bytes are read or written at once, so waiting
+// for the TokenBucket happens in small steps.
+const throttleChunkSize = 32 * 1024
+
+// TokenBucket limits the throughput to a rate of bytes per second. It allows bursts of
+// up to one second worth of bytes. A rate of 0 means unlimited.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   ByteSize
+	tokens float64
+	last   time.Time
+
+	clock Clock
+	sleep func(time.Duration)
+}
+
+// NewTokenBucket creates a TokenBucket with the given rate in bytes per second.
+func NewTokenBucket(rate ByteSize) *TokenBucket {
+	return newTokenBucket(rate, time.Now, time.Sleep)
+}
+
+func newTokenBucket(rate ByteSize, clock Clock, sleep func(time.Duration)) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		tokens: float64(rate),
+		last:   clock(),
+		clock:  clock,
+		sleep:  sleep,
+	}
+}
+
+// Rate returns the current rate in bytes per second.
+func (b *TokenBucket) Rate() ByteSize {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// SetRate changes the rate in bytes per second. 0 means unlimited.
+func (b *TokenBucket) SetRate(rate ByteSize) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	b.rate = rate
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+}
+
+func (b *TokenBucket) refill() {
+	now := b.clock()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if b.tokens > float64(b.rate) {
+		b.tokens = float64(b.rate)
+	}
+	b.last = now
+}
+
+// Wait takes n bytes out of the bucket and blocks until the rate allows them.
+func (b *TokenBucket) Wait(n int) {
+	b.mu.Lock()
+	if b.rate == 0 {
+		b.mu.Unlock()
+		return
+	}
+	b.refill()
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if delay > 0 {
+		b.sleep(delay)
+	}
+}
+
+// Meter measures the throughput over the last few seconds.
+type Meter struct {
+	mu      sync.Mutex
+	total   uint64
+	samples []meterSample
+}
+
+type meterSample struct {
+	time  time.Time
+	total uint64
+}
+
+const meterWindow = 5 * time.Second
+
+// Add records n transferred bytes.
+func (m *Meter) Add(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.total += uint64(n)
+	now := time.Now()
+	if len(m.samples) == 0 || now.Sub(m.samples[len(m.samples)-1].time) >= time.Second {
+		m.samples = append(m.samples, meterSample{now, m.total})
+	}
+	for len(m.samples) > 1 && now.Sub(m.samples[0].time) > meterWindow {
+		m.samples = m.samples[1:]
+	}
+}
+
+// Total returns the number of bytes recorded so far.
+func (m *Meter) Total() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.total
+}
+
+// Rate returns the throughput in bytes per second.
+func (m *Meter) Rate() ByteSize {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.samples) == 0 {
+		return 0
+	}
+	oldest := m.samples[0]
+	elapsed := time.Since(oldest.time)
+	if elapsed > meterWindow+time.Second {
+		// Nothing was transferred recently.
+		return 0
+	}
+	if elapsed < time.Second {
+		elapsed = time.Second
+	}
+	return ByteSize(float64(m.total-oldest.total) / elapsed.Seconds())
+}
+
+// ThrottleConfig configures the bandwidth limits of a Throttle. All rates are in bytes
+// per second, 0 means unlimited.
+type ThrottleConfig struct {
+	// Rate limits all transfers of the node together.
+	Rate ByteSize
+
+	// PeerRates limits the transfers from and to single peers.
+	PeerRates map[PeerID]ByteSize
+}
+
+// The Throttle limits the bandwidth used by the Uploader and FileServer, globally and per peer.
+// The global rate is further limited by the bandwidth of the active ScheduleWindow.
+type Throttle struct {
+	Schedule *Schedule
+	Clock    Clock
+
+	// Sleep waits until the rates allow the next chunk. Defaults to time.Sleep.
+	Sleep func(time.Duration)
+
+	mu        sync.Mutex
+	rate      ByteSize
+	global    *TokenBucket
+	meter     *Meter
+	peers     map[PeerID]*TokenBucket
+	peerMeter map[PeerID]*Meter
+}
+
+// NewThrottle creates a Throttle for the given config.
+func NewThrottle(cfg ThrottleConfig) *Throttle {
+	t := &Throttle{
+		Clock:     time.Now,
+		Sleep:     time.Sleep,
+		rate:      cfg.Rate,
+		meter:     &Meter{},
+		peers:     make(map[PeerID]*TokenBucket),
+		peerMeter: make(map[PeerID]*Meter),
+	}
+	t.global = t.newBucket(cfg.Rate)
+	for peer, rate := range cfg.PeerRates {
+		t.peers[peer] = t.newBucket(rate)
+	}
+	return t
+}
+
+// newBucket creates a TokenBucket using the Clock and Sleep of the Throttle, even if
+// they are changed later on.
+func (t *Throttle) newBucket(rate ByteSize) *TokenBucket {
+	return newTokenBucket(rate,
+		func() time.Time { return t.Clock() },
+		func(d time.Duration) { t.Sleep(d) })
+}
+
+// SetRate changes the global rate.
+func (t *Throttle) SetRate(rate ByteSize) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rate = rate
+	t.global.SetRate(t.effectiveRate())
+}
+
+// SetPeerRate changes the rate for a single peer.
+func (t *Throttle) SetPeerRate(peer PeerID, rate ByteSize) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if bucket, ok := t.peers[peer]; ok {
+		bucket.SetRate(rate)
+		return
+	}
+	t.peers[peer] = t.newBucket(rate)
+}
+
+// RemovePeer forgets the measured throughput of a peer which left the network. Its
+// configured rate is kept.
+func (t *Throttle) RemovePeer(peer PeerID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.peerMeter, peer)
+}
+
+// Reload applies the rates of cfg. Peers missing in cfg are no longer limited.
+func (t *Throttle) Reload(cfg ThrottleConfig) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rate = cfg.Rate
+	t.global.SetRate(t.effectiveRate())
+	for peer := range t.peers {
+		if _, ok := cfg.PeerRates[peer]; !ok {
+			delete(t.peers, peer)
+		}
+	}
+	for peer, rate := range cfg.PeerRates {
+		if bucket, ok := t.peers[peer]; ok {
+			bucket.SetRate(rate)
+		} else {
+			t.peers[peer] = t.newBucket(rate)
+		}
+	}
+}
+
+// effectiveRate returns the smaller one of the configured rate and the schedules bandwidth.
+// Must be called with t.mu held.
+func (t *Throttle) effectiveRate() ByteSize {
+	rate := t.rate
+	if scheduled := t.Schedule.Bandwidth(t.Clock()); scheduled > 0 && (rate == 0 || scheduled < rate) {
+		rate = scheduled
+	}
+	return rate
+}
+
+func (t *Throttle) wait(peer PeerID, n int) {
+	t.mu.Lock()
+	if rate := t.effectiveRate(); rate != t.global.Rate() {
+		t.global.SetRate(rate)
+	}
+	bucket := t.peers[peer]
+	var m *Meter
+	if peer != "" {
+		// Transfers of unknown peers only count towards the global rate.
+		var ok bool
+		if m, ok = t.peerMeter[peer]; !ok {
+			m = &Meter{}
+			t.peerMeter[peer] = m
+		}
+	}
+	t.mu.Unlock()
+
+	if bucket != nil {
+		bucket.Wait(n)
+	}
+	t.global.Wait(n)
+	t.meter.Add(n)
+	if m != nil {
+		m.Add(n)
+	}
+}
+
+// Reader returns a reader limiting reading from r to the rates for peer.
+func (t *Throttle) Reader(peer PeerID, r io.Reader) io.Reader {
+	return &throttledReader{t, peer, r}
+}
+
+// Writer returns a writer limiting writing to w to the rates for peer.
+func (t *Throttle) Writer(peer PeerID, w io.Writer) io.Writer {
+	return &throttledWriter{t, peer, w}
+}
+
+// ThrottleStats reports the configured rates and measured throughput in bytes per second.
+type ThrottleStats struct {
+	Rate       ByteSize                     `json:"rate"`
+	Scheduled  ByteSize                     `json:"scheduled"`
+	Throughput ByteSize                     `json:"throughput"`
+	Total      uint64                       `json:"total"`
+	Peers      map[PeerID]PeerThrottleStats `json:"peers"`
+}
+
+// PeerThrottleStats reports the configured rate and measured throughput for a single peer.
+type PeerThrottleStats struct {
+	Rate       ByteSize `json:"rate"`
+	Throughput ByteSize `json:"throughput"`
+	Total      uint64   `json:"total"`
+}
+
+// Stats returns the current rates and throughput.
+func (t *Throttle) Stats() ThrottleStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := ThrottleStats{
+		Rate:       t.rate,
+		Scheduled:  t.Schedule.Bandwidth(t.Clock()),
+		Throughput: t.meter.Rate(),
+		Total:      t.meter.Total(),
+		Peers:      make(map[PeerID]PeerThrottleStats),
+	}
+	for peer, bucket := range t.peers {
+		stats.Peers[peer] = PeerThrottleStats{Rate: bucket.Rate()}
+	}
+	for peer, m := range t.peerMeter {
+		s := stats.Peers[peer]
+		s.Throughput = m.Rate()
+		s.Total = m.Total()
+		stats.Peers[peer] = s
+	}
+	return stats
+}
+
+type throttledReader struct {
+	t    *Throttle
+	peer PeerID
+	r    io.Reader
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunkSize {
+		p = p[:throttleChunkSize]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.t.wait(r.peer, n)
+	}
+	return n, err
+}
+
+type throttledWriter struct {
+	t    *Throttle
+	peer PeerID
+	w    io.Writer
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > throttleChunkSize {
+			chunk = chunk[:throttleChunkSize]
+		}
+		w.t.wait(w.peer, len(chunk))
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// throttledResponseWriter limits the body written to an http.ResponseWriter.
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	body io.Writer
+}
+
+func (w *throttledResponseWriter) Write(p []byte) (int, error) {
+	return w.body.Write(p)
+}
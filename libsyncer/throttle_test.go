@@ -0,0 +1,119 @@
+package libsyncer
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// testClock is a Clock that only advances while sleeping.
+type testClock struct {
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *testClock) Now() time.Time { return c.now }
+
+func (c *testClock) Sleep(d time.Duration) {
+	c.now = c.now.Add(d)
+	c.slept += d
+}
+
+func TestTokenBucket(t *testing.T) {
+	c := &testClock{now: time.Now()}
+	b := newTokenBucket(100, c.Now, c.Sleep)
+
+	for _, step := range []struct {
+		name  string
+		idle  time.Duration
+		n     int
+		slept time.Duration
+	}{
+		{"burst", 0, 100, 0},
+		{"rate", 0, 50, 500 * time.Millisecond},
+		{"rate", 0, 100, 1500 * time.Millisecond},
+		// The bucket holds at most one second worth of bytes.
+		{"burst after idle", 10 * time.Second, 100, 1500 * time.Millisecond},
+		{"rate after idle", 0, 100, 2500 * time.Millisecond},
+	} {
+		c.now = c.now.Add(step.idle)
+		b.Wait(step.n)
+		if c.slept != step.slept {
+			t.Fatalf("%s: expected to sleep %v, got %v", step.name, step.slept, c.slept)
+		}
+	}
+
+	// Lowering the rate also limits the burst.
+	b.SetRate(10)
+	c.now = c.now.Add(time.Minute)
+	b.Wait(20)
+	if c.slept != 3500*time.Millisecond {
+		t.Fatalf("Expected to sleep 3.5s, got %v", c.slept)
+	}
+
+	b.SetRate(0)
+	b.Wait(1 << 30)
+	if c.slept != 3500*time.Millisecond {
+		t.Fatalf("Expected no limit, slept %v", c.slept)
+	}
+}
+
+func TestThrottleReload(t *testing.T) {
+	throttle := NewThrottle(ThrottleConfig{Rate: 64 << 10})
+	c := &testClock{now: time.Now()}
+	throttle.Clock = c.Now
+	throttle.Sleep = func(d time.Duration) {
+		c.Sleep(d)
+		if c.slept == time.Second {
+			throttle.Reload(ThrottleConfig{Rate: 128 << 10, PeerRates: map[PeerID]ByteSize{"peer": 32 << 10}})
+		}
+	}
+
+	// 512 KiB take 7s at 64 KiB/s. After one second the rate is doubled, so the
+	// remaining 384 KiB take 3s.
+	if _, err := throttle.Writer("other", ioutil.Discard).Write(make([]byte, 512<<10)); err != nil {
+		t.Fatal(err)
+	}
+	if c.slept != 4*time.Second {
+		t.Fatalf("Expected to sleep 4s, got %v", c.slept)
+	}
+	if stats := throttle.Stats(); stats.Rate != 128<<10 || stats.Peers["peer"].Rate != 32<<10 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+
+	// The peer is limited below the global rate.
+	c.slept = 0
+	throttle.Writer("peer", ioutil.Discard).Write(make([]byte, 64<<10))
+	if c.slept != time.Second {
+		t.Fatalf("Expected to sleep 1s, got %v", c.slept)
+	}
+
+	// Peers missing in the config are no longer limited.
+	c.now = c.now.Add(time.Minute)
+	c.slept = 0
+	throttle.Reload(ThrottleConfig{})
+	throttle.Writer("peer", ioutil.Discard).Write(make([]byte, 1<<20))
+	if c.slept != 0 {
+		t.Fatalf("Expected no limit, slept %v", c.slept)
+	}
+}
+
+func TestThrottlePeers(t *testing.T) {
+	throttle := NewThrottle(ThrottleConfig{PeerRates: map[PeerID]ByteSize{"pi1": 1 << 20}})
+	throttle.Writer("", ioutil.Discard).Write(make([]byte, 10))
+	throttle.Writer("pi1", ioutil.Discard).Write(make([]byte, 10))
+	throttle.Writer("pi2", ioutil.Discard).Write(make([]byte, 10))
+
+	stats := throttle.Stats()
+	if stats.Total != 30 || len(stats.Peers) != 2 || stats.Peers["pi2"].Total != 10 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+
+	// Peers which left are forgotten, their configured rates are kept.
+	throttle.RemovePeer("pi1")
+	throttle.RemovePeer("pi2")
+	stats = throttle.Stats()
+	if len(stats.Peers) != 1 || stats.Peers["pi1"] != (PeerThrottleStats{Rate: 1 << 20}) {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+}
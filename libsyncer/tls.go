@@ -0,0 +1,124 @@
+package libsyncer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// TLSConfig configures HTTPS for the FileServer and the clients talking to other FileServers.
+// All peers use certificates signed by a cluster CA. The certificate of a peer must be issued
+// for its peer name.
+type TLSConfig struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// Enabled returns true if a certificate is configured.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+func (c TLSConfig) load() (tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return cert, nil, err
+	}
+
+	ca, err := ioutil.ReadFile(c.CAFile)
+	if err != nil {
+		return cert, nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return cert, nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+	}
+	return cert, pool, nil
+}
+
+// ServerConfig returns a tls.Config for a server, requiring clients to present a
+// certificate signed by the CA.
+func (c TLSConfig) ServerConfig() (*tls.Config, error) {
+	cert, pool, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ClientConfig returns a tls.Config for a client, presenting the local certificate and
+// requiring a server certificate signed by the CA.
+func (c TLSConfig) ClientConfig() (*tls.Config, error) {
+	cert, pool, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// PeerClients provides http.Clients for talking to the FileServers of other peers.
+// With TLS enabled, each client presents the local certificate and verifies that the
+// server certificate is signed by the CA and issued for the expected peer.
+// A nil PeerClients uses http.DefaultClient.
+type PeerClients struct {
+	cert tls.Certificate
+	pool *x509.CertPool
+
+	mu      sync.Mutex
+	clients map[PeerID]*http.Client
+}
+
+// NewPeerClients returns the PeerClients for the given config, or nil if TLS is disabled.
+func NewPeerClients(cfg TLSConfig) (*PeerClients, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+	cert, pool, err := cfg.load()
+	if err != nil {
+		return nil, err
+	}
+	return &PeerClients{
+		cert:    cert,
+		pool:    pool,
+		clients: make(map[PeerID]*http.Client),
+	}, nil
+}
+
+// Client returns the http.Client for talking to peer.
+func (c *PeerClients) Client(peer PeerID) *http.Client {
+	if c == nil {
+		return http.DefaultClient
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	client, ok := c.clients[peer]
+	if !ok {
+		client = &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{
+					Certificates: []tls.Certificate{c.cert},
+					RootCAs:      c.pool,
+					ServerName:   string(peer),
+					MinVersion:   tls.VersionTLS12,
+				},
+			},
+		}
+		c.clients[peer] = client
+	}
+	return client
+}
@@ -0,0 +1,82 @@
+package libsyncer
+
+import (
+	"fmt"
+	"time"
+)
+
+// TrashDir is the directory of a volume keeping the files deleted after transfers.
+const TrashDir = ".mediasyncer-trash"
+
+// TrashConfig limits how long and how many deleted files are kept in the trash.
+type TrashConfig struct {
+	// Retention is how long files are kept. 0 disables the trash, files are deleted
+	// immediately.
+	Retention time.Duration
+
+	// MaxSize is the size of the trash, above which the oldest files are purged. 0 is unlimited.
+	MaxSize ByteSize
+}
+
+// DefaultTrashConfig keeps deleted files for a week.
+var DefaultTrashConfig = TrashConfig{Retention: 7 * 24 * time.Hour}
+
+// TrashEntry is a file in the trash of a volume.
+type TrashEntry struct {
+	// ID identifies the entry within the trash of the volume.
+	ID string
+
+	// Path is the path the file is restored to.
+	Path    string
+	Size    ByteSize
+	Deleted time.Time
+}
+
+// Trasher is implemented by volumes which can keep deleted files in a trash. The trash
+// doesn't count as used space: it is purged when space is needed.
+type Trasher interface {
+	// Trash moves the file at path into the trash.
+	Trash(path string) error
+
+	// TrashEntries returns the files in the trash, oldest first.
+	TrashEntries() ([]TrashEntry, error)
+
+	// Restore moves a file out of the trash to its original path, which is returned.
+	Restore(id string) (string, error)
+
+	// Purge deletes the files older than the retention period and the oldest files until
+	// the trash fits its size limit and need bytes are available outside of the trash.
+	Purge(need ByteSize) error
+}
+
+// TrashFile moves the file into the trash of vol, if vol is a Trasher, and deletes it otherwise.
+func TrashFile(vol Volume, path string) error {
+	if t, ok := vol.(Trasher); ok {
+		return t.Trash(path)
+	}
+	return vol.Delete(path)
+}
+
+// MakeRoom purges the trash of vol, if any, until size bytes can be written.
+func MakeRoom(vol Volume, size ByteSize) error {
+	if t, ok := vol.(Trasher); ok {
+		return t.Purge(size)
+	}
+	return nil
+}
+
+// ListTrash returns the files in the trash of vol.
+func ListTrash(vol Volume) ([]TrashEntry, error) {
+	if t, ok := vol.(Trasher); ok {
+		return t.TrashEntries()
+	}
+	return nil, nil
+}
+
+// RestoreFile moves a file out of the trash of vol and returns its path.
+func RestoreFile(vol Volume, id string) (string, error) {
+	if t, ok := vol.(Trasher); ok {
+		return t.Restore(id)
+	}
+	return "", fmt.Errorf("volume %s has no trash", vol.ID())
+}
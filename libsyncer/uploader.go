@@ -1,44 +1,158 @@
 package libsyncer
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"time"
 )
 
+// RetryPolicy defines how often and how fast failed uploads are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts, including the first one.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry. It doubles with each retry
+	// up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy tries an upload 5 times within roughly 30 seconds.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 2 * time.Second,
+	MaxBackoff:     15 * time.Second,
+}
+
+// UploadResult reports the outcome of an upload. Err is nil if the upload succeeded.
+type UploadResult struct {
+	File FileID
+	Peer PeerID
+	Err  error
+}
+
+// UploadError describes why an upload failed.
+type UploadError struct {
+	// Op is the step that failed: read, request or upload.
+	Op string
+
+	// StatusCode is the HTTP status returned by the peer, if any.
+	StatusCode int
+
+	// Temporary is true if retrying the upload may succeed.
+	Temporary bool
+
+	Err error
+}
+
+func (e *UploadError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("%s failed: %s", e.Op, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("%s failed: %v", e.Op, e.Err)
+}
+
 type Uploader struct {
-	Volume Volume
+	Volumes  Volumes
+	Throttle *Throttle
+	Retry    RetryPolicy
+	Clients  *PeerClients
+
+	// Name is the local peer, sent along with uploads.
+	Name PeerID
+
+	// After waits between attempts. Defaults to time.After.
+	After func(d time.Duration) <-chan time.Time
 }
 
-func (u *Uploader) Upload(file FileID, peer PeerID, uploadURL string, done chan<- FileID) {
+// Upload sends the file to the peer via a PUT request to uploadURL and reports the result
+// on results. Temporary errors are retried according to the RetryPolicy. Cancelling ctx,
+// e.g. because the peer left the network, aborts the upload.
+func (u *Uploader) Upload(ctx context.Context, file FileID, peer PeerID, uploadURL string, results chan<- UploadResult) {
 	log.Printf("Uploading file %s to %s\n", file, peer)
 
-	if u.Volume.ID() != file.VolumeID {
-		panic("Uploading invalid volume-id!")
+	backoff := u.Retry.InitialBackoff
+	var err *UploadError
+	for attempt := 1; ; attempt++ {
+		err = u.upload(ctx, file, peer, uploadURL)
+		if err == nil || !err.Temporary || attempt >= u.Retry.MaxAttempts {
+			break
+		}
+
+		log.Printf("%s: attempt %d failed, retrying in %v: %v\n", file, attempt, backoff, err)
+		after := u.After
+		if after == nil {
+			after = time.After
+		}
+		select {
+		case <-after(backoff):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			err = &UploadError{Op: "upload", Err: ctx.Err()}
+			break
+		}
+		backoff *= 2
+		if backoff > u.Retry.MaxBackoff {
+			backoff = u.Retry.MaxBackoff
+		}
+	}
+
+	if err != nil {
+		log.Printf("%s: upload to %s failed: %v\n", file, peer, err)
+		results <- UploadResult{file, peer, err}
+		return
+	}
+	results <- UploadResult{file, peer, nil}
+}
+
+func (u *Uploader) upload(ctx context.Context, file FileID, peer PeerID, uploadURL string) *UploadError {
+	vol := u.Volumes.Get(file.VolumeID)
+	if vol == nil {
+		return &UploadError{Op: "read", Err: fmt.Errorf("invalid volume-id %s", file.VolumeID)}
 	}
 
-	reader, err := u.Volume.Read(file.Path)
+	reader, err := vol.Read(file.Path)
 	if err != nil {
-		panic("Cannot read file: " + err.Error())
+		return &UploadError{Op: "read", Err: err}
 	}
 	if closer, ok := reader.(io.Closer); ok {
 		defer closer.Close()
 	}
-
-	req, err := http.NewRequest("PUT", uploadURL, reader)
+	info, err := vol.Stat(file.Path)
+	if err != nil {
+		return &UploadError{Op: "read", Err: err}
+	}
+	meta, err := ReadMeta(vol, file.Path)
 	if err != nil {
-		panic("Failed to build request: " + err.Error())
+		return &UploadError{Op: "read", Err: err}
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	req, err := http.NewRequest("PUT", uploadURL, u.Throttle.Reader(peer, reader))
 	if err != nil {
-		panic("Failed to upload " + file.String() + ": " + err.Error())
+		return &UploadError{Op: "request", Err: err}
 	}
-	defer resp.Body.Close()
+	req = req.WithContext(ctx)
+	req.ContentLength = info.Size()
+	req.Header.Set(PeerHeader, string(u.Name))
+	meta.SetHeader(req.Header)
 
-	if resp.StatusCode == http.StatusCreated {
-		done <- file
+	resp, err := u.Clients.Client(peer).Do(req)
+	if err != nil {
+		return &UploadError{Op: "upload", Temporary: ctx.Err() == nil, Err: err}
 	}
+	defer resp.Body.Close()
 
 	log.Println(file.String() + ": " + resp.Status)
+	if resp.StatusCode != http.StatusCreated {
+		return &UploadError{
+			Op:         "upload",
+			StatusCode: resp.StatusCode,
+			Temporary:  resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests,
+		}
+	}
+	return nil
 }
@@ -0,0 +1,115 @@
+package libsyncer
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testUploadServer fails the first failures requests with status and records the bodies.
+type testUploadServer struct {
+	failures int
+	status   int
+	bodies   []string
+}
+
+func (s *testUploadServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	s.bodies = append(s.bodies, string(body))
+	if len(s.bodies) <= s.failures {
+		w.WriteHeader(s.status)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func TestUploaderRetry(t *testing.T) {
+	vol := newTestVolume("v", 1000)
+	vol.files["a"] = []byte("hello")
+	file := FileID{VolumeID: "v", Path: "a"}
+
+	for _, c := range []struct {
+		name     string
+		failures int
+		status   int
+
+		attempts  int
+		backoffs  []time.Duration
+		ok        bool
+		temporary bool
+	}{
+		{"success", 0, 0, 1, nil, true, false},
+		{"temporary failures", 2, http.StatusServiceUnavailable, 3, []time.Duration{1 * time.Second, 2 * time.Second}, true, false},
+		{"backoff limit", 4, http.StatusInternalServerError, 5, []time.Duration{1 * time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}, true, false},
+		{"too many failures", 10, http.StatusTooManyRequests, 5, []time.Duration{1 * time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}, false, true},
+		{"permanent failure", 10, http.StatusForbidden, 1, nil, false, false},
+	} {
+		handler := &testUploadServer{failures: c.failures, status: c.status}
+		server := httptest.NewServer(handler)
+
+		var backoffs []time.Duration
+		u := &Uploader{
+			Volumes:  Volumes{vol},
+			Throttle: NewThrottle(ThrottleConfig{}),
+			Retry:    RetryPolicy{MaxAttempts: 5, InitialBackoff: 1 * time.Second, MaxBackoff: 3 * time.Second},
+			Name:     "local",
+			After: func(d time.Duration) <-chan time.Time {
+				backoffs = append(backoffs, d)
+				ch := make(chan time.Time, 1)
+				ch <- time.Now()
+				return ch
+			},
+		}
+		results := make(chan UploadResult, 1)
+		u.Upload(context.Background(), file, "peer", server.URL, results)
+		server.Close()
+		result := <-results
+
+		if (result.Err == nil) != c.ok {
+			t.Errorf("%s: unexpected result %v", c.name, result.Err)
+		}
+		if err, ok := result.Err.(*UploadError); ok && (err.Temporary != c.temporary || err.StatusCode != c.status) {
+			t.Errorf("%s: unexpected error %+v", c.name, err)
+		}
+		if len(handler.bodies) != c.attempts {
+			t.Errorf("%s: expected %d attempts, got %d", c.name, c.attempts, len(handler.bodies))
+		}
+		// Each attempt reads the file again.
+		for _, body := range handler.bodies {
+			if body != "hello" {
+				t.Errorf("%s: unexpected body %q", c.name, body)
+			}
+		}
+		if !reflect.DeepEqual(backoffs, c.backoffs) {
+			t.Errorf("%s: expected backoffs %v, got %v", c.name, c.backoffs, backoffs)
+		}
+	}
+}
+
+func TestUploaderCancel(t *testing.T) {
+	vol := newTestVolume("v", 1000)
+	vol.files["a"] = []byte("hello")
+	server := httptest.NewServer(&testUploadServer{failures: 10, status: http.StatusBadGateway})
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	u := &Uploader{
+		Volumes:  Volumes{vol},
+		Throttle: NewThrottle(ThrottleConfig{}),
+		Retry:    RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Hour, MaxBackoff: time.Hour},
+		After: func(d time.Duration) <-chan time.Time {
+			cancel()
+			return nil
+		},
+	}
+	results := make(chan UploadResult, 1)
+	u.Upload(ctx, FileID{VolumeID: "v", Path: "a"}, "peer", server.URL, results)
+	result := <-results
+	if err, ok := result.Err.(*UploadError); !ok || err.Err != context.Canceled {
+		t.Fatalf("Expected the upload to be cancelled, got %v", result.Err)
+	}
+}
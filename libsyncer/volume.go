@@ -1,14 +1,17 @@
 package libsyncer
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 type Volume interface {
 	ID() string
 	AvailableBytes() uint64
+	Capacity() uint64
 	Walk(f filepath.WalkFunc) error
 
 	Stat(path string) (os.FileInfo, error)
@@ -16,3 +19,66 @@ type Volume interface {
 	Write(path string) (io.WriteCloser, error)
 	Delete(path string) error
 }
+
+// Renamer is implemented by volumes which can rename a file within the volume. An existing
+// file at the new path is replaced.
+type Renamer interface {
+	Rename(from, to string) error
+}
+
+// RenameFile renames the file at from to to, replacing an existing file. The file is copied
+// and deleted afterwards, if vol is not a Renamer.
+func RenameFile(vol Volume, from, to string) error {
+	if r, ok := vol.(Renamer); ok {
+		return r.Rename(from, to)
+	}
+
+	reader, err := vol.Read(from)
+	if err != nil {
+		return err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	writer, err := vol.Write(to)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, reader)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return vol.Delete(from)
+}
+
+// Watcher is implemented by volumes which can report changes of their files.
+type Watcher interface {
+	// Watch calls changed with the path of each created, written or removed file or
+	// directory until stop is closed. If changes were lost, rescan is called.
+	Watch(stop <-chan struct{}, changed func(path string), rescan func()) error
+}
+
+// Watch watches vol, if it is a Watcher.
+func Watch(vol Volume, stop <-chan struct{}, changed func(path string), rescan func()) error {
+	w, ok := vol.(Watcher)
+	if !ok {
+		return fmt.Errorf("volume %s can't be watched", vol.ID())
+	}
+	return w.Watch(stop, changed, rescan)
+}
+
+// LastWrite returns when the file at path was written last: its ModTime or the last
+// write observed while watching the volume, whichever is later. Files being written,
+// e.g. by a download client preserving the original ModTime, are detected this way.
+func LastWrite(vol Volume, path string, info os.FileInfo) time.Time {
+	t := info.ModTime()
+	if v, ok := vol.(interface{ LastWrite(string) time.Time }); ok {
+		if observed := v.LastWrite(path); observed.After(t) {
+			return observed
+		}
+	}
+	return t
+}
@@ -0,0 +1,273 @@
+package libsyncer
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// Volumes are all volumes of a node.
+type Volumes []Volume
+
+// Get returns the volume with the given ID or nil, if the node has no such volume.
+func (vols Volumes) Get(id string) Volume {
+	for _, vol := range vols {
+		if vol.ID() == id {
+			return vol
+		}
+	}
+	return nil
+}
+
+// IDs returns the IDs of all volumes.
+func (vols Volumes) IDs() []string {
+	ids := make([]string, len(vols))
+	for i, vol := range vols {
+		ids[i] = vol.ID()
+	}
+	return ids
+}
+
+// Stat returns the volume containing path, if any.
+func (vols Volumes) Stat(path string) (Volume, os.FileInfo, error) {
+	for _, vol := range vols {
+		info, err := vol.Stat(path)
+		if err == nil {
+			return vol, info, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, nil, err
+		}
+	}
+	return nil, nil, os.ErrNotExist
+}
+
+// VolumeConfig configures a volume of a node.
+type VolumeConfig struct {
+	Volume Volume
+
+	// PriceFormula prices the files of this volume. Defaults to Config.PriceFormula.
+	PriceFormula PriceFormula
+
+	// HighWatermark is the fraction of the capacity the volume is filled up to by won
+	// auctions. Above it, files are moved to other local volumes. 0 disables the limit.
+	HighWatermark float64
+
+	// LowWatermark is the fraction a volume is drained to when it is above the HighWatermark.
+	// Other volumes receive files as long as they stay below their LowWatermark.
+	// Defaults to the HighWatermark.
+	LowWatermark float64
+}
+
+func (cfg VolumeConfig) high() float64 {
+	if cfg.HighWatermark <= 0 {
+		return 1
+	}
+	return cfg.HighWatermark
+}
+
+func (cfg VolumeConfig) low() float64 {
+	if cfg.LowWatermark <= 0 {
+		return cfg.high()
+	}
+	return cfg.LowWatermark
+}
+
+// fill returns the fraction of the volume used after adding size bytes.
+func (cfg VolumeConfig) fill(size ByteSize) float64 {
+	capacity := cfg.Volume.Capacity()
+	if capacity == 0 {
+		return 1
+	}
+	used := capacity - cfg.Volume.AvailableBytes()
+	return float64(uint64(size)+used) / float64(capacity)
+}
+
+// Mover is implemented by volumes which can move a file to another volume cheaper than
+// copying it, e.g. by renaming it on the same filesystem. Move returns an error, if
+// it can't move the file to the given volume.
+type Mover interface {
+	Move(path string, to Volume) error
+}
+
+// MoveFile moves the file at path from one volume to another. The file is renamed if the
+// source volume supports it, otherwise it is copied and deleted afterwards.
+func MoveFile(path string, from, to Volume) error {
+	if _, err := to.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists on volume %s", path, to.ID())
+	}
+	if mover, ok := from.(Mover); ok {
+		if err := mover.Move(path, to); err == nil {
+			return nil
+		}
+	}
+
+	info, err := from.Stat(path)
+	if err != nil {
+		return err
+	}
+	meta, err := ReadMeta(from, path)
+	if err != nil {
+		return err
+	}
+	reader, err := from.Read(path)
+	if err != nil {
+		return err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	if err := MakeRoom(to, ByteSize(info.Size())); err != nil {
+		return err
+	}
+	writer, err := to.Write(path)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(writer, reader)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n != info.Size() {
+		err = fmt.Errorf("expected %d bytes, copied %d", info.Size(), n)
+	}
+	if err != nil {
+		to.Delete(path)
+		return err
+	}
+	if err := WriteMeta(to, path, meta); err != nil {
+		log.Println("ERROR: Failed to restore metadata of " + path + ": " + err.Error())
+	}
+	return from.Delete(path)
+}
+
+// The Rebalancer moves files between the local volumes of a node. Files are moved away
+// from volumes above their HighWatermark to the volume pricing them highest, until the
+// volume is below its LowWatermark. Volumes being drained are emptied completely.
+type Rebalancer struct {
+	Volumes []VolumeConfig
+	Pricing map[string]*Pricing
+	Ticker  *time.Ticker
+
+	// Name is the local peer, passed to the PriceFormulas.
+	Name PeerID
+
+	// Busy reports files which must not be moved, e.g. because they are being uploaded.
+	Busy func(file FileID) bool
+
+	// Draining reports volumes being drained, which don't take files.
+	Draining func(volume string) bool
+
+	reloads chan []VolumeConfig
+	stop    chan struct{}
+}
+
+// NewRebalancer creates a Rebalancer checking the volumes every minute.
+func NewRebalancer(name PeerID, vols []VolumeConfig, pricing map[string]*Pricing) *Rebalancer {
+	return &Rebalancer{
+		Name:    name,
+		Volumes: vols,
+		Pricing: pricing,
+		Ticker:  time.NewTicker(1 * time.Minute),
+		reloads: make(chan []VolumeConfig),
+		stop:    make(chan struct{}),
+	}
+}
+
+func (r *Rebalancer) Serve() {
+	for {
+		select {
+		case <-r.Ticker.C:
+			r.Rebalance()
+		case vols := <-r.reloads:
+			r.Volumes = vols
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Reload replaces the watermarks of the volumes. The volumes must be the ones the Rebalancer
+// was created with.
+func (r *Rebalancer) Reload(vols []VolumeConfig) {
+	select {
+	case r.reloads <- vols:
+	case <-r.stop:
+	}
+}
+
+func (r *Rebalancer) Stop() {
+	r.Ticker.Stop()
+	close(r.stop)
+}
+
+// Rebalance drains all volumes above their HighWatermark or being drained.
+func (r *Rebalancer) Rebalance() {
+	for _, src := range r.Volumes {
+		if src.fill(0) <= src.high() && !r.draining(src.Volume) {
+			continue
+		}
+		r.drain(src)
+	}
+}
+
+func (r *Rebalancer) draining(vol Volume) bool {
+	return r.Draining != nil && r.Draining(vol.ID())
+}
+
+func (r *Rebalancer) drain(src VolumeConfig) {
+	var moves []FileID
+	src.Volume.Walk(func(path string, info os.FileInfo, err error) error {
+		if LastWrite(src.Volume, path, info).After(time.Now().Add(-1 * time.Hour)) {
+			// Might still be written, like files being downloaded.
+			return nil
+		}
+		file := FileID{VolumeID: src.Volume.ID(), Path: path}
+		if r.Busy != nil && r.Busy(file) {
+			return nil
+		}
+		moves = append(moves, file)
+		return nil
+	})
+
+	for _, file := range moves {
+		if src.fill(0) <= src.low() && !r.draining(src.Volume) {
+			return
+		}
+		info, err := src.Volume.Stat(file.Path)
+		if err != nil {
+			continue
+		}
+		t := info.ModTime()
+		stats := FileStats{Size: ByteSize(info.Size()), ModTime: &t}
+
+		dst := r.target(src, file, stats)
+		if dst == nil {
+			continue
+		}
+		log.Printf("Moving %s to volume %s\n", file, dst.ID())
+		if err := MoveFile(file.Path, src.Volume, dst); err != nil {
+			log.Println("ERROR: Failed to move " + file.String() + ": " + err.Error())
+		}
+	}
+}
+
+// target returns the volume pricing the file highest, which stays below its LowWatermark
+// when storing the file.
+func (r *Rebalancer) target(src VolumeConfig, file FileID, stats FileStats) Volume {
+	var best Volume
+	bestPrice := Price(-1)
+	for _, dst := range r.Volumes {
+		if dst.Volume.ID() == src.Volume.ID() || dst.fill(stats.Size) > dst.low() || Ignored(dst.Volume, file.Path) || r.draining(dst.Volume) {
+			continue
+		}
+		pricing := r.Pricing[dst.Volume.ID()]
+		price := pricing.Price(pricing.Context(r.Name, ""), file, stats)
+		if price > bestPrice {
+			best, bestPrice = dst.Volume, price
+		}
+	}
+	return best
+}
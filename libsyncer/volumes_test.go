@@ -0,0 +1,174 @@
+package libsyncer
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testVolume keeps files in memory.
+type testVolume struct {
+	id       string
+	capacity uint64
+	files    map[string][]byte
+}
+
+func newTestVolume(id string, capacity uint64) *testVolume {
+	return &testVolume{id, capacity, make(map[string][]byte)}
+}
+
+// testModTime is the modification time of all files of a testVolume.
+var testModTime = time.Now().Add(-24 * time.Hour)
+
+type testFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi testFileInfo) Name() string       { return fi.name }
+func (fi testFileInfo) Size() int64        { return fi.size }
+func (fi testFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi testFileInfo) ModTime() time.Time { return testModTime }
+func (fi testFileInfo) IsDir() bool        { return false }
+func (fi testFileInfo) Sys() interface{}   { return nil }
+
+type testWriter struct {
+	bytes.Buffer
+	v    *testVolume
+	path string
+}
+
+func (w *testWriter) Close() error {
+	w.v.files[w.path] = w.Bytes()
+	return nil
+}
+
+func (v *testVolume) ID() string       { return v.id }
+func (v *testVolume) Capacity() uint64 { return v.capacity }
+func (v *testVolume) AvailableBytes() uint64 {
+	free := v.capacity
+	for _, data := range v.files {
+		free -= uint64(len(data))
+	}
+	return free
+}
+
+func (v *testVolume) Walk(f filepath.WalkFunc) error {
+	var paths []string
+	for path := range v.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		info, _ := v.Stat(path)
+		if err := f(path, info, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *testVolume) Stat(path string) (os.FileInfo, error) {
+	data, ok := v.files[path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return testFileInfo{path, int64(len(data))}, nil
+}
+
+func (v *testVolume) Read(path string) (io.ReadSeeker, error) {
+	data, ok := v.files[path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return bytes.NewReader(data), nil
+}
+
+func (v *testVolume) Write(path string) (io.WriteCloser, error) {
+	return &testWriter{v: v, path: path}, nil
+}
+
+func (v *testVolume) Delete(path string) error {
+	if _, ok := v.files[path]; !ok {
+		return os.ErrNotExist
+	}
+	delete(v.files, path)
+	return nil
+}
+
+func TestMoveFile(t *testing.T) {
+	a, b := newTestVolume("a", 100), newTestVolume("b", 100)
+	a.files["x"] = []byte("hello")
+
+	if err := MoveFile("x", a, b); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := a.files["x"]; ok {
+		t.Fatalf("File still exists on source volume")
+	}
+	if string(b.files["x"]) != "hello" {
+		t.Fatalf("Unexpected content %q", b.files["x"])
+	}
+
+	a.files["x"] = []byte("again")
+	if err := MoveFile("x", a, b); err == nil {
+		t.Fatalf("Expected an error when overwriting a file")
+	}
+}
+
+func TestRebalancer(t *testing.T) {
+	full, empty := newTestVolume("full", 100), newTestVolume("empty", 100)
+	for _, path := range []string{"1", "2", "3"} {
+		full.files[path] = make([]byte, 30)
+	}
+	vols := []VolumeConfig{
+		{Volume: full, HighWatermark: 0.8, LowWatermark: 0.5},
+		{Volume: empty, HighWatermark: 0.8, LowWatermark: 0.5},
+	}
+	pricing := map[string]*Pricing{}
+	for _, vol := range vols {
+		pricing[vol.Volume.ID()] = &Pricing{Formula: AdaptPriceFormula(PriceFormulaStatic(1)), Volume: vol.Volume}
+	}
+
+	r := NewRebalancer("local", vols, pricing)
+	r.Busy = func(file FileID) bool { return file.Path == "1" }
+	r.Rebalance()
+	r.Stop()
+
+	// Only one file fits below the LowWatermark of the empty volume, the busy file stays.
+	if len(full.files) != 2 || len(empty.files) != 1 {
+		t.Fatalf("Unexpected files: full=%d empty=%d", len(full.files), len(empty.files))
+	}
+	if _, ok := empty.files["2"]; !ok {
+		t.Fatalf("Expected file 2 to be moved")
+	}
+}
+
+func TestRebalancerDraining(t *testing.T) {
+	draining, other := newTestVolume("draining", 100), newTestVolume("other", 100)
+	for _, path := range []string{"1", "2"} {
+		draining.files[path] = make([]byte, 10)
+	}
+	vols := []VolumeConfig{
+		{Volume: draining, HighWatermark: 0.8, LowWatermark: 0.5},
+		{Volume: other, HighWatermark: 0.8, LowWatermark: 0.5},
+	}
+	pricing := map[string]*Pricing{}
+	for _, vol := range vols {
+		pricing[vol.Volume.ID()] = &Pricing{Formula: AdaptPriceFormula(PriceFormulaStatic(1)), Volume: vol.Volume}
+	}
+
+	r := NewRebalancer("local", vols, pricing)
+	r.Draining = func(volume string) bool { return volume == "draining" }
+	r.Rebalance()
+	r.Stop()
+
+	// The volume is emptied, although it is below its watermarks.
+	if len(draining.files) != 0 || len(other.files) != 2 {
+		t.Fatalf("Unexpected files: draining=%d other=%d", len(draining.files), len(other.files))
+	}
+}
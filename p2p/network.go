@@ -2,8 +2,12 @@
 package p2p
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/memberlist"
@@ -22,6 +26,9 @@ func PrintMessages(b bool) {
 
 type Callback func(peer string, messageType libsyncer.MessageType, message string)
 
+// PeerCallback is invoked for join, leave and update events of other peers.
+type PeerCallback func(event libsyncer.PeerEvent, peer string, meta libsyncer.NodeMeta)
+
 // Config defines the configuration for the network.
 type Config struct {
 	*memberlist.Config
@@ -32,16 +39,55 @@ func DefaultConfig() Config {
 	return Config{memberlist.DefaultLANConfig()}
 }
 
+// DecodeClusterKey decodes a base64 encoded key of 16, 24 or 32 bytes.
+func DecodeClusterKey(key string) ([]byte, error) {
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cluster key: %v", err)
+	}
+	if l := len(k); l != 16 && l != 24 && l != 32 {
+		return nil, fmt.Errorf("invalid cluster key: must be 16, 24 or 32 bytes, got %d", l)
+	}
+	return k, nil
+}
+
+// SetClusterKeys enables the encryption of all messages in the network. The first key is
+// used for encrypting, all keys are tried for decrypting. Unencrypted messages are rejected.
+//
+// To rotate the key, add the new key as a secondary key on all peers, make it the primary
+// key with MemberlistTransport.UseKey and finally remove the old key with RemoveKey.
+func (cfg Config) SetClusterKeys(keys [][]byte) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	keyring, err := memberlist.NewKeyring(keys[1:], keys[0])
+	if err != nil {
+		return err
+	}
+	cfg.Keyring = keyring
+	cfg.GossipVerifyIncoming = true
+	cfg.GossipVerifyOutgoing = true
+	return nil
+}
+
 // MemberlistTransport provides an implementation of libsyncer.Transport using Hashicorps Memberlist.
+// The cluster key is its only authentication: the sender of a message is not verified.
 type MemberlistTransport struct {
 	Memberlist  *memberlist.Memberlist
 	subscribers map[libsyncer.MessageType][]Callback
+	keyring     *memberlist.Keyring
+	delegate    *SyncerDelegate
+
+	peerMu          sync.Mutex
+	peerSubscribers []PeerCallback
 }
 
 func New(cfg Config) *MemberlistTransport {
 	sd := &SyncerDelegate{}
+	events := &peerEventDelegate{events: make(chan peerEvent, 256)}
 	var mlCfg *memberlist.Config = cfg.Config
 	mlCfg.Delegate = sd
+	mlCfg.Events = events
 	ml, err := memberlist.Create(mlCfg)
 	if err != nil {
 		panic(err.Error())
@@ -50,8 +96,11 @@ func New(cfg Config) *MemberlistTransport {
 	n := &MemberlistTransport{
 		Memberlist:  ml,
 		subscribers: make(map[libsyncer.MessageType][]Callback),
+		keyring:     mlCfg.Keyring,
+		delegate:    sd,
 	}
 	sd.Callback = n.receiveMessage
+	go n.dispatchPeerEvents(events.events)
 	return n
 }
 
@@ -68,6 +117,30 @@ func (n *MemberlistTransport) Join(peers []string) {
 	}
 }
 
+// InstallKey adds a key to decrypt messages with.
+func (n *MemberlistTransport) InstallKey(key []byte) error {
+	if n.keyring == nil {
+		return fmt.Errorf("encryption is not enabled")
+	}
+	return n.keyring.AddKey(key)
+}
+
+// UseKey makes an installed key the key to encrypt messages with.
+func (n *MemberlistTransport) UseKey(key []byte) error {
+	if n.keyring == nil {
+		return fmt.Errorf("encryption is not enabled")
+	}
+	return n.keyring.UseKey(key)
+}
+
+// RemoveKey removes a key which is not the primary key anymore.
+func (n *MemberlistTransport) RemoveKey(key []byte) error {
+	if n.keyring == nil {
+		return fmt.Errorf("encryption is not enabled")
+	}
+	return n.keyring.RemoveKey(key)
+}
+
 // Leave shuts down the current Transport.
 func (n *MemberlistTransport) Leave(timeout time.Duration) error {
 	n.Memberlist.Leave(timeout)
@@ -82,20 +155,22 @@ func (n *MemberlistTransport) Send(peer string, messageType libsyncer.MessageTyp
 		log.Printf("SENDING %s, %s:\t%s\n", peer, messageType, message)
 	}
 
-	var peerNode *memberlist.Node
-	for _, member := range n.Memberlist.Members() {
-		if member.Name == peer {
-			peerNode = member
-			break
-		}
+	peerNode := n.member(peer)
+	if peerNode == nil {
+		return fmt.Errorf("unknown peer %s", peer)
 	}
 
 	self := n.Memberlist.LocalNode()
-	return n.Memberlist.SendToTCP(peerNode, n.serializeMessage(self.Name, messageType, message))
+	data := n.serializeMessage(self.Name, messageType, message)
+	if len(data) > libsyncer.MaxMessageSize {
+		return fmt.Errorf("%s message exceeds %d bytes", messageType, libsyncer.MaxMessageSize)
+	}
+	return n.Memberlist.SendReliable(peerNode, data)
 }
 
-// BroadcastTCP sends a message to each peer in the network, aborting on the first error.
-// This message can reach, 0, all or any number of members.
+// BroadcastTCP sends a message to each peer in the network over TCP. The peers are
+// contacted concurrently and a failure for one peer does not stop the broadcast to the
+// others. All failures are returned as a *libsyncer.BroadcastError.
 func (n *MemberlistTransport) BroadcastTCP(messageType libsyncer.MessageType, message string) error {
 	if printMessages {
 		log.Printf("BROADCAST %s:\t%s\n", messageType, message)
@@ -103,18 +178,117 @@ func (n *MemberlistTransport) BroadcastTCP(messageType libsyncer.MessageType, me
 
 	self := n.Memberlist.LocalNode()
 	data := n.serializeMessage(self.Name, messageType, message)
+	if len(data) > libsyncer.MaxMessageSize {
+		return fmt.Errorf("%s message exceeds %d bytes", messageType, libsyncer.MaxMessageSize)
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		errors = make(map[string]error)
+	)
 	for _, member := range n.Memberlist.Members() {
-		if member == self {
+		if member.Name == self.Name {
 			continue
 		}
 
-		if err := n.Memberlist.SendToUDP(member, data); err != nil {
-			return err
-		}
+		wg.Add(1)
+		go func(member *memberlist.Node) {
+			defer wg.Done()
+			if err := n.Memberlist.SendReliable(member, data); err != nil {
+				mu.Lock()
+				errors[member.Name] = err
+				mu.Unlock()
+			}
+		}(member)
+	}
+	wg.Wait()
+
+	if len(errors) > 0 {
+		return &libsyncer.BroadcastError{Errors: errors}
 	}
 	return nil
 }
 
+// SetMeta updates the metadata advertised for the local node. If the encoded metadata
+// exceeds the size limit of memberlist, labels and volumes are dropped.
+func (n *MemberlistTransport) SetMeta(meta libsyncer.NodeMeta) error {
+	data, err := encodeMeta(meta, memberlist.MetaMaxSize)
+	if err != nil {
+		return err
+	}
+	n.delegate.setMeta(data)
+	return n.Memberlist.UpdateNode(10 * time.Second)
+}
+
+func encodeMeta(meta libsyncer.NodeMeta, limit int) ([]byte, error) {
+	for {
+		data, err := json.Marshal(meta)
+		if err != nil || len(data) <= limit {
+			return data, err
+		}
+
+		switch {
+		case len(meta.Labels) > 0:
+			meta.Labels = meta.Labels[:len(meta.Labels)-1]
+		case len(meta.Volumes) > 0:
+			meta.Volumes = meta.Volumes[:len(meta.Volumes)-1]
+		default:
+			return nil, fmt.Errorf("node metadata exceeds %d bytes", limit)
+		}
+	}
+}
+
+// Peers returns the metadata of all other peers in the network.
+func (n *MemberlistTransport) Peers() map[string]libsyncer.NodeMeta {
+	self := n.Memberlist.LocalNode()
+	peers := make(map[string]libsyncer.NodeMeta)
+	for _, member := range n.Memberlist.Members() {
+		if member.Name == self.Name {
+			continue
+		}
+		peers[member.Name] = decodeMeta(member)
+	}
+	return peers
+}
+
+func decodeMeta(node *memberlist.Node) libsyncer.NodeMeta {
+	var meta libsyncer.NodeMeta
+	if len(node.Meta) > 0 {
+		if err := json.Unmarshal(node.Meta, &meta); err != nil {
+			log.Printf("Invalid metadata from %s: %v\n", node.Name, err)
+		}
+	}
+	return meta
+}
+
+// OnPeerEvent invokes callback whenever another peer joins, leaves or updates its metadata.
+// The callbacks are invoked one after another in the order of the events.
+func (n *MemberlistTransport) OnPeerEvent(callback func(event libsyncer.PeerEvent, peer string, meta libsyncer.NodeMeta)) {
+	n.peerMu.Lock()
+	defer n.peerMu.Unlock()
+	n.peerSubscribers = append(n.peerSubscribers, callback)
+}
+
+func (n *MemberlistTransport) dispatchPeerEvents(events <-chan peerEvent) {
+	for e := range events {
+		if e.node.Name == n.Name() {
+			continue
+		}
+		if printMessages {
+			log.Printf("PEER %s %s\n", e.event, e.node.Name)
+		}
+
+		meta := decodeMeta(&e.node)
+		n.peerMu.Lock()
+		subscribers := n.peerSubscribers
+		n.peerMu.Unlock()
+		for _, cb := range subscribers {
+			cb(e.event, e.node.Name, meta)
+		}
+	}
+}
+
 // Subscribe creates a subscription for messageType and invokes callback for any new message
 // arriving over the transport.
 func (n *MemberlistTransport) Subscribe(messageType libsyncer.MessageType, callback func(peer string, messageType libsyncer.MessageType, message string)) {
@@ -126,9 +300,28 @@ func (n *MemberlistTransport) Subscribe(messageType libsyncer.MessageType, callb
 	n.subscribers[messageType] = append(l, callback)
 }
 
+// member returns the member with the given name or nil, if no such member is known.
+func (n *MemberlistTransport) member(peer string) *memberlist.Node {
+	for _, member := range n.Memberlist.Members() {
+		if member.Name == peer {
+			return member
+		}
+	}
+	return nil
+}
+
 func (n *MemberlistTransport) receiveMessage(data []byte) {
 	senderPeer, messageType, message := n.deserializeMessage(data)
 
+	// The sender is the name stated in the message, memberlist doesn't tell where it came
+	// from. This only drops messages of peers which left; it doesn't authenticate the sender.
+	// The keyring is the only authentication: with encryption enabled, only peers knowing
+	// the key can send messages, but each of them can use any name.
+	if n.member(senderPeer) == nil {
+		log.Printf("Dropping %s message from unknown peer %s\n", messageType, senderPeer)
+		return
+	}
+
 	if printMessages {
 		log.Printf("RECEIVED %s, %s:\t%s\n", senderPeer, messageType, message)
 	}
@@ -144,11 +337,57 @@ func (n *MemberlistTransport) serializeMessage(sourcePeer string, messageType li
 
 func (n *MemberlistTransport) deserializeMessage(data []byte) (string, libsyncer.MessageType, string) {
 	v := strings.SplitN(string(data), " ", 3)
+	if len(v) != 3 {
+		return "", "", ""
+	}
 	return v[0], libsyncer.MessageType(v[1]), v[2]
 }
 
+type peerEvent struct {
+	event libsyncer.PeerEvent
+	node  memberlist.Node
+}
+
+// peerEventDelegate implements memberlist.EventDelegate. Memberlist must not be blocked
+// by the subscribers, so the events are queued and dispatched by the transport.
+type peerEventDelegate struct {
+	events chan peerEvent
+}
+
+func (d *peerEventDelegate) notify(event libsyncer.PeerEvent, node *memberlist.Node) {
+	select {
+	case d.events <- peerEvent{event, *node}:
+	default:
+		log.Printf("Dropping %s event for %s - too many pending events\n", event, node.Name)
+	}
+}
+
+// NotifyJoin is invoked when a node is detected to have joined.
+func (d *peerEventDelegate) NotifyJoin(node *memberlist.Node) {
+	d.notify(libsyncer.PeerJoined, node)
+}
+
+// NotifyLeave is invoked when a node is detected to have left or died.
+func (d *peerEventDelegate) NotifyLeave(node *memberlist.Node) {
+	d.notify(libsyncer.PeerLeft, node)
+}
+
+// NotifyUpdate is invoked when a node is detected to have updated its metadata.
+func (d *peerEventDelegate) NotifyUpdate(node *memberlist.Node) {
+	d.notify(libsyncer.PeerUpdated, node)
+}
+
 type SyncerDelegate struct {
 	Callback func(data []byte)
+
+	mu   sync.Mutex
+	meta []byte
+}
+
+func (sd *SyncerDelegate) setMeta(meta []byte) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	sd.meta = meta
 }
 
 // Memberlist Delete Handlers
@@ -156,7 +395,12 @@ type SyncerDelegate struct {
 // when broadcasting an alive message. It's length is limited to
 // the given byte size. This metadata is available in the Node structure.
 func (sd *SyncerDelegate) NodeMeta(limit int) []byte {
-	return []byte{}
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	if len(sd.meta) > limit {
+		return []byte{}
+	}
+	return sd.meta
 }
 
 // NotifyMsg is called when a user-data message is received.
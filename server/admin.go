@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/pflag"
+
+	"github.com/zeisss/mediasyncer/libsyncer"
+)
+
+// defaultAdminTokenFile is where the token of the admin API is stored by default.
+const defaultAdminTokenFile = "./mediasyncer-admin-token"
+
+// loadAdminToken reads the token of the admin API from path. If the file doesn't exist,
+// a random token is written to it.
+func loadAdminToken(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return "", fmt.Errorf("%s is empty", path)
+		}
+		return token, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(secret)
+	if err := ioutil.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	log.Println("Created the admin token in " + path)
+	return token, nil
+}
+
+// adminClient talks to the admin API of a running node for the subcommands.
+type adminClient struct {
+	addr      string
+	tokenFile string
+
+	// json prints the responses as JSON instead of tables.
+	json bool
+}
+
+// newAdminClient registers the flags for reaching the admin API.
+func newAdminClient(flags *pflag.FlagSet) *adminClient {
+	c := &adminClient{}
+	flags.StringVar(&c.addr, "admin-addr", "127.0.0.1:8090", "Address of the admin API of the node")
+	flags.StringVar(&c.tokenFile, "admin-token-file", defaultAdminTokenFile, "File containing the token of the admin API")
+	flags.BoolVar(&c.json, "json", false, "Print JSON instead of a table")
+	return c
+}
+
+// newRequest creates a request to the admin API, carrying the token.
+func (c *adminClient) newRequest(method, path string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := url.URL{Scheme: "http", Host: c.addr, Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if c.tokenFile != "" {
+		data, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if token := strings.TrimSpace(string(data)); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	return req, nil
+}
+
+// send sends a request created by newRequest. Responses other than 2xx are returned as error.
+func (c *adminClient) send(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("admin API: %s %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// do sends a request to the admin API and decodes the JSON response into v, if given.
+func (c *adminClient) do(method, path string, query url.Values, v interface{}) error {
+	req, err := c.newRequest(method, path, query, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if v == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// print prints v as JSON with --json and calls table otherwise.
+func (c *adminClient) print(v interface{}, table func(w io.Writer)) {
+	if c.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(v); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	table(w)
+	w.Flush()
+}
+
+// humanSize formats a size with a binary unit, e.g. 1.5GiB.
+func humanSize(size libsyncer.ByteSize) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	f := float64(size)
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", size)
+	}
+	return fmt.Sprintf("%.1f%s", f, units[i])
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const certsUsage = `Usage: mediasyncer certs ca [--dir=DIR]
+       mediasyncer certs node --name=PEER [--ip=IP]... [--dir=DIR]
+
+Generates a cluster CA (ca.pem, ca-key.pem) and certificates for the peers
+(PEER.pem, PEER-key.pem), to be used with --tls-ca, --tls-cert and --tls-key.
+`
+
+// certsCommand implements the `certs` subcommand.
+func certsCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, certsUsage)
+		os.Exit(2)
+	}
+
+	flags := pflag.NewFlagSet("certs", pflag.ExitOnError)
+	dir := flags.String("dir", "./certs", "Directory for the certificates")
+	name := flags.String("name", "", "Peer name the certificate is issued for")
+	ips := flags.StringSlice("ip", nil, "IP addresses of the peer")
+	validity := flags.Duration("validity", 10*365*24*time.Hour, "How long the certificate is valid")
+	flags.Parse(args[1:])
+
+	if err := os.MkdirAll(*dir, 0700); err != nil {
+		fatal(err)
+	}
+
+	switch args[0] {
+	case "ca":
+		template := certTemplate("mediasyncer CA", *validity)
+		template.IsCA = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		template.BasicConstraintsValid = true
+		if err := createCert(*dir, "ca", template, nil); err != nil {
+			fatal(err)
+		}
+	case "node":
+		if *name == "" {
+			fatal(fmt.Errorf("--name is required"))
+		}
+		ca, err := tls.LoadX509KeyPair(filepath.Join(*dir, "ca.pem"), filepath.Join(*dir, "ca-key.pem"))
+		if err != nil {
+			fatal(err)
+		}
+		template := certTemplate(*name, *validity)
+		template.DNSNames = []string{*name}
+		for _, ip := range *ips {
+			template.IPAddresses = append(template.IPAddresses, net.ParseIP(ip))
+		}
+		template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		if err := createCert(*dir, *name, template, &ca); err != nil {
+			fatal(err)
+		}
+	default:
+		fmt.Fprint(os.Stderr, certsUsage)
+		os.Exit(2)
+	}
+}
+
+func certTemplate(commonName string, validity time.Duration) *x509.Certificate {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		fatal(err)
+	}
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(validity),
+	}
+}
+
+// createCert creates a key and a certificate signed by ca and stores them as name.pem
+// and name-key.pem in dir. If ca is nil, the certificate is self signed.
+func createCert(dir, name string, template *x509.Certificate, ca *tls.Certificate) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	parent, signer := template, interface{}(key)
+	if ca != nil {
+		if parent, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+			return err
+		}
+		signer = ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := writePEM(filepath.Join(dir, name+".pem"), "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+	if err := writePEM(filepath.Join(dir, name+"-key.pem"), "EC PRIVATE KEY", keyDer, 0600); err != nil {
+		return err
+	}
+	fmt.Printf("Created %s\n", filepath.Join(dir, name+".pem"))
+	return nil
+}
+
+func writePEM(path, blockType string, data []byte, mode os.FileMode) error {
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(fp, &pem.Block{Type: blockType, Bytes: data}); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "ERROR: "+err.Error())
+	os.Exit(1)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	"github.com/zeisss/mediasyncer/libsyncer"
+	"github.com/zeisss/mediasyncer/p2p"
+	"github.com/zeisss/mediasyncer/static"
+)
+
+// reloadable are the flags applied by a reload on SIGHUP. Changes of other flags only apply
+// after a restart.
+var reloadable = map[string]bool{
+	"price-formula":   true,
+	"price-static":    true,
+	"price-default":   true,
+	"price-old":       true,
+	"price-young":     true,
+	"price-old-age":   true,
+	"price-young-age": true,
+	"peer-label":      true,
+	"schedule":        true,
+	"bandwidth":       true,
+	"peer-bandwidth":  true,
+	"conflict":        true,
+	"volume":          true,
+	"scrub-rate":      true,
+	"debug":           true,
+}
+
+// configFile sets the flags from a config file. Each key of the file is the name of a flag,
+// keys of a [table] are prefixed with the name of the table, e.g. `[trash] size = "50GiB"`
+// sets --trash-size. Repeatable flags take arrays. The peers to join are given as `peers`.
+// Flags given on the command line take precedence over the file.
+type configFile struct {
+	path  string
+	flags *pflag.FlagSet
+
+	// defaults are the values of the flags not given on the command line.
+	defaults map[string][]string
+
+	// peers are the peers to join, if none are given on the command line.
+	peers []string
+}
+
+// newConfigFile creates a configFile for the flags, which must be parsed already.
+func newConfigFile(path string, flags *pflag.FlagSet) *configFile {
+	c := &configFile{path: path, flags: flags, defaults: make(map[string][]string)}
+	flags.VisitAll(func(f *pflag.Flag) {
+		if !f.Changed && f.Name != "config" {
+			c.defaults[f.Name] = flagValue(f)
+		}
+	})
+	return c
+}
+
+func flagValue(f *pflag.Flag) []string {
+	if slice, ok := f.Value.(pflag.SliceValue); ok {
+		return slice.GetSlice()
+	}
+	return []string{f.Value.String()}
+}
+
+// values returns the current values of the flags not given on the command line.
+func (c *configFile) values() map[string][]string {
+	values := make(map[string][]string)
+	for name := range c.defaults {
+		values[name] = flagValue(c.flags.Lookup(name))
+	}
+	return values
+}
+
+// set sets the flags to the given values. Flags without a value are reset to their default.
+func (c *configFile) set(values map[string][]string) error {
+	for name, def := range c.defaults {
+		value, ok := values[name]
+		if !ok {
+			value = def
+		}
+		f := c.flags.Lookup(name)
+		if slice, ok := f.Value.(pflag.SliceValue); ok {
+			if err := slice.Replace(value); err != nil {
+				return fmt.Errorf("invalid value for %s: %v", name, err)
+			}
+			continue
+		}
+		if len(value) != 1 {
+			return fmt.Errorf("%s takes a single value", name)
+		}
+		if err := f.Value.Set(value[0]); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %v", value[0], name, err)
+		}
+	}
+	return nil
+}
+
+// apply reads the file and sets the flags. If the file is invalid, the flags are kept.
+func (c *configFile) apply() error {
+	file, err := os.Open(c.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	values, err := libsyncer.ParseConfigFile(file)
+	if err != nil {
+		return err
+	}
+
+	peers := values["peers"]
+	delete(values, "peers")
+	for name := range values {
+		if _, ok := c.defaults[name]; ok {
+			continue
+		}
+		if f := c.flags.Lookup(name); f == nil || name == "config" {
+			return fmt.Errorf("unknown setting %s", name)
+		}
+		// Given on the command line.
+		delete(values, name)
+	}
+
+	previous := c.values()
+	if err := c.set(values); err != nil {
+		c.set(previous)
+		return err
+	}
+	c.peers = peers
+	return nil
+}
+
+// volumeXattrs returns the xattrs option of each volume spec by path.
+func volumeXattrs(specs []string) map[string]bool {
+	xattrs := make(map[string]bool)
+	for _, spec := range specs {
+		options := strings.Split(spec, ";")
+		xattrs[options[0]] = false
+		for _, option := range options[1:] {
+			if v := strings.SplitN(option, "=", 2); len(v) == 2 && v[0] == "xattrs" {
+				xattrs[options[0]], _ = strconv.ParseBool(v[1])
+			}
+		}
+	}
+	return xattrs
+}
+
+// volumeRestarts returns the changed options of volumes which only apply after a restart,
+// as the running volumes are kept by a reload.
+func volumeRestarts(previous, current []string) []string {
+	before := volumeXattrs(previous)
+	var restart []string
+	for path, xattrs := range volumeXattrs(current) {
+		if old, ok := before[path]; ok && old != xattrs {
+			restart = append(restart, "xattrs of volume "+path)
+		}
+	}
+	return restart
+}
+
+// reload applies the changed config file to the running syncer. Invalid config files
+// are rejected as a whole. Changes of flags which aren't reloadable are logged.
+func (c *configFile) reload(syncer *libsyncer.Syncer, network transport, adaptive *libsyncer.AdaptivePricer) (err error) {
+	previous := c.values()
+	previousPeers := c.peers
+	defer func() {
+		if err != nil {
+			c.set(previous)
+			c.peers = previousPeers
+		}
+	}()
+
+	if err := c.apply(); err != nil {
+		return err
+	}
+	priceFormula, err := pricer(formula)
+	if err != nil {
+		return err
+	}
+	cfg, err := syncerConfig(network, priceFormula)
+	if err != nil {
+		return err
+	}
+	if adaptive != nil {
+		adaptive.SetBase(priceFormula)
+		cfg.PriceFormula = adaptive.Formula()
+	}
+
+	current := c.values()
+	var restart []string
+	for name, value := range current {
+		if !reloadable[name] && strings.Join(value, "\x00") != strings.Join(previous[name], "\x00") {
+			restart = append(restart, "--"+name)
+		}
+	}
+	restart = append(restart, volumeRestarts(previous["volume"], current["volume"])...)
+	if len(pflag.Args()) == 0 && strings.Join(c.peers, "\x00") != strings.Join(previousPeers, "\x00") {
+		restart = append(restart, "peers")
+	}
+	if len(restart) > 0 {
+		sort.Strings(restart)
+		log.Println("Changed settings require a restart: " + strings.Join(restart, ", "))
+	}
+
+	syncer.Reload(cfg)
+	p2p.PrintMessages(printNetworkMessages)
+	static.PrintMessages(printNetworkMessages)
+	return nil
+}
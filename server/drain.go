@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io"
+	"net/url"
+
+	"github.com/spf13/pflag"
+
+	"github.com/zeisss/mediasyncer/libsyncer"
+)
+
+// drainCommand implements the `drain` subcommand, which moves all files off the volumes of a
+// node, e.g. before removing a disk: the files are awarded to any bidder and the volumes take
+// no files. Draining is not persisted, it stops when the node restarts.
+func drainCommand(args []string) {
+	flags := pflag.NewFlagSet("drain", pflag.ExitOnError)
+	admin := newAdminClient(flags)
+	volume := flags.String("volume", "", "Volume to drain, all volumes of the node if empty")
+	stop := flags.Bool("stop", false, "Stop draining")
+	flags.Parse(args)
+
+	query := url.Values{"action": {"drain"}}
+	if *stop {
+		query.Set("action", "undrain")
+	}
+	if *volume != "" {
+		query.Set("volume", *volume)
+	}
+	var volumes []libsyncer.VolumeStatus
+	if err := admin.do("POST", "/volumes", query, &volumes); err != nil {
+		fatal(err)
+	}
+	admin.print(volumes, func(w io.Writer) {
+		printVolumes(w, volumes)
+	})
+}
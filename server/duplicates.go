@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/spf13/pflag"
+
+	"github.com/zeisss/mediasyncer/libsyncer"
+)
+
+// duplicatesCommand implements the `duplicates` subcommand, which prints the duplicates
+// found by a running node through its admin API.
+func duplicatesCommand(args []string) {
+	flags := pflag.NewFlagSet("duplicates", pflag.ExitOnError)
+	admin := newAdminClient(flags)
+	refresh := flags.Bool("refresh", false, "Search the cluster for duplicates now, instead of reporting the last search")
+	flags.Parse(args)
+
+	method := "GET"
+	if *refresh {
+		method = "POST"
+	}
+	var report libsyncer.DuplicateReport
+	if err := admin.do(method, "/duplicates", nil, &report); err != nil {
+		fatal(err)
+	}
+	duplicates := report.Duplicates
+	var wasted libsyncer.ByteSize
+	for _, dup := range duplicates {
+		wasted += dup.Size * libsyncer.ByteSize(len(dup.Replicas)-1)
+	}
+	admin.print(report, func(w io.Writer) {
+		for _, dup := range duplicates {
+			fmt.Fprintf(w, "%s (%d bytes, %d copies)\n", dup.Hash, dup.Size, len(dup.Replicas))
+			for _, r := range dup.Replicas {
+				fmt.Fprintf(w, "\t%s\t%s/%s\n", r.Peer, r.File.VolumeID, r.File.Path)
+			}
+		}
+	})
+	fmt.Fprintf(os.Stderr, "%d duplicates, %d bytes in redundant copies\n", len(duplicates), wasted)
+	if len(report.Skipped) > 0 {
+		peers := make([]string, 0, len(report.Skipped))
+		for peer := range report.Skipped {
+			peers = append(peers, string(peer))
+		}
+		sort.Strings(peers)
+		for _, peer := range peers {
+			fmt.Fprintf(os.Stderr, "Skipped %s: %s\n", peer, report.Skipped[libsyncer.PeerID(peer)])
+		}
+		fmt.Fprintln(os.Stderr, "The files of skipped peers are missing. Fetching their catalogs requires TLS or a shared --peer-secret-file.")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/zeisss/mediasyncer/libsyncer"
+)
+
+const lsUsage = `Usage: mediasyncer ls [--volume=ID] [PATTERN]
+
+Lists the files of a node. PATTERN is a glob for the path or the name of the
+files (e.g. '*.mkv'), other patterns match any part of the path.
+`
+
+const findUsage = `Usage: mediasyncer find PATTERN
+
+Searches all peers of the cluster for files matching PATTERN, see ls.
+`
+
+const getUsage = `Usage: mediasyncer get [--volume=ID] [--peer=NAME] PATH [LOCAL]
+
+Downloads a file from a node, or through the node from another peer, to LOCAL
+(the name of the file by default, - for stdout).
+`
+
+const putUsage = `Usage: mediasyncer put [--volume=ID] [--overwrite] LOCAL [PATH]
+
+Uploads a local file to a node, by default to the volume with the most free
+space and with the name of the local file.
+`
+
+// lsCommand implements the `ls` subcommand.
+func lsCommand(args []string) {
+	flags := pflag.NewFlagSet("ls", pflag.ExitOnError)
+	admin := newAdminClient(flags)
+	volume := flags.String("volume", "", "Volume to list, all volumes if empty")
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		exitUsage(lsUsage)
+	}
+
+	query := url.Values{}
+	if *volume != "" {
+		query.Set("volume", *volume)
+	}
+	if flags.NArg() == 1 {
+		query.Set("match", flags.Arg(0))
+	}
+	var files []libsyncer.FileStatus
+	if err := admin.do("GET", "/files", query, &files); err != nil {
+		fatal(err)
+	}
+	admin.print(files, func(w io.Writer) {
+		fmt.Fprintln(w, "VOLUME\tPATH\tSIZE\tMODIFIED\tPINNED")
+		for _, f := range files {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\n", f.File.VolumeID, f.File.Path, humanSize(f.Size), f.ModTime.Format(time.RFC3339), f.Pinned)
+		}
+	})
+}
+
+// findCommand implements the `find` subcommand.
+func findCommand(args []string) {
+	flags := pflag.NewFlagSet("find", pflag.ExitOnError)
+	admin := newAdminClient(flags)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		exitUsage(findUsage)
+	}
+
+	var result libsyncer.FindResult
+	if err := admin.do("GET", "/find", url.Values{"match": {flags.Arg(0)}}, &result); err != nil {
+		fatal(err)
+	}
+	admin.print(result, func(w io.Writer) {
+		fmt.Fprintln(w, "PEER\tVOLUME\tPATH\tSIZE\tMODIFIED\tPINNED")
+		for _, f := range result.Files {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%v\n", f.Peer, f.File.VolumeID, f.File.Path, humanSize(f.Size), f.ModTime.Format(time.RFC3339), f.Pinned)
+		}
+	})
+	for _, peer := range result.Unreachable {
+		fmt.Fprintf(os.Stderr, "WARNING: %s could not be searched\n", peer)
+	}
+}
+
+// getCommand implements the `get` subcommand.
+func getCommand(args []string) {
+	flags := pflag.NewFlagSet("get", pflag.ExitOnError)
+	admin := newAdminClient(flags)
+	volume := flags.String("volume", "", "Volume of the file, all volumes of the node are searched if empty")
+	peer := flags.String("peer", "", "Peer to download the file from, requires --volume")
+	overwrite := flags.Bool("overwrite", false, "Replace an existing local file")
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		exitUsage(getUsage)
+	}
+	remote := flags.Arg(0)
+	local := path.Base(remote)
+	if flags.NArg() == 2 {
+		local = flags.Arg(1)
+	}
+
+	query := url.Values{"path": {remote}}
+	if *volume != "" {
+		query.Set("volume", *volume)
+	}
+	if *peer != "" {
+		query.Set("peer", *peer)
+	}
+	if local != "-" && !*overwrite {
+		if _, err := os.Stat(local); err == nil {
+			fatal(fmt.Errorf("%s exists, use --overwrite to replace it", local))
+		}
+	}
+
+	req, err := admin.newRequest("GET", "/file", query, nil)
+	if err != nil {
+		fatal(err)
+	}
+	resp, err := admin.send(req)
+	if err != nil {
+		fatal(err)
+	}
+	defer resp.Body.Close()
+	if local == "-" {
+		if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	// Partial downloads are excluded by default, so a node watching the directory ignores them.
+	tmp := local + ".part"
+	file, err := os.Create(tmp)
+	if err != nil {
+		fatal(err)
+	}
+	n, err := io.Copy(file, resp.Body)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, local)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		fatal(err)
+	}
+	if meta, err := libsyncer.ParseFileMeta(resp.Header); err == nil {
+		if meta.Mode != 0 {
+			os.Chmod(local, meta.Mode)
+		}
+		if !meta.ModTime.IsZero() {
+			os.Chtimes(local, meta.ModTime, meta.ModTime)
+		}
+	}
+
+	result := struct {
+		Path string             `json:"path"`
+		Size libsyncer.ByteSize `json:"size"`
+	}{local, libsyncer.ByteSize(n)}
+	admin.print(result, func(w io.Writer) {
+		fmt.Fprintf(w, "Downloaded %s to %s (%s)\n", remote, local, humanSize(result.Size))
+	})
+}
+
+// putCommand implements the `put` subcommand.
+func putCommand(args []string) {
+	flags := pflag.NewFlagSet("put", pflag.ExitOnError)
+	admin := newAdminClient(flags)
+	volume := flags.String("volume", "", "Volume to store the file on, the volume with the most free space if empty")
+	overwrite := flags.Bool("overwrite", false, "Replace an existing file, which is moved into the trash")
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		exitUsage(putUsage)
+	}
+	local := flags.Arg(0)
+	remote := filepath.ToSlash(filepath.Base(local))
+	if flags.NArg() == 2 {
+		remote = flags.Arg(1)
+	}
+
+	file, err := os.Open(local)
+	if err != nil {
+		fatal(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		fatal(err)
+	}
+	if info.IsDir() {
+		fatal(fmt.Errorf("%s is a directory", local))
+	}
+
+	query := url.Values{"path": {remote}}
+	if *volume != "" {
+		query.Set("volume", *volume)
+	}
+	if *overwrite {
+		query.Set("overwrite", "1")
+	}
+	req, err := admin.newRequest("PUT", "/file", query, file)
+	if err != nil {
+		fatal(err)
+	}
+	req.ContentLength = info.Size()
+	libsyncer.FileMeta{ModTime: info.ModTime(), Mode: info.Mode().Perm()}.SetHeader(req.Header)
+
+	resp, err := admin.send(req)
+	if err != nil {
+		fatal(err)
+	}
+	defer resp.Body.Close()
+	var status libsyncer.FileStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		fatal(err)
+	}
+	admin.print(status, func(w io.Writer) {
+		fmt.Fprintf(w, "Uploaded %s to %s on volume %s (%s)\n", local, status.File.Path, status.File.VolumeID, humanSize(status.Size))
+	})
+}
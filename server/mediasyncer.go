@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -12,13 +17,17 @@ import (
 	"github.com/zeisss/mediasyncer/disk"
 	"github.com/zeisss/mediasyncer/libsyncer"
 	"github.com/zeisss/mediasyncer/p2p"
+	"github.com/zeisss/mediasyncer/static"
 )
 
 var p2pConfig p2p.Config = p2p.DefaultConfig()
 var fsConfig libsyncer.FileServerConfig
+var adaptiveConfig libsyncer.AdaptiveConfig = libsyncer.DefaultAdaptiveConfig()
 
 var (
-	volumePath           string
+	volumeSpecs          []string
+	excludes             []string
+	indexDir             string
 	formula              string
 	formulaStaticPrice   float32
 	formulaDefaultPrice  float32
@@ -27,10 +36,34 @@ var (
 	formulaYoungPrice    float32
 	formulaYoungAge      time.Duration
 	printNetworkMessages bool
+	peerLabels           []string
+	nodeLabels           []string
+	adaptive             bool
+	scheduleWindows      []string
+	bandwidth            string
+	peerBandwidths       []string
+	adminAddr            string
+	adminTokenFile       string
+	adminToken           string
+	peerSecretFile       string
+	transferMode         string
+	clusterKeys          []string
+	transportType        string
+	trashRetention       time.Duration
+	trashSize            string
+	scrubInterval        time.Duration
+	scrubRate            string
+	dedupConfig          libsyncer.DedupConfig
+	conflictPolicy       string
+	configPath           string
+	pinsFile             string
+	peers                []string
 )
 
 func init() {
-	pflag.StringVar(&formula, "price-formula", "static", "What price formular to use? static, random, old, young")
+	pflag.StringVar(&configPath, "config", "", "Config file (TOML) setting any of the flags. Flags given on the command line take precedence. Reloaded on SIGHUP")
+
+	pflag.StringVar(&formula, "price-formula", "static", "What price formular to use? static, random, old, young or an expression like 'size > 1GiB ? 2 : 1'")
 	pflag.Float32Var(&formulaStaticPrice, "price-static", 1.0, "Price for static formular")
 	pflag.Float32Var(&formulaDefaultPrice, "price-default", 1.0, "Default Price for old/young formular")
 	pflag.Float32Var(&formulaOldPrice, "price-old", 1.0, "Age Price for old formular")
@@ -38,59 +71,380 @@ func init() {
 	pflag.DurationVar(&formulaOldAge, "price-old-age", 6*30*24*time.Hour, "Minimum age before start bidding price-old")
 	pflag.DurationVar(&formulaYoungAge, "price-young-age", 60*24*time.Hour, "Maximum age before stop bidding price-old")
 
-	pflag.StringVar(&volumePath, "volume", "./lib", "What files to sync")
+	pflag.BoolVar(&adaptive, "price-adaptive", false, "Adjust the prices of the formula based on won and lost auctions")
+	pflag.Float64Var(&adaptiveConfig.TargetFill, "price-adaptive-target", adaptiveConfig.TargetFill, "Fraction of the volume the adaptive pricing aims to fill")
+	pflag.StringVar(&adaptiveConfig.StatePath, "price-adaptive-state", "./mediasyncer-price-state.json", "File to persist the adaptive pricing state in")
+	pflag.StringSliceVar(&peerLabels, "peer-label", nil, "Label a peer for the price formula as peer=label, e.g. laptop=battery")
+	pflag.StringSliceVar(&nodeLabels, "label", nil, "Label advertised for this node, e.g. always-on, battery or room:office")
+
+	pflag.StringArrayVar(&scheduleWindows, "schedule", nil, "Time window like 'mon-fri 18:00-23:00 auction=off bid=on bandwidth=512KiB'. Can be repeated")
+
+	pflag.StringVar(&bandwidth, "bandwidth", "0", "Bandwidth limit for all transfers in bytes per second, e.g. 2MiB. 0 is unlimited")
+	pflag.StringSliceVar(&peerBandwidths, "peer-bandwidth", nil, "Bandwidth limit for transfers with a peer as peer=size, e.g. pi1=512KiB")
+	pflag.StringVar(&transferMode, "transfer", "push", "How won files are transfered: push (seller uploads) or pull (winner downloads)")
+	pflag.StringVar(&conflictPolicy, "conflict", string(libsyncer.ConflictSkip), "How to bid on files existing locally: skip, rename (keep both), newer (overwrite if newer) or replicated (drop the sellers copy if the content is the same)")
+	pflag.StringVar(&adminAddr, "admin-addr", "", "Address for the admin HTTP API, e.g. 127.0.0.1:8090. Disabled if empty")
+	pflag.StringVar(&adminTokenFile, "admin-token-file", defaultAdminTokenFile, "File with the bearer token required by the admin API, created with a random token if missing. Empty disables authentication")
+
+	pflag.StringArrayVar(&volumeSpecs, "volume", []string{"./lib"}, "What files to sync, optionally with per volume settings like './lib;price=size > 1GiB ? 2 : 1;high=0.9;low=0.8;xattrs=true'. Can be repeated")
+
+	pflag.StringVar(&indexDir, "index-dir", "./mediasyncer-index", "Directory for the file indexes of the volumes. Empty disables the indexes")
+	pflag.DurationVar(&trashRetention, "trash-retention", libsyncer.DefaultTrashConfig.Retention, "How long files are kept in the trash of a volume after they were transfered. 0 deletes them immediately")
+	pflag.StringVar(&trashSize, "trash-size", "0", "Size of the trash of each volume, e.g. 50GiB, above which the oldest files are purged. 0 is unlimited")
+	pflag.DurationVar(&scrubInterval, "scrub-interval", libsyncer.DefaultScrubConfig.Interval, "How often the content of each indexed file is verified against its recorded hash. 0 disables scrubbing")
+	pflag.StringVar(&scrubRate, "scrub-rate", "10MiB", "How many bytes per second are read when verifying files. 0 is unlimited")
+	pflag.DurationVar(&dedupConfig.Interval, "dedup-interval", libsyncer.DefaultDedupConfig.Interval, "How often the catalogs of all peers are searched for duplicate files. 0 disables the search")
+	pflag.IntVar(&dedupConfig.Replicas, "replicas", 0, "Number of copies of a file to keep in the cluster, redundant local copies are moved into the trash. 0 only reports duplicates")
+	pflag.StringVar(&pinsFile, "pins-file", "./mediasyncer-pins.json", "File to persist the pinned files in, which are never auctioned")
+	pflag.StringSliceVar(&excludes, "exclude", libsyncer.DefaultExcludes, "gitignore-style pattern of files never to sync, in addition to the .mediasyncerignore files")
 
 	pflag.StringVar(&fsConfig.Addr, "http-addr", "127.0.0.1", "IP to listen on. Must be resolvable by all peers")
 	pflag.IntVar(&fsConfig.Port, "http-port", 8080, "Port for HTTP FileServer")
+	pflag.StringVar(&fsConfig.TLS.CAFile, "tls-ca", "./certs/ca.pem", "CA certificate the certificates of all peers are signed with")
+	pflag.StringVar(&fsConfig.TLS.CertFile, "tls-cert", "", "Certificate of this peer. Enables HTTPS for the FileServer and transfers")
+	pflag.StringVar(&fsConfig.TLS.KeyFile, "tls-key", "", "Private key of this peer")
+	pflag.StringVar(&peerSecretFile, "peer-secret-file", "", "File with a secret shared by all peers, to authenticate their requests to each other without TLS")
 
+	pflag.StringVar(&transportType, "transport", "memberlist", "How peers talk to each other: memberlist (gossip) or static (HTTP to the peers given as arguments)")
 	pflag.IntVar(&p2pConfig.BindPort, "bind-port", 8000, "The port to bind to")
+	pflag.StringSliceVar(&clusterKeys, "cluster-key", nil, "Base64 encoded key (16, 24 or 32 bytes) to encrypt the network with. The first key is used for encrypting, all for decrypting")
 	pflag.StringVar(&p2pConfig.Name, "name", "mediasyncer", "The name of this process. Must be unique for the memberlist cluster")
 
 	pflag.BoolVar(&printNetworkMessages, "debug", false, "Print network messages received/sent")
 }
 
-func pricer() libsyncer.PriceFormula {
+func pricer(formula string) (libsyncer.PriceFormula, error) {
 	switch formula {
 	case "static":
-		return libsyncer.PriceFormulaStatic(libsyncer.Price(formulaStaticPrice))
+		return libsyncer.AdaptPriceFormula(libsyncer.PriceFormulaStatic(libsyncer.Price(formulaStaticPrice))), nil
 	case "random":
-		return libsyncer.PriceFormulaRandom()
+		return libsyncer.AdaptPriceFormula(libsyncer.PriceFormulaRandom()), nil
 	case "old":
-		return libsyncer.PriceFormulaAge(true, formulaOldAge, libsyncer.Price(formulaOldPrice), libsyncer.Price(formulaDefaultPrice), time.Now)
+		return libsyncer.AdaptPriceFormula(libsyncer.PriceFormulaAge(true, formulaOldAge, libsyncer.Price(formulaOldPrice), libsyncer.Price(formulaDefaultPrice), time.Now)), nil
 	case "young":
-		return libsyncer.PriceFormulaAge(true, formulaYoungAge, libsyncer.Price(formulaYoungPrice), libsyncer.Price(formulaDefaultPrice), time.Now)
+		return libsyncer.AdaptPriceFormula(libsyncer.PriceFormulaAge(true, formulaYoungAge, libsyncer.Price(formulaYoungPrice), libsyncer.Price(formulaDefaultPrice), time.Now)), nil
+	default:
+		f, err := libsyncer.PriceFormulaExpr(formula)
+		if err != nil {
+			return nil, fmt.Errorf("invalid formula: %v", err)
+		}
+		return f, nil
+	}
+}
+
+// splitPeerValue splits flag values of the form peer=value.
+func splitPeerValue(s string) (libsyncer.PeerID, string, error) {
+	v := strings.SplitN(s, "=", 2)
+	if len(v) != 2 {
+		return "", "", fmt.Errorf("invalid value, expected peer=value: %s", s)
+	}
+	return libsyncer.PeerID(v[0]), v[1], nil
+}
+
+func labels() (libsyncer.PeerLabels, error) {
+	l := libsyncer.PeerLabels{}
+	for _, label := range peerLabels {
+		peer, value, err := splitPeerValue(label)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --peer-label: %v", err)
+		}
+		l[peer] = append(l[peer], value)
+	}
+	return l, nil
+}
+
+func throttle() (libsyncer.ThrottleConfig, error) {
+	rate, err := libsyncer.ParseByteSize(bandwidth)
+	if err != nil {
+		return libsyncer.ThrottleConfig{}, fmt.Errorf("invalid --bandwidth: %v", err)
+	}
+	cfg := libsyncer.ThrottleConfig{
+		Rate:      rate,
+		PeerRates: make(map[libsyncer.PeerID]libsyncer.ByteSize),
+	}
+	for _, peerBandwidth := range peerBandwidths {
+		peer, value, err := splitPeerValue(peerBandwidth)
+		if err == nil {
+			cfg.PeerRates[peer], err = libsyncer.ParseByteSize(value)
+		}
+		if err != nil {
+			return libsyncer.ThrottleConfig{}, fmt.Errorf("invalid --peer-bandwidth: %v", err)
+		}
+	}
+	return cfg, nil
+}
+
+func schedule() (*libsyncer.Schedule, error) {
+	s, err := libsyncer.ParseSchedule(scheduleWindows)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --schedule: %v", err)
+	}
+	return s, nil
+}
+
+func pull() (bool, error) {
+	switch transferMode {
+	case "push":
+		return false, nil
+	case "pull":
+		return true, nil
 	default:
-		panic("Unknown formula: " + formula)
+		return false, fmt.Errorf("unknown transfer mode: %s", transferMode)
+	}
+}
+
+func conflict() (libsyncer.ConflictPolicy, error) {
+	policy, err := libsyncer.ParseConflictPolicy(conflictPolicy)
+	if err != nil {
+		return "", fmt.Errorf("invalid --conflict: %v", err)
 	}
+	return policy, nil
 }
 
-func volume() libsyncer.Volume {
-	v := disk.Open(volumePath)
-	return v
+// transport is a libsyncer.Transport which can leave the network.
+type transport interface {
+	libsyncer.Transport
+	Leave(timeout time.Duration) error
+}
+
+func newTransport() transport {
+	switch transportType {
+	case "memberlist":
+		var keys [][]byte
+		for _, clusterKey := range clusterKeys {
+			key, err := p2p.DecodeClusterKey(clusterKey)
+			if err != nil {
+				panic(err.Error())
+			}
+			keys = append(keys, key)
+		}
+		if err := p2pConfig.SetClusterKeys(keys); err != nil {
+			panic(err.Error())
+		}
+
+		network := p2p.New(p2pConfig)
+		network.Join(peers)
+		return network
+	case "static":
+		if len(clusterKeys) > 0 {
+			panic("--cluster-key is not supported by the static transport, use --tls-cert instead")
+		}
+		cfg := static.DefaultConfig()
+		cfg.Name = p2pConfig.Name
+		cfg.Addr = fmt.Sprintf(":%d", p2pConfig.BindPort)
+		cfg.Peers = peers
+		cfg.TLS = fsConfig.TLS
+		return static.New(cfg)
+	default:
+		panic("Unknown transport: " + transportType)
+	}
+}
+
+// loadPeerSecret reads the secret shared by all peers from path.
+func loadPeerSecret(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret := bytes.TrimSpace(data)
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("%s must contain at least 16 bytes", path)
+	}
+	return secret, nil
+}
+
+func scrub() (libsyncer.ScrubConfig, error) {
+	rate, err := libsyncer.ParseByteSize(scrubRate)
+	if err != nil {
+		return libsyncer.ScrubConfig{}, fmt.Errorf("invalid --scrub-rate: %v", err)
+	}
+	return libsyncer.ScrubConfig{Interval: scrubInterval, Rate: rate}, nil
+}
+
+// volumes parses the --volume flags of the form path;price=formula;high=0.9;low=0.8;xattrs=true.
+func volumes() ([]libsyncer.VolumeConfig, error) {
+	maxTrashSize, err := libsyncer.ParseByteSize(trashSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --trash-size: %v", err)
+	}
+
+	var vols []libsyncer.VolumeConfig
+	for _, spec := range volumeSpecs {
+		options := strings.Split(spec, ";")
+		if info, err := os.Stat(options[0]); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("invalid volume %s: not a directory", options[0])
+		}
+		d := disk.Open(options[0])
+		d.TrashConfig = libsyncer.TrashConfig{Retention: trashRetention, MaxSize: maxTrashSize}
+		vol := libsyncer.VolumeConfig{Volume: d}
+		for _, option := range options[1:] {
+			v := strings.SplitN(option, "=", 2)
+			if len(v) != 2 {
+				return nil, fmt.Errorf("invalid volume option: %s", option)
+			}
+			var err error
+			switch v[0] {
+			case "price":
+				vol.PriceFormula, err = pricer(v[1])
+			case "high":
+				vol.HighWatermark, err = strconv.ParseFloat(v[1], 64)
+			case "low":
+				vol.LowWatermark, err = strconv.ParseFloat(v[1], 64)
+			case "xattrs":
+				d.Xattrs, err = strconv.ParseBool(v[1])
+			default:
+				return nil, fmt.Errorf("unknown volume option: %s", v[0])
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid volume option %s: %v", option, err)
+			}
+		}
+		vols = append(vols, vol)
+	}
+	return vols, nil
+}
+
+// syncerConfig builds the libsyncer.Config from the flags. It returns an error for the
+// first invalid flag.
+func syncerConfig(network transport, priceFormula libsyncer.PriceFormula) (libsyncer.Config, error) {
+	cfg := libsyncer.Config{
+		FileServerConfig: fsConfig,
+		AdminAddr:        adminAddr,
+		AdminToken:       adminToken,
+		PriceFormula:     priceFormula,
+		Labels:           nodeLabels,
+		Transport:        network,
+		Excludes:         excludes,
+		IndexDir:         indexDir,
+		PinsFile:         pinsFile,
+		Dedup:            dedupConfig,
+	}
+	var err error
+	if cfg.ThrottleConfig, err = throttle(); err != nil {
+		return cfg, err
+	}
+	if cfg.Pull, err = pull(); err != nil {
+		return cfg, err
+	}
+	if cfg.Conflict, err = conflict(); err != nil {
+		return cfg, err
+	}
+	if cfg.PeerLabels, err = labels(); err != nil {
+		return cfg, err
+	}
+	if cfg.Schedule, err = schedule(); err != nil {
+		return cfg, err
+	}
+	if cfg.Scrub, err = scrub(); err != nil {
+		return cfg, err
+	}
+	cfg.Volumes, err = volumes()
+	return cfg, err
+}
+
+// commands are the subcommands of mediasyncer. Most talk to the admin API of a running node.
+// Without a subcommand, the node is started.
+var commands = map[string]func(args []string){
+	"certs":      certsCommand,
+	"status":     statusCommand,
+	"peers":      peersCommand,
+	"ls":         lsCommand,
+	"find":       findCommand,
+	"get":        getCommand,
+	"put":        putCommand,
+	"pin":        pinCommand,
+	"drain":      drainCommand,
+	"trash":      trashCommand,
+	"duplicates": duplicatesCommand,
+}
+
+// exitUsage prints the usage of a subcommand and exits.
+func exitUsage(usage string) {
+	fmt.Fprint(os.Stderr, usage)
+	os.Exit(2)
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+
 	pflag.Parse()
 
+	var cfgFile *configFile
+	peers = pflag.Args()
+	if configPath != "" {
+		cfgFile = newConfigFile(configPath, pflag.CommandLine)
+		if err := cfgFile.apply(); err != nil {
+			panic("Invalid config file " + configPath + ": " + err.Error())
+		}
+		if len(peers) == 0 {
+			peers = cfgFile.peers
+		}
+	}
+
 	p2p.PrintMessages(printNetworkMessages)
+	static.PrintMessages(printNetworkMessages)
+
+	if adminAddr != "" && adminTokenFile != "" {
+		token, err := loadAdminToken(adminTokenFile)
+		if err != nil {
+			panic("Failed to load the admin token: " + err.Error())
+		}
+		adminToken = token
+	}
+
+	if peerSecretFile != "" {
+		secret, err := loadPeerSecret(peerSecretFile)
+		if err != nil {
+			panic("Failed to load the peer secret: " + err.Error())
+		}
+		fsConfig.Secret = secret
+	}
 
 	log.SetPrefix(p2pConfig.Name + " ")
 
-	network := p2p.New(p2pConfig)
-	network.Join(pflag.Args())
+	network := newTransport()
 
-	cfg := libsyncer.Config{
-		FileServerConfig: fsConfig,
-		PriceFormula:     pricer(),
-		Transport:        network,
-		Volume:           volume(),
+	priceFormula, err := pricer(formula)
+	if err != nil {
+		panic("Invalid --price-formula: " + err.Error())
+	}
+	var adaptivePricer *libsyncer.AdaptivePricer
+	if adaptive {
+		a, err := libsyncer.NewAdaptivePricer(network, priceFormula, adaptiveConfig)
+		if err != nil {
+			panic("Failed to load adaptive pricing: " + err.Error())
+		}
+		adaptivePricer = a
+		priceFormula = a.Formula()
+	}
+
+	cfg, err := syncerConfig(network, priceFormula)
+	if err != nil {
+		panic(err.Error())
 	}
 	syncer := libsyncer.New(cfg)
 	go syncer.Serve()
 
-	ch := make(chan os.Signal)
-	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
-	<-ch
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range ch {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if cfgFile == nil {
+			log.Println("Received SIGHUP, but no --config is given. Ignoring.")
+			continue
+		}
+		log.Println("Received SIGHUP. Reloading " + configPath + " ...")
+		if err := cfgFile.reload(syncer, network, adaptivePricer); err != nil {
+			log.Println("ERROR: Not reloading invalid " + configPath + ": " + err.Error())
+		}
+	}
 
 	log.Println("Received shutdown signal. Stopping ...")
 	syncer.Stop()
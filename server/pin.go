@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/spf13/pflag"
+
+	"github.com/zeisss/mediasyncer/libsyncer"
+)
+
+// pinCommand implements the `pin` subcommand. Pinned files are kept on their volume: they are
+// never auctioned, moved to another volume or retired as duplicates. Without paths, the
+// pinned files are listed.
+func pinCommand(args []string) {
+	flags := pflag.NewFlagSet("pin", pflag.ExitOnError)
+	admin := newAdminClient(flags)
+	volume := flags.String("volume", "", "Volume of the files, all volumes of the node are searched if empty")
+	remove := flags.Bool("remove", false, "Remove the pins of the files")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		var pins []libsyncer.FileID
+		if err := admin.do("GET", "/pins", nil, &pins); err != nil {
+			fatal(err)
+		}
+		admin.print(pins, func(w io.Writer) {
+			fmt.Fprintln(w, "VOLUME\tPATH")
+			for _, file := range pins {
+				fmt.Fprintf(w, "%s\t%s\n", file.VolumeID, file.Path)
+			}
+		})
+		return
+	}
+
+	method, verb := "POST", "Pinned"
+	if *remove {
+		method, verb = "DELETE", "Unpinned"
+	}
+	var files []libsyncer.FileID
+	for _, p := range flags.Args() {
+		query := url.Values{"path": {p}}
+		if *volume != "" {
+			query.Set("volume", *volume)
+		}
+		var file libsyncer.FileID
+		if err := admin.do(method, "/pins", query, &file); err != nil {
+			fatal(err)
+		}
+		files = append(files, file)
+	}
+	admin.print(files, func(w io.Writer) {
+		for _, file := range files {
+			fmt.Fprintf(w, "%s %s on volume %s\n", verb, file.Path, file.VolumeID)
+		}
+	})
+}
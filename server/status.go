@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	"github.com/zeisss/mediasyncer/libsyncer"
+)
+
+// statusCommand implements the `status` subcommand, which prints what a node is doing and
+// the space of its volumes.
+func statusCommand(args []string) {
+	flags := pflag.NewFlagSet("status", pflag.ExitOnError)
+	admin := newAdminClient(flags)
+	flags.Parse(args)
+
+	var status struct {
+		Node    libsyncer.NodeStatus     `json:"node"`
+		Volumes []libsyncer.VolumeStatus `json:"volumes"`
+	}
+	if err := admin.do("GET", "/status", nil, &status.Node); err != nil {
+		fatal(err)
+	}
+	if err := admin.do("GET", "/volumes", nil, &status.Volumes); err != nil {
+		fatal(err)
+	}
+
+	admin.print(status, func(w io.Writer) {
+		node := status.Node
+		auctioning := "running"
+		if node.Paused {
+			auctioning = "paused"
+		}
+		fmt.Fprintf(w, "Name:\t%s\n", node.Name)
+		fmt.Fprintf(w, "Protocol:\t%d\n", node.Version)
+		fmt.Fprintf(w, "Peers:\t%d\n", node.Peers)
+		fmt.Fprintf(w, "Auctioning:\t%s, %d auctions, %d uploads\n", auctioning, node.Auctions, node.Uploads)
+		fmt.Fprintf(w, "Bidding:\t%d bids, %d downloads\n", node.Bids, node.Downloads)
+		fmt.Fprintf(w, "Corrupt files:\t%d\n", node.Corrupt)
+		fmt.Fprintln(w)
+		printVolumes(w, status.Volumes)
+	})
+}
+
+// printVolumes prints a table of the volumes.
+func printVolumes(w io.Writer, volumes []libsyncer.VolumeStatus) {
+	fmt.Fprintln(w, "VOLUME\tCAPACITY\tFREE\tFILL\tHIGH\tLOW\tRESERVED\tDRAINING")
+	for _, vol := range volumes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%.0f%%\t%.0f%%\t%.0f%%\t%s\t%v\n", vol.ID, humanSize(vol.Capacity), humanSize(vol.Free),
+			vol.Fill*100, vol.HighWatermark*100, vol.LowWatermark*100, humanSize(vol.Reserved), vol.Draining)
+	}
+}
+
+// peersCommand implements the `peers` subcommand, which prints the peers known to a node.
+func peersCommand(args []string) {
+	flags := pflag.NewFlagSet("peers", pflag.ExitOnError)
+	admin := newAdminClient(flags)
+	flags.Parse(args)
+
+	var peers []libsyncer.PeerStatus
+	if err := admin.do("GET", "/peers", nil, &peers); err != nil {
+		fatal(err)
+	}
+	admin.print(peers, func(w io.Writer) {
+		fmt.Fprintln(w, "PEER\tURL\tVOLUMES\tCAPACITY\tFREE\tLABELS\tPROTOCOL")
+		for _, peer := range peers {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%d\n", peer.Name, peer.URL, len(peer.Volumes),
+				humanSize(peer.Capacity), humanSize(peer.Free), strings.Join(peer.Labels, ","), peer.Version)
+		}
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/zeisss/mediasyncer/disk"
+	"github.com/zeisss/mediasyncer/libsyncer"
+)
+
+const trashUsage = `Usage: mediasyncer trash list [--volume-id=ID | --volume=PATH...]
+       mediasyncer trash restore [--volume-id=ID | --volume=PATH] ID...
+
+Lists the files kept in the trash of the volumes after they were transfered to
+other peers, or restores them to their original path. The trash is managed
+through the admin API of the node, or with --volume directly on the disk, even
+if the node is not running.
+`
+
+// trashCommand implements the `trash` subcommand.
+func trashCommand(args []string) {
+	if len(args) == 0 {
+		exitUsage(trashUsage)
+	}
+
+	flags := pflag.NewFlagSet("trash", pflag.ExitOnError)
+	admin := newAdminClient(flags)
+	paths := flags.StringArray("volume", nil, "Volume to work on directly, options like ';price=...' are ignored. Can be repeated")
+	volumeID := flags.String("volume-id", "", "Volume of the node to work on, all volumes if empty")
+	flags.Parse(args[1:])
+
+	if len(*paths) == 0 {
+		trashAdminCommand(admin, args[0], *volumeID, flags.Args())
+		return
+	}
+
+	var vols []*disk.Volume
+	for _, path := range *paths {
+		vols = append(vols, disk.Open(strings.SplitN(path, ";", 2)[0]))
+	}
+
+	switch args[0] {
+	case "list":
+		var trash []libsyncer.TrashStatus
+		for _, vol := range vols {
+			entries, err := vol.TrashEntries()
+			if err != nil {
+				fatal(err)
+			}
+			for _, entry := range entries {
+				trash = append(trash, libsyncer.TrashStatus{Volume: vol.Path, ID: entry.ID, Path: entry.Path, Size: entry.Size, Deleted: entry.Deleted})
+			}
+		}
+		admin.print(trash, func(w io.Writer) {
+			printTrash(w, trash)
+		})
+	case "restore":
+		if len(vols) != 1 || flags.NArg() == 0 {
+			exitUsage(trashUsage)
+		}
+		for _, id := range flags.Args() {
+			path, err := libsyncer.RestoreFile(vols[0], id)
+			if err != nil {
+				fatal(err)
+			}
+			fmt.Printf("Restored %s\n", path)
+		}
+	default:
+		exitUsage(trashUsage)
+	}
+}
+
+// trashAdminCommand manages the trash through the admin API.
+func trashAdminCommand(admin *adminClient, command, volume string, ids []string) {
+	query := url.Values{}
+	if volume != "" {
+		query.Set("volume", volume)
+	}
+
+	switch command {
+	case "list":
+		var trash []libsyncer.TrashStatus
+		if err := admin.do("GET", "/trash", query, &trash); err != nil {
+			fatal(err)
+		}
+		admin.print(trash, func(w io.Writer) {
+			printTrash(w, trash)
+		})
+	case "restore":
+		if len(ids) == 0 {
+			exitUsage(trashUsage)
+		}
+		query.Set("action", "restore")
+		var files []libsyncer.FileID
+		for _, id := range ids {
+			query.Set("id", id)
+			var file libsyncer.FileID
+			if err := admin.do("POST", "/trash", query, &file); err != nil {
+				fatal(err)
+			}
+			files = append(files, file)
+		}
+		admin.print(files, func(w io.Writer) {
+			for _, file := range files {
+				fmt.Fprintf(w, "Restored %s on volume %s\n", file.Path, file.VolumeID)
+			}
+		})
+	default:
+		exitUsage(trashUsage)
+	}
+}
+
+func printTrash(w io.Writer, trash []libsyncer.TrashStatus) {
+	fmt.Fprintln(w, "VOLUME\tID\tSIZE\tDELETED")
+	for _, entry := range trash {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", entry.Volume, entry.ID, entry.Size, entry.Deleted.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,436 @@
+// Package static provides an implementation of libsyncer.Transport for a static list of peers,
+// which exchange their messages via HTTP(S) requests. It can be used where the gossip of
+// memberlist is blocked, e.g. in Docker bridge networks.
+package static
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeisss/mediasyncer/libsyncer"
+)
+
+var (
+	printMessages = true
+)
+
+// PrintMessages enables (or disables) some debug output via the log package.
+func PrintMessages(b bool) {
+	printMessages = b
+}
+
+// MessageTypeHeader contains the libsyncer.MessageType of a message.
+const MessageTypeHeader = "X-Mediasyncer-Message-Type"
+
+type Callback func(peer string, messageType libsyncer.MessageType, message string)
+
+// PeerCallback is invoked for join, leave and update events of other peers.
+type PeerCallback func(event libsyncer.PeerEvent, peer string, meta libsyncer.NodeMeta)
+
+// Config defines the configuration of the Transport.
+type Config struct {
+	// Name of the local peer. Must be unique within the network.
+	Name string
+
+	// Addr is the address to listen on, e.g. ":8000".
+	Addr string
+
+	// Peers are the addresses (host:port) of the other peers. Every peer must list all others.
+	Peers []string
+
+	// TLS enables HTTPS with client certificates. The peer name is taken from the certificates then.
+	TLS libsyncer.TLSConfig
+
+	// ProbeInterval is how often the peers are contacted to detect joins, leaves and
+	// metadata updates.
+	ProbeInterval time.Duration
+
+	// Timeout limits each request to another peer.
+	Timeout time.Duration
+}
+
+// DefaultConfig returns a Config probing the peers every 5 seconds.
+func DefaultConfig() Config {
+	return Config{
+		Addr:          ":8000",
+		ProbeInterval: 5 * time.Second,
+		Timeout:       10 * time.Second,
+	}
+}
+
+// Transport implements libsyncer.Transport with HTTP requests to a static list of peers.
+// A peer is considered alive as long as it answers the probes.
+type Transport struct {
+	cfg Config
+
+	server *http.Server
+	client *http.Client
+	scheme string
+
+	mu              sync.Mutex
+	meta            libsyncer.NodeMeta
+	peers           map[string]*peer
+	subscribers     map[libsyncer.MessageType][]Callback
+	peerSubscribers []PeerCallback
+
+	events chan peerEvent
+	stop   chan struct{}
+}
+
+// peer is the state of a configured peer address.
+type peer struct {
+	addr  string
+	name  string
+	meta  libsyncer.NodeMeta
+	alive bool
+}
+
+type peerEvent struct {
+	event libsyncer.PeerEvent
+	name  string
+	meta  libsyncer.NodeMeta
+}
+
+// status is returned by a peer when being probed.
+type status struct {
+	Name string             `json:"name"`
+	Meta libsyncer.NodeMeta `json:"meta"`
+}
+
+// New creates a Transport and starts listening on cfg.Addr and probing the peers.
+func New(cfg Config) *Transport {
+	t := &Transport{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		scheme: "http",
+
+		peers:       make(map[string]*peer),
+		subscribers: make(map[libsyncer.MessageType][]Callback),
+		events:      make(chan peerEvent, 256),
+		stop:        make(chan struct{}),
+	}
+	for _, addr := range cfg.Peers {
+		t.peers[addr] = &peer{addr: addr}
+	}
+
+	l, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		panic(err.Error())
+	}
+	if cfg.TLS.Enabled() {
+		serverCfg, err := cfg.TLS.ServerConfig()
+		if err != nil {
+			panic("Failed to load TLS config: " + err.Error())
+		}
+		clientCfg, err := cfg.TLS.ClientConfig()
+		if err != nil {
+			panic("Failed to load TLS config: " + err.Error())
+		}
+		l = tls.NewListener(l, serverCfg)
+		t.client.Transport = &http.Transport{TLSClientConfig: clientCfg}
+		t.scheme = "https"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", t.handleStatus)
+	mux.HandleFunc("/message", t.handleMessage)
+	t.server = &http.Server{Handler: mux}
+	go t.server.Serve(l)
+
+	go t.dispatchPeerEvents()
+	go t.probeLoop()
+	return t
+}
+
+// Name returns peerID of the current node.
+func (t *Transport) Name() string {
+	return t.cfg.Name
+}
+
+// Leave stops probing the peers and shuts down the HTTP server.
+func (t *Transport) Leave(timeout time.Duration) error {
+	close(t.stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return t.server.Shutdown(ctx)
+}
+
+// Subscribe creates a subscription for messageType and invokes callback for any new message
+// arriving over the transport.
+func (t *Transport) Subscribe(messageType libsyncer.MessageType, callback func(peer string, messageType libsyncer.MessageType, message string)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.subscribers[messageType] = append(t.subscribers[messageType], callback)
+}
+
+// OnPeerEvent invokes callback whenever another peer joins, leaves or updates its metadata.
+// The callbacks are invoked one after another in the order of the events.
+func (t *Transport) OnPeerEvent(callback func(event libsyncer.PeerEvent, peer string, meta libsyncer.NodeMeta)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.peerSubscribers = append(t.peerSubscribers, callback)
+}
+
+// SetMeta updates the metadata advertised for the local node. The peers see the update
+// with their next probe.
+func (t *Transport) SetMeta(meta libsyncer.NodeMeta) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.meta = meta
+	return nil
+}
+
+// Peers returns the metadata of all alive peers.
+func (t *Transport) Peers() map[string]libsyncer.NodeMeta {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	peers := make(map[string]libsyncer.NodeMeta)
+	for _, p := range t.peers {
+		if p.alive {
+			peers[p.name] = p.meta
+		}
+	}
+	return peers
+}
+
+// Send sends message tagged with messageType to the given peer. If the peers
+// has any subscriptions for messageType, their callbacks will be invoked.
+func (t *Transport) Send(peer string, messageType libsyncer.MessageType, message string) error {
+	if printMessages {
+		log.Printf("SENDING %s, %s:\t%s\n", peer, messageType, message)
+	}
+
+	if len(message) > libsyncer.MaxMessageSize {
+		return fmt.Errorf("%s message exceeds %d bytes", messageType, libsyncer.MaxMessageSize)
+	}
+	addr, ok := t.addr(peer)
+	if !ok {
+		return fmt.Errorf("unknown peer %s", peer)
+	}
+	return t.send(addr, messageType, message)
+}
+
+// BroadcastTCP sends a message to each alive peer. The peers are contacted concurrently and
+// a failure for one peer does not stop the broadcast to the others. All failures are
+// returned as a *libsyncer.BroadcastError.
+func (t *Transport) BroadcastTCP(messageType libsyncer.MessageType, message string) error {
+	if printMessages {
+		log.Printf("BROADCAST %s:\t%s\n", messageType, message)
+	}
+
+	if len(message) > libsyncer.MaxMessageSize {
+		return fmt.Errorf("%s message exceeds %d bytes", messageType, libsyncer.MaxMessageSize)
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		errors = make(map[string]error)
+	)
+	for name, addr := range t.addrs() {
+		wg.Add(1)
+		go func(name, addr string) {
+			defer wg.Done()
+			if err := t.send(addr, messageType, message); err != nil {
+				mu.Lock()
+				errors[name] = err
+				mu.Unlock()
+			}
+		}(name, addr)
+	}
+	wg.Wait()
+
+	if len(errors) > 0 {
+		return &libsyncer.BroadcastError{Errors: errors}
+	}
+	return nil
+}
+
+func (t *Transport) send(addr string, messageType libsyncer.MessageType, message string) error {
+	req, err := http.NewRequest("POST", t.scheme+"://"+addr+"/message", strings.NewReader(message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(libsyncer.PeerHeader, t.Name())
+	req.Header.Set(MessageTypeHeader, string(messageType))
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("sending %s failed: %s", messageType, resp.Status)
+	}
+	return nil
+}
+
+// addr returns the address of the alive peer with the given name.
+func (t *Transport) addr(name string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, p := range t.peers {
+		if p.alive && p.name == name {
+			return p.addr, true
+		}
+	}
+	return "", false
+}
+
+// addrs returns the addresses of all alive peers by name.
+func (t *Transport) addrs() map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	addrs := make(map[string]string)
+	for _, p := range t.peers {
+		if p.alive {
+			addrs[p.name] = p.addr
+		}
+	}
+	return addrs
+}
+
+// sender returns the name of the peer sending req. With TLS, the name is taken from the
+// verified client certificate.
+func sender(req *http.Request) string {
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		return req.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return req.Header.Get(libsyncer.PeerHeader)
+}
+
+func (t *Transport) handleStatus(w http.ResponseWriter, req *http.Request) {
+	t.mu.Lock()
+	s := status{Name: t.Name(), Meta: t.meta}
+	t.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+func (t *Transport) handleMessage(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	peer := sender(req)
+	if _, ok := t.addr(peer); !ok {
+		log.Printf("Dropping message from unknown peer %s\n", peer)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, libsyncer.MaxMessageSize))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	messageType := libsyncer.MessageType(req.Header.Get(MessageTypeHeader))
+	if printMessages {
+		log.Printf("RECEIVED %s, %s:\t%s\n", peer, messageType, body)
+	}
+
+	t.mu.Lock()
+	subscribers := t.subscribers[messageType]
+	t.mu.Unlock()
+	for _, cb := range subscribers {
+		go cb(peer, messageType, string(body))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (t *Transport) probeLoop() {
+	ticker := time.NewTicker(t.cfg.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, addr := range t.cfg.Peers {
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				t.probe(addr)
+			}(addr)
+		}
+		wg.Wait()
+
+		select {
+		case <-ticker.C:
+		case <-t.stop:
+			close(t.events)
+			return
+		}
+	}
+}
+
+// probe asks the peer at addr for its name and metadata and emits the resulting events.
+func (t *Transport) probe(addr string) {
+	var s status
+	resp, err := t.client.Get(t.scheme + "://" + addr + "/status")
+	if err == nil {
+		err = json.NewDecoder(resp.Body).Decode(&s)
+		if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+			s.Name = resp.TLS.PeerCertificates[0].Subject.CommonName
+		}
+		resp.Body.Close()
+	}
+
+	for _, e := range t.update(addr, s, err == nil && s.Name != "") {
+		t.events <- e
+	}
+}
+
+// update records the result of a probe and returns the resulting events.
+func (t *Transport) update(addr string, s status, alive bool) []peerEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.peers[addr]
+	if !alive {
+		if !p.alive {
+			return nil
+		}
+		p.alive = false
+		return []peerEvent{{libsyncer.PeerLeft, p.name, p.meta}}
+	}
+
+	var events []peerEvent
+	switch {
+	case p.alive && p.name != s.Name:
+		// Another peer took over the address.
+		events = append(events, peerEvent{libsyncer.PeerLeft, p.name, p.meta}, peerEvent{libsyncer.PeerJoined, s.Name, s.Meta})
+	case !p.alive:
+		events = append(events, peerEvent{libsyncer.PeerJoined, s.Name, s.Meta})
+	case !reflect.DeepEqual(p.meta, s.Meta):
+		events = append(events, peerEvent{libsyncer.PeerUpdated, s.Name, s.Meta})
+	}
+	p.alive = true
+	p.name = s.Name
+	p.meta = s.Meta
+	return events
+}
+
+func (t *Transport) dispatchPeerEvents() {
+	for e := range t.events {
+		if printMessages {
+			log.Printf("PEER %s %s\n", e.event, e.name)
+		}
+
+		t.mu.Lock()
+		subscribers := t.peerSubscribers
+		t.mu.Unlock()
+		for _, cb := range subscribers {
+			cb(e.event, e.name, e.meta)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package static
+
+import (
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zeisss/mediasyncer/libsyncer"
+)
+
+// freeAddr returns a local address no one is listening on.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// waitFor polls cond until it is true or a second passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func newTestTransport(name, addr string, peers ...string) *Transport {
+	cfg := DefaultConfig()
+	cfg.Name = name
+	cfg.Addr = addr
+	cfg.Peers = peers
+	cfg.ProbeInterval = 10 * time.Millisecond
+	cfg.Timeout = time.Second
+	return New(cfg)
+}
+
+type received struct {
+	peer        string
+	messageType libsyncer.MessageType
+	message     string
+}
+
+func TestTransport(t *testing.T) {
+	addrA, addrB := freeAddr(t), freeAddr(t)
+	a := newTestTransport("a", addrA, addrB)
+	b := newTestTransport("b", addrB, addrA)
+	defer b.Leave(time.Second)
+
+	messages := make(chan received, 10)
+	b.Subscribe("test", func(peer string, messageType libsyncer.MessageType, message string) {
+		messages <- received{peer, messageType, message}
+	})
+	left := make(chan string, 10)
+	b.OnPeerEvent(func(event libsyncer.PeerEvent, peer string, meta libsyncer.NodeMeta) {
+		if event == libsyncer.PeerLeft {
+			left <- peer
+		}
+	})
+
+	a.SetMeta(libsyncer.NodeMeta{URL: "http://a/"})
+	waitFor(t, "the peers to join", func() bool {
+		return b.Peers()["a"].URL == "http://a/" && len(a.Peers()) == 1
+	})
+
+	if err := a.Send("b", "test", "hello\tworld"); err != nil {
+		t.Fatal(err)
+	}
+	if m := <-messages; m != (received{"a", "test", "hello\tworld"}) {
+		t.Fatalf("Unexpected message %+v", m)
+	}
+	if err := a.BroadcastTCP("test", "everyone"); err != nil {
+		t.Fatal(err)
+	}
+	if m := <-messages; m != (received{"a", "test", "everyone"}) {
+		t.Fatalf("Unexpected message %+v", m)
+	}
+
+	if err := a.Send("c", "test", "hello"); err == nil {
+		t.Errorf("Expected an error for an unknown peer")
+	}
+	if err := a.Send("b", "test", strings.Repeat("x", libsyncer.MaxMessageSize+1)); err == nil {
+		t.Errorf("Expected an error for an oversized message")
+	}
+
+	// Messages are only accepted from configured peers.
+	req, _ := http.NewRequest("POST", "http://"+addrB+"/message", strings.NewReader("hello"))
+	req.Header.Set(libsyncer.PeerHeader, "mallory")
+	req.Header.Set(MessageTypeHeader, "test")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 for an unknown peer, got %s", resp.Status)
+	}
+
+	a.Leave(time.Second)
+	select {
+	case peer := <-left:
+		if peer != "a" {
+			t.Fatalf("Expected a to leave, got %s", peer)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for a to leave")
+	}
+	if peers := b.Peers(); len(peers) != 0 {
+		t.Fatalf("Expected no peers, got %v", peers)
+	}
+}
+
+func TestTransportUpdate(t *testing.T) {
+	tr := &Transport{peers: map[string]*peer{"host:8000": {addr: "host:8000"}}}
+	meta := libsyncer.NodeMeta{URL: "http://host/"}
+	updated := libsyncer.NodeMeta{URL: "http://host/", Labels: []string{"always-on"}}
+
+	for _, step := range []struct {
+		name   string
+		status status
+		alive  bool
+		events []peerEvent
+	}{
+		{"unreachable", status{}, false, nil},
+		{"join", status{"b", meta}, true, []peerEvent{{libsyncer.PeerJoined, "b", meta}}},
+		{"unchanged", status{"b", meta}, true, nil},
+		{"meta update", status{"b", updated}, true, []peerEvent{{libsyncer.PeerUpdated, "b", updated}}},
+		{"new peer at the address", status{"c", meta}, true, []peerEvent{{libsyncer.PeerLeft, "b", updated}, {libsyncer.PeerJoined, "c", meta}}},
+		{"leave", status{}, false, []peerEvent{{libsyncer.PeerLeft, "c", meta}}},
+		{"still gone", status{}, false, nil},
+	} {
+		if events := tr.update("host:8000", step.status, step.alive); !reflect.DeepEqual(events, step.events) {
+			t.Fatalf("%s: expected %+v, got %+v", step.name, step.events, events)
+		}
+	}
+}